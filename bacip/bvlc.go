@@ -0,0 +1,243 @@
+package bacip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// BVLCResultCode is the result of a BVLL request to a BBMD
+type BVLCResultCode uint16
+
+const (
+	BVLCResultSuccessful                      BVLCResultCode = 0x0000
+	BVLCResultWriteBDTNAK                     BVLCResultCode = 0x0010
+	BVLCResultReadBDTNAK                      BVLCResultCode = 0x0020
+	BVLCResultRegisterForeignDeviceNAK        BVLCResultCode = 0x0030
+	BVLCResultReadFDTNAK                      BVLCResultCode = 0x0040
+	BVLCResultDeleteFDTEntryNAK               BVLCResultCode = 0x0050
+	BVLCResultDistributeBroadcastToNetworkNAK BVLCResultCode = 0x0060
+)
+
+var bvlcResultNames = map[BVLCResultCode]string{
+	BVLCResultSuccessful:                      "successful completion",
+	BVLCResultWriteBDTNAK:                     "Write-Broadcast-Distribution-Table NAK",
+	BVLCResultReadBDTNAK:                      "Read-Broadcast-Distribution-Table NAK",
+	BVLCResultRegisterForeignDeviceNAK:        "Register-Foreign-Device NAK",
+	BVLCResultReadFDTNAK:                      "Read-Foreign-Device-Table NAK",
+	BVLCResultDeleteFDTEntryNAK:               "Delete-Foreign-Device-Table-Entry NAK",
+	BVLCResultDistributeBroadcastToNetworkNAK: "Distribute-Broadcast-To-Network NAK",
+}
+
+func (c BVLCResultCode) String() string {
+	if name, ok := bvlcResultNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("BVLCResultCode(0x%04x)", uint16(c))
+}
+
+// BVLCResult is the answer of a BBMD to a BVLL request. A code other
+// than BVLCResultSuccessful is a NAK, returned as error by the client.
+// A NAK can be checked with errors.Is(err, BVLCResult{Code: code}).
+type BVLCResult struct {
+	Code BVLCResultCode
+}
+
+func (r BVLCResult) Error() string {
+	return fmt.Sprintf("bvlc result: %s", r.Code)
+}
+
+func (r BVLCResult) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint16(nil, uint16(r.Code)), nil
+}
+
+func (r *BVLCResult) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("invalid BVLC-Result length %d", len(data))
+	}
+	r.Code = BVLCResultCode(binary.BigEndian.Uint16(data))
+	return nil
+}
+
+// RegisterForeignDevice asks a BBMD to forward the broadcasts to the
+// sender for TTL seconds
+type RegisterForeignDevice struct {
+	TTL uint16
+}
+
+func (r RegisterForeignDevice) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint16(nil, r.TTL), nil
+}
+
+func (r *RegisterForeignDevice) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("invalid Register-Foreign-Device length %d", len(data))
+	}
+	r.TTL = binary.BigEndian.Uint16(data)
+	return nil
+}
+
+// bipAddressLength is the length of a B/IP address: the IPv4 address
+// followed by the UDP port
+const bipAddressLength = 6
+
+func appendBIPAddress(b []byte, addr net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	b = append(b, ip...)
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+func decodeBIPAddress(data []byte) net.UDPAddr {
+	return net.UDPAddr{
+		IP:   net.IPv4(data[0], data[1], data[2], data[3]),
+		Port: int(binary.BigEndian.Uint16(data[4:])),
+	}
+}
+
+// BDTEntry is an entry of a Broadcast Distribution Table. The
+// broadcasts are forwarded to the address of the BBMD with the bits
+// cleared in the mask set, i.e. a mask of 255.255.255.255 sends them
+// to the BBMD, which broadcasts them on its subnet.
+type BDTEntry struct {
+	Addr net.UDPAddr
+	Mask net.IPMask
+}
+
+// ForwardAddress returns the address the broadcasts are forwarded to
+func (e BDTEntry) ForwardAddress() *net.UDPAddr {
+	ip := e.Addr.IP.To4()
+	mask := e.Mask
+	if len(mask) != net.IPv4len {
+		mask = net.CIDRMask(32, 32)
+	}
+	dst := make(net.IP, net.IPv4len)
+	for i := range dst {
+		dst[i] = ip[i] | ^mask[i]
+	}
+	return &net.UDPAddr{IP: dst, Port: e.Addr.Port}
+}
+
+// BroadcastDistributionTable is the payload of Write-BDT and of
+// Read-BDT-Ack
+type BroadcastDistributionTable struct {
+	Entries []BDTEntry
+}
+
+func (t BroadcastDistributionTable) MarshalBinary() ([]byte, error) {
+	b := []byte{}
+	for _, e := range t.Entries {
+		if e.Addr.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid BDT entry address %v", e.Addr)
+		}
+		mask := e.Mask
+		if len(mask) != net.IPv4len {
+			return nil, fmt.Errorf("invalid BDT entry mask %v", e.Mask)
+		}
+		b = appendBIPAddress(b, e.Addr)
+		b = append(b, mask...)
+	}
+	return b, nil
+}
+
+func (t *BroadcastDistributionTable) UnmarshalBinary(data []byte) error {
+	const entryLength = bipAddressLength + net.IPv4len
+	if len(data)%entryLength != 0 {
+		return fmt.Errorf("invalid BDT length %d", len(data))
+	}
+	t.Entries = []BDTEntry{}
+	for i := 0; i < len(data); i += entryLength {
+		mask := make(net.IPMask, net.IPv4len)
+		copy(mask, data[i+bipAddressLength:i+entryLength])
+		t.Entries = append(t.Entries, BDTEntry{
+			Addr: decodeBIPAddress(data[i:]),
+			Mask: mask,
+		})
+	}
+	return nil
+}
+
+// FDTEntry is an entry of a Foreign Device Table
+type FDTEntry struct {
+	Addr net.UDPAddr
+	// TTL is the time to live given at registration, in seconds
+	TTL uint16
+	// Remaining is the number of seconds before the entry expires,
+	// it includes the grace period of 30 seconds
+	Remaining uint16
+}
+
+// ForeignDeviceTable is the payload of Read-FDT-Ack
+type ForeignDeviceTable struct {
+	Entries []FDTEntry
+}
+
+func (t ForeignDeviceTable) MarshalBinary() ([]byte, error) {
+	b := []byte{}
+	for _, e := range t.Entries {
+		if e.Addr.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid FDT entry address %v", e.Addr)
+		}
+		b = appendBIPAddress(b, e.Addr)
+		b = binary.BigEndian.AppendUint16(b, e.TTL)
+		b = binary.BigEndian.AppendUint16(b, e.Remaining)
+	}
+	return b, nil
+}
+
+func (t *ForeignDeviceTable) UnmarshalBinary(data []byte) error {
+	const entryLength = bipAddressLength + 4
+	if len(data)%entryLength != 0 {
+		return fmt.Errorf("invalid FDT length %d", len(data))
+	}
+	t.Entries = []FDTEntry{}
+	for i := 0; i < len(data); i += entryLength {
+		t.Entries = append(t.Entries, FDTEntry{
+			Addr:      decodeBIPAddress(data[i:]),
+			TTL:       binary.BigEndian.Uint16(data[i+bipAddressLength:]),
+			Remaining: binary.BigEndian.Uint16(data[i+bipAddressLength+2:]),
+		})
+	}
+	return nil
+}
+
+// DeleteForeignDeviceTableEntry asks a BBMD to remove a foreign
+// device from its table
+type DeleteForeignDeviceTableEntry struct {
+	Addr net.UDPAddr
+}
+
+func (d DeleteForeignDeviceTableEntry) MarshalBinary() ([]byte, error) {
+	if d.Addr.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid FDT entry address %v", d.Addr)
+	}
+	return appendBIPAddress(nil, d.Addr), nil
+}
+
+func (d *DeleteForeignDeviceTableEntry) UnmarshalBinary(data []byte) error {
+	if len(data) != bipAddressLength {
+		return fmt.Errorf("invalid Delete-Foreign-Device-Table-Entry length %d", len(data))
+	}
+	d.Addr = decodeBIPAddress(data)
+	return nil
+}
+
+// newBVLCPayload returns the payload used to decode the functions not
+// carrying a NPDU
+func newBVLCPayload(f Function) Payload {
+	switch f {
+	case BacFuncResult:
+		return &BVLCResult{}
+	case BacFuncRegisterForeignDevice:
+		return &RegisterForeignDevice{}
+	case BacFuncWriteBroadcastDistributionTable, BacFuncBroadcastDistributionTableAck:
+		return &BroadcastDistributionTable{}
+	case BacFuncReadForeignDeviceTableAck:
+		return &ForeignDeviceTable{}
+	case BacFuncDeleteForeignDeviceTableEntry:
+		return &DeleteForeignDeviceTableEntry{}
+	}
+	return &DataPayload{}
+}
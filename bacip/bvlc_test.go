@@ -0,0 +1,77 @@
+package bacip
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestBDTEntryForwardAddress(t *testing.T) {
+	is := is.New(t)
+	e := BDTEntry{Addr: net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 47808}, Mask: net.CIDRMask(24, 32)}
+	is.Equal(e.ForwardAddress().String(), "192.168.1.255:47808") // one-hop: directed broadcast
+	e.Mask = net.CIDRMask(32, 32)
+	is.Equal(e.ForwardAddress().String(), "192.168.1.10:47808") // two-hop: the BBMD itself
+}
+
+func TestBVLCTablesCoherency(t *testing.T) {
+	ttc := []struct {
+		name    string
+		data    string //hex string
+		payload Payload
+	}{
+		{
+			name: "Read-BDT-Ack",
+			data: "8103000ec0a8010abac0ffffffff",
+			payload: &BroadcastDistributionTable{Entries: []BDTEntry{
+				{Addr: net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 47808}, Mask: net.CIDRMask(32, 32)},
+			}},
+		},
+		{
+			name: "Read-FDT-Ack",
+			data: "8107000e0a000005bac0003c0050",
+			payload: &ForeignDeviceTable{Entries: []FDTEntry{
+				{Addr: net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 47808}, TTL: 60, Remaining: 80},
+			}},
+		},
+		{
+			name:    "Delete-FDT-Entry",
+			data:    "8108000a0a000005bac0",
+			payload: &DeleteForeignDeviceTableEntry{Addr: net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 47808}},
+		},
+		{
+			name:    "Register-Foreign-Device",
+			data:    "81050006003c",
+			payload: &RegisterForeignDevice{TTL: 60},
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			b, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var bvlc BVLC
+			is.NoErr(bvlc.UnmarshalBinary(b))
+			is.Equal(bvlc.Payload, tc.payload)
+			b2, err := bvlc.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(hex.EncodeToString(b2), tc.data)
+		})
+	}
+}
+
+func TestForwardedNPDUCoherency(t *testing.T) {
+	is := is.New(t)
+	// Forwarded WhoIs of 10.0.0.5:47808
+	b, err := hex.DecodeString("8104000e0a000005bac001001008")
+	is.NoErr(err)
+	var bvlc BVLC
+	is.NoErr(bvlc.UnmarshalBinary(b))
+	is.Equal(bvlc.Origin.String(), "10.0.0.5:47808")
+	is.Equal(bvlc.NPDU.ADPU.ServiceType, ServiceUnconfirmedWhoIs)
+	b2, err := bvlc.MarshalBinary()
+	is.NoErr(err)
+	is.Equal(b2, b)
+}
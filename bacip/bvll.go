@@ -0,0 +1,139 @@
+package bacip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// bvllRequests matches the answers of the BBMDs with the pending
+// requests. The answers don't identify the request they answer, so
+// the requests to a BBMD are sent one at a time.
+type bvllRequests struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingBVLL
+}
+
+type pendingBVLL struct {
+	answers chan BVLC
+	// done is closed at the end of the request
+	done chan struct{}
+}
+
+// start waits for the end of the request in progress to peer, if any,
+// and registers a new one
+func (r *bvllRequests) start(ctx context.Context, peer string) (chan BVLC, error) {
+	for {
+		r.mutex.Lock()
+		p, busy := r.pending[peer]
+		if !busy {
+			p = &pendingBVLL{answers: make(chan BVLC, 1), done: make(chan struct{})}
+			r.pending[peer] = p
+			r.mutex.Unlock()
+			return p.answers, nil
+		}
+		r.mutex.Unlock()
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *bvllRequests) stop(peer string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if p, ok := r.pending[peer]; ok {
+		close(p.done)
+		delete(r.pending, peer)
+	}
+}
+
+// deliver passes the answer to the pending request to peer. It
+// returns false if there is none.
+func (r *bvllRequests) deliver(peer string, answer BVLC) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.pending[peer]
+	if !ok {
+		return false
+	}
+	select {
+	case p.answers <- answer:
+	default:
+	}
+	return true
+}
+
+// bvllRequest sends the request to the BBMD and waits for its answer.
+// The request is retried as a confirmed request. A NAK is returned
+// as a BVLCResult error.
+func (c *Client) bvllRequest(ctx context.Context, bbmd *net.UDPAddr, request BVLC) (BVLC, error) {
+	link, ok := c.link.(*IPv4Link)
+	if !ok {
+		return BVLC{}, fmt.Errorf("%v needs a BACnet/IP client", request.Function)
+	}
+	c.settingsMutex.Lock()
+	timings := c.timings
+	c.settingsMutex.Unlock()
+	return link.request(ctx, bbmd, request, timings)
+}
+
+// ReadBDT returns the broadcast distribution table of the BBMD
+func (c *Client) ReadBDT(ctx context.Context, bbmd *net.UDPAddr) ([]BDTEntry, error) {
+	answer, err := c.bvllRequest(ctx, bbmd, BVLC{Function: BacFuncBroadcastDistributionTable})
+	if err != nil {
+		return nil, fmt.Errorf("read BDT of %v: %w", bbmd, err)
+	}
+	bdt, ok := answer.Payload.(*BroadcastDistributionTable)
+	if !ok || answer.Function != BacFuncBroadcastDistributionTableAck {
+		return nil, fmt.Errorf("read BDT of %v: unexpected answer %v", bbmd, answer.Function)
+	}
+	return bdt.Entries, nil
+}
+
+// WriteBDT replaces the broadcast distribution table of the BBMD. A
+// refusal of the BBMD is returned as BVLCResult{BVLCResultWriteBDTNAK}.
+func (c *Client) WriteBDT(ctx context.Context, bbmd *net.UDPAddr, entries []BDTEntry) error {
+	return c.bvllCommand(ctx, bbmd, BVLC{
+		Function: BacFuncWriteBroadcastDistributionTable,
+		Payload:  &BroadcastDistributionTable{Entries: entries},
+	})
+}
+
+// ReadFDT returns the foreign devices registered to the BBMD
+func (c *Client) ReadFDT(ctx context.Context, bbmd *net.UDPAddr) ([]FDTEntry, error) {
+	answer, err := c.bvllRequest(ctx, bbmd, BVLC{Function: BacFuncReadForeignDeviceTable})
+	if err != nil {
+		return nil, fmt.Errorf("read FDT of %v: %w", bbmd, err)
+	}
+	fdt, ok := answer.Payload.(*ForeignDeviceTable)
+	if !ok || answer.Function != BacFuncReadForeignDeviceTableAck {
+		return nil, fmt.Errorf("read FDT of %v: unexpected answer %v", bbmd, answer.Function)
+	}
+	return fdt.Entries, nil
+}
+
+// DeleteFDTEntry removes the foreign device at addr from the table of
+// the BBMD. An unknown device is returned as
+// BVLCResult{BVLCResultDeleteFDTEntryNAK}.
+func (c *Client) DeleteFDTEntry(ctx context.Context, bbmd *net.UDPAddr, addr net.UDPAddr) error {
+	return c.bvllCommand(ctx, bbmd, BVLC{
+		Function: BacFuncDeleteForeignDeviceTableEntry,
+		Payload:  &DeleteForeignDeviceTableEntry{Addr: addr},
+	})
+}
+
+// bvllCommand sends a request answered by a BVLC-Result
+func (c *Client) bvllCommand(ctx context.Context, bbmd *net.UDPAddr, request BVLC) error {
+	answer, err := c.bvllRequest(ctx, bbmd, request)
+	if err != nil {
+		return fmt.Errorf("%v to %v: %w", request.Function, bbmd, err)
+	}
+	if answer.Function != BacFuncResult {
+		return fmt.Errorf("%v to %v: unexpected answer %v", request.Function, bbmd, answer.Function)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package bacip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TypeBacnetIPv6 is the BVLL type of BACnet/IPv6 (Annex U)
+const TypeBacnetIPv6 BVLCType = 0x82
+
+// BVLL6Function is the function of a BACnet/IPv6 BVLL message
+type BVLL6Function byte
+
+const (
+	BVLL6Result                        BVLL6Function = 0x00
+	BVLL6OriginalUnicastNPDU           BVLL6Function = 0x01
+	BVLL6OriginalBroadcastNPDU         BVLL6Function = 0x02
+	BVLL6AddressResolution             BVLL6Function = 0x03
+	BVLL6ForwardedAddressResolution    BVLL6Function = 0x04
+	BVLL6AddressResolutionAck          BVLL6Function = 0x05
+	BVLL6VirtualAddressResolution      BVLL6Function = 0x06
+	BVLL6VirtualAddressResolutionAck   BVLL6Function = 0x07
+	BVLL6ForwardedNPDU                 BVLL6Function = 0x08
+	BVLL6RegisterForeignDevice         BVLL6Function = 0x09
+	BVLL6DeleteForeignDeviceTableEntry BVLL6Function = 0x0A
+	BVLL6DistributeBroadcastToNetwork  BVLL6Function = 0x0C
+)
+
+var bvll6FunctionNames = map[BVLL6Function]string{
+	BVLL6Result:                        "BVLC-Result",
+	BVLL6OriginalUnicastNPDU:           "Original-Unicast-NPDU",
+	BVLL6OriginalBroadcastNPDU:         "Original-Broadcast-NPDU",
+	BVLL6AddressResolution:             "Address-Resolution",
+	BVLL6ForwardedAddressResolution:    "Forwarded-Address-Resolution",
+	BVLL6AddressResolutionAck:          "Address-Resolution-ACK",
+	BVLL6VirtualAddressResolution:      "Virtual-Address-Resolution",
+	BVLL6VirtualAddressResolutionAck:   "Virtual-Address-Resolution-ACK",
+	BVLL6ForwardedNPDU:                 "Forwarded-NPDU",
+	BVLL6RegisterForeignDevice:         "Register-Foreign-Device",
+	BVLL6DeleteForeignDeviceTableEntry: "Delete-Foreign-Device-Table-Entry",
+	BVLL6DistributeBroadcastToNetwork:  "Distribute-Broadcast-To-Network",
+}
+
+func (f BVLL6Function) String() string {
+	if name, ok := bvll6FunctionNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("BVLL6Function(0x%02x)", byte(f))
+}
+
+// BVLL6ResultCode is the code of a BACnet/IPv6 BVLC-Result. The NAK
+// codes differ from the BACnet/IP ones.
+type BVLL6ResultCode uint16
+
+const (
+	BVLL6ResultSuccessful                      BVLL6ResultCode = 0x0000
+	BVLL6ResultAddressResolutionNAK            BVLL6ResultCode = 0x0030
+	BVLL6ResultVirtualAddressResolutionNAK     BVLL6ResultCode = 0x0060
+	BVLL6ResultRegisterForeignDeviceNAK        BVLL6ResultCode = 0x0090
+	BVLL6ResultDeleteFDTEntryNAK               BVLL6ResultCode = 0x00A0
+	BVLL6ResultDistributeBroadcastToNetworkNAK BVLL6ResultCode = 0x00C0
+)
+
+var bvll6ResultNames = map[BVLL6ResultCode]string{
+	BVLL6ResultSuccessful:                      "successful completion",
+	BVLL6ResultAddressResolutionNAK:            "Address-Resolution NAK",
+	BVLL6ResultVirtualAddressResolutionNAK:     "Virtual-Address-Resolution NAK",
+	BVLL6ResultRegisterForeignDeviceNAK:        "Register-Foreign-Device NAK",
+	BVLL6ResultDeleteFDTEntryNAK:               "Delete-Foreign-Device-Table-Entry NAK",
+	BVLL6ResultDistributeBroadcastToNetworkNAK: "Distribute-Broadcast-To-Network NAK",
+}
+
+func (c BVLL6ResultCode) String() string {
+	if name, ok := bvll6ResultNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("BVLL6ResultCode(0x%04x)", uint16(c))
+}
+
+// BVLL6ResultError is a NAK received from a BACnet/IPv6 node. It can
+// be checked with errors.Is(err, BVLL6ResultError{Code: code}).
+type BVLL6ResultError struct {
+	Code BVLL6ResultCode
+}
+
+func (r BVLL6ResultError) Error() string {
+	return fmt.Sprintf("bvll6 result: %s", r.Code)
+}
+
+// VMAC is the 3 bytes virtual MAC address of a BACnet/IPv6 node. It
+// is the MAC address of the devices of a BACnet/IPv6 network, the
+// IPv6 address of a node being found by address resolution.
+type VMAC [3]byte
+
+func (v VMAC) String() string {
+	return fmt.Sprintf("%02x%02x%02x", v[0], v[1], v[2])
+}
+
+// VMACFromInstance returns the VMAC of a device, which is by default
+// its instance number
+func VMACFromInstance(instance uint32) VMAC {
+	return VMAC{byte(instance >> 16), byte(instance >> 8), byte(instance)}
+}
+
+// bip6AddressLength is the length of a B/IPv6 address: the IPv6
+// address followed by the UDP port
+const bip6AddressLength = 18
+
+func appendBIP6Address(b []byte, addr net.UDPAddr) []byte {
+	ip := addr.IP.To16()
+	if ip == nil {
+		ip = net.IPv6unspecified
+	}
+	b = append(b, ip...)
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+func decodeBIP6Address(data []byte) net.UDPAddr {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, data)
+	return net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[net.IPv6len:]))}
+}
+
+// BVLL6 is a BACnet/IPv6 BVLL message. The fields used depend on the
+// function.
+type BVLL6 struct {
+	Function BVLL6Function
+	// Source is the VMAC of the sender, or of the originating node
+	// of a forwarded message
+	Source VMAC
+	// Destination is the VMAC of the recipient of an unicast NPDU or
+	// of an ACK, and the target of an address resolution
+	Destination VMAC
+	// Origin is the B/IPv6 address of the originating node of the
+	// forwarded messages
+	Origin *net.UDPAddr
+	// Result is the code of a BVLC-Result
+	Result BVLL6ResultCode
+	// TTL is the time to live in seconds of a foreign device
+	// registration
+	TTL uint16
+	// Data is the raw NPDU of the functions carrying one
+	Data []byte
+}
+
+// hasDestination is true for the functions with a destination VMAC
+func (f BVLL6Function) hasDestination() bool {
+	switch f {
+	case BVLL6OriginalUnicastNPDU, BVLL6AddressResolution, BVLL6ForwardedAddressResolution,
+		BVLL6AddressResolutionAck, BVLL6VirtualAddressResolutionAck:
+		return true
+	}
+	return false
+}
+
+// hasNPDU is true for the functions carrying a NPDU
+func (f BVLL6Function) hasNPDU() bool {
+	switch f {
+	case BVLL6OriginalUnicastNPDU, BVLL6OriginalBroadcastNPDU, BVLL6ForwardedNPDU, BVLL6DistributeBroadcastToNetwork:
+		return true
+	}
+	return false
+}
+
+// hasOrigin is true for the forwarded functions
+func (f BVLL6Function) hasOrigin() bool {
+	return f == BVLL6ForwardedNPDU || f == BVLL6ForwardedAddressResolution
+}
+
+func (bvll BVLL6) MarshalBinary() ([]byte, error) {
+	b := []byte{byte(TypeBacnetIPv6), byte(bvll.Function), 0, 0}
+	b = append(b, bvll.Source[:]...)
+	if bvll.Function.hasDestination() {
+		b = append(b, bvll.Destination[:]...)
+	}
+	if bvll.Function.hasOrigin() {
+		if bvll.Origin == nil {
+			return nil, fmt.Errorf("%v without origin address", bvll.Function)
+		}
+		b = appendBIP6Address(b, *bvll.Origin)
+	}
+	switch bvll.Function {
+	case BVLL6Result:
+		b = binary.BigEndian.AppendUint16(b, uint16(bvll.Result))
+	case BVLL6RegisterForeignDevice:
+		b = binary.BigEndian.AppendUint16(b, bvll.TTL)
+	case BVLL6DeleteForeignDeviceTableEntry:
+		if bvll.Origin == nil {
+			return nil, fmt.Errorf("%v without address", bvll.Function)
+		}
+		b = appendBIP6Address(b, *bvll.Origin)
+	}
+	if bvll.Function.hasNPDU() {
+		b = append(b, bvll.Data...)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b, nil
+}
+
+// ErrNotBacnetIPv6 is returned when decoding a message of another
+// BVLL type
+var ErrNotBacnetIPv6 = errors.New("packet isn't a bacnet/IPv6 payload")
+
+func (bvll *BVLL6) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("read bvll6 header: short message of %d bytes", len(data))
+	}
+	if BVLCType(data[0]) != TypeBacnetIPv6 {
+		return ErrNotBacnetIPv6
+	}
+	bvll.Function = BVLL6Function(data[1])
+	if int(binary.BigEndian.Uint16(data[2:])) != len(data) {
+		return fmt.Errorf("incoherent Length field in BVLL6. Advertized size is %d, real size %d", binary.BigEndian.Uint16(data[2:]), len(data))
+	}
+	remaining := data[4:]
+	read := func(n int) ([]byte, error) {
+		if len(remaining) < n {
+			return nil, fmt.Errorf("read %v: short payload of %d bytes", bvll.Function, len(data))
+		}
+		b := remaining[:n]
+		remaining = remaining[n:]
+		return b, nil
+	}
+	b, err := read(3)
+	if err != nil {
+		return err
+	}
+	copy(bvll.Source[:], b)
+	if bvll.Function.hasDestination() {
+		b, err := read(3)
+		if err != nil {
+			return err
+		}
+		copy(bvll.Destination[:], b)
+	}
+	if bvll.Function.hasOrigin() || bvll.Function == BVLL6DeleteForeignDeviceTableEntry {
+		b, err := read(bip6AddressLength)
+		if err != nil {
+			return err
+		}
+		origin := decodeBIP6Address(b)
+		bvll.Origin = &origin
+	}
+	switch bvll.Function {
+	case BVLL6Result:
+		b, err := read(2)
+		if err != nil {
+			return err
+		}
+		bvll.Result = BVLL6ResultCode(binary.BigEndian.Uint16(b))
+	case BVLL6RegisterForeignDevice:
+		b, err := read(2)
+		if err != nil {
+			return err
+		}
+		bvll.TTL = binary.BigEndian.Uint16(b)
+	}
+	if bvll.Function.hasNPDU() {
+		bvll.Data = append([]byte{}, remaining...)
+	}
+	return nil
+}
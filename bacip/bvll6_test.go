@@ -0,0 +1,80 @@
+package bacip
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestBVLL6Coherency(t *testing.T) {
+	ttc := []struct {
+		name string
+		data string //hex string
+		bvll BVLL6
+	}{
+		{
+			name: "Original-Unicast-NPDU",
+			data: "8201000c0004d20000650100",
+			bvll: BVLL6{Function: BVLL6OriginalUnicastNPDU, Source: VMAC{0x00, 0x04, 0xd2}, Destination: VMAC{0x00, 0x00, 0x65}, Data: []byte{0x01, 0x00}},
+		},
+		{
+			name: "Original-Broadcast-NPDU",
+			data: "820200090004d20100",
+			bvll: BVLL6{Function: BVLL6OriginalBroadcastNPDU, Source: VMAC{0x00, 0x04, 0xd2}, Data: []byte{0x01, 0x00}},
+		},
+		{
+			name: "Address-Resolution",
+			data: "8203000a0004d2000065",
+			bvll: BVLL6{Function: BVLL6AddressResolution, Source: VMAC{0x00, 0x04, 0xd2}, Destination: VMAC{0x00, 0x00, 0x65}},
+		},
+		{
+			name: "Forwarded-NPDU",
+			data: "8208001b0004d2fd000000000000000000000000000002bac00100",
+			bvll: BVLL6{
+				Function: BVLL6ForwardedNPDU,
+				Source:   VMAC{0x00, 0x04, 0xd2},
+				Origin:   &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 47808},
+				Data:     []byte{0x01, 0x00},
+			},
+		},
+		{
+			name: "BVLC-Result",
+			data: "820000090004d20030",
+			bvll: BVLL6{Function: BVLL6Result, Source: VMAC{0x00, 0x04, 0xd2}, Result: BVLL6ResultAddressResolutionNAK},
+		},
+		{
+			name: "Register-Foreign-Device",
+			data: "820900090004d2003c",
+			bvll: BVLL6{Function: BVLL6RegisterForeignDevice, Source: VMAC{0x00, 0x04, 0xd2}, TTL: 60},
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			data, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var bvll BVLL6
+			is.NoErr(bvll.UnmarshalBinary(data))
+			is.Equal(bvll, tc.bvll)
+			b, err := tc.bvll.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(hex.EncodeToString(b), tc.data)
+		})
+	}
+}
+
+func TestBVLL6NotIPv6(t *testing.T) {
+	is := is.New(t)
+	var bvll BVLL6
+	is.Equal(bvll.UnmarshalBinary([]byte{0x81, 0x0b, 0x00, 0x04}), ErrNotBacnetIPv6)
+}
+
+func TestBVLL6ResultCode(t *testing.T) {
+	is := is.New(t)
+	is.Equal(BVLL6ResultAddressResolutionNAK.String(), "Address-Resolution NAK")
+	is.Equal(BVLL6ResultRegisterForeignDeviceNAK.String(), "Register-Foreign-Device NAK")
+	is.Equal(BVLL6ResultCode(0x00f0).String(), "BVLL6ResultCode(0x00f0)")
+	is.Equal(BVLL6ResultError{Code: BVLL6ResultAddressResolutionNAK}.Error(), "bvll6 result: Address-Resolution NAK")
+}
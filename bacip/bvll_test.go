@@ -0,0 +1,110 @@
+package bacip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestBDTManagement(t *testing.T) {
+	is := is.New(t)
+	bdt := []BDTEntry{
+		{Addr: net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 47808}, Mask: net.CIDRMask(32, 32)},
+		{Addr: net.UDPAddr{IP: net.IPv4(192, 168, 2, 10), Port: 47808}, Mask: net.CIDRMask(24, 32)},
+	}
+	var written []BDTEntry
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte {
+		switch req.Function {
+		case BacFuncBroadcastDistributionTable:
+			b, err := BVLC{Type: TypeBacnetIP, Function: BacFuncBroadcastDistributionTableAck, Payload: &BroadcastDistributionTable{Entries: bdt}}.MarshalBinary()
+			is.NoErr(err)
+			return [][]byte{b}
+		case BacFuncWriteBroadcastDistributionTable:
+			written = req.Payload.(*BroadcastDistributionTable).Entries
+			if len(written) == 0 {
+				return [][]byte{bvlcResult(t, BVLCResultWriteBDTNAK)}
+			}
+			return [][]byte{bvlcResult(t, BVLCResultSuccessful)}
+		}
+		return [][]byte{bvlcResult(t, BVLCResultReadBDTNAK)}
+	})
+	c := newTestClient(t)
+	entries, err := c.ReadBDT(context.Background(), bbmd.addr())
+	is.NoErr(err)
+	is.Equal(entries, bdt)
+
+	is.NoErr(c.WriteBDT(context.Background(), bbmd.addr(), bdt[:1]))
+	bbmd.mutex.Lock()
+	is.Equal(written, bdt[:1])
+	bbmd.mutex.Unlock()
+
+	err = c.WriteBDT(context.Background(), bbmd.addr(), nil)
+	is.True(errors.Is(err, BVLCResult{Code: BVLCResultWriteBDTNAK}))
+}
+
+func TestFDTManagement(t *testing.T) {
+	is := is.New(t)
+	expected := []FDTEntry{
+		{Addr: net.UDPAddr{IP: net.IPv4(10, 8, 0, 2), Port: 47808}, TTL: 60, Remaining: 75},
+	}
+	fdt := expected
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte {
+		switch req.Function {
+		case BacFuncReadForeignDeviceTable:
+			b, err := BVLC{Type: TypeBacnetIP, Function: BacFuncReadForeignDeviceTableAck, Payload: &ForeignDeviceTable{Entries: fdt}}.MarshalBinary()
+			is.NoErr(err)
+			return [][]byte{b}
+		case BacFuncDeleteForeignDeviceTableEntry:
+			addr := req.Payload.(*DeleteForeignDeviceTableEntry).Addr
+			if len(fdt) == 0 || !addr.IP.Equal(fdt[0].Addr.IP) || addr.Port != fdt[0].Addr.Port {
+				return [][]byte{bvlcResult(t, BVLCResultDeleteFDTEntryNAK)}
+			}
+			fdt = nil
+			return [][]byte{bvlcResult(t, BVLCResultSuccessful)}
+		}
+		return nil
+	})
+	c := newTestClient(t)
+	entries, err := c.ReadFDT(context.Background(), bbmd.addr())
+	is.NoErr(err)
+	is.Equal(entries, expected)
+
+	addr := net.UDPAddr{IP: net.IPv4(10, 8, 0, 2), Port: 47808}
+	is.NoErr(c.DeleteFDTEntry(context.Background(), bbmd.addr(), addr))
+	err = c.DeleteFDTEntry(context.Background(), bbmd.addr(), addr)
+	var result BVLCResult
+	is.True(errors.As(err, &result))
+	is.Equal(result.Code, BVLCResultDeleteFDTEntryNAK)
+
+	entries, err = c.ReadFDT(context.Background(), bbmd.addr())
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+}
+
+func TestBVLLRequestsPerBBMD(t *testing.T) {
+	is := is.New(t)
+	// The first BBMD never answers
+	silent := newFakeBBMD(t, func(req BVLC) [][]byte { return nil })
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte {
+		return [][]byte{bvlcResult(t, BVLCResultSuccessful)}
+	})
+	c := newTestClient(t)
+	c.SetAPDUTimings(APDUTimings{Timeout: 2 * time.Second})
+	go func() { _, _ = c.ReadFDT(context.Background(), silent.addr()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// The requests to the other BBMDs aren't delayed
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	is.NoErr(c.DeleteFDTEntry(ctx, bbmd.addr(), net.UDPAddr{IP: net.IPv4(10, 8, 0, 2), Port: 47808}))
+
+	// The ones to the same BBMD wait for it, until the context is done
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.ReadFDT(ctx, silent.addr())
+	is.True(errors.Is(err, context.DeadlineExceeded))
+}
@@ -16,16 +16,19 @@ import (
 )
 
 type Client struct {
-	//Maybe change to bacnet address
-	ipAddress        net.IP
-	broadcastAddress net.IP
-	udpPort          int
-	udp              *net.UDPConn
-	subscriptions    *Subscriptions
-	transactions     *Transactions
-	logger           Logger
-	runFlag          atomic.Bool
-	wg               sync.WaitGroup
+	link          DataLink
+	dispatcher    *Dispatcher
+	transactions  *Transactions
+	routes        *routes
+	settingsMutex sync.Mutex
+	timings       APDUTimings
+	limits        APDULimits
+	deviceTimings map[bacnet.ObjectID]APDUTimings
+	device        *bacnet.ObjectID
+	vendorID      uint32
+	logger        Logger
+	runFlag       atomic.Bool
+	wg            sync.WaitGroup
 }
 
 type Logger interface {
@@ -38,11 +41,6 @@ type NoOpLogger struct{}
 func (NoOpLogger) Info(...interface{})  {}
 func (NoOpLogger) Error(...interface{}) {}
 
-type Subscriptions struct {
-	sync.RWMutex
-	f func(BVLC, net.UDPAddr)
-}
-
 const DefaultUDPPort = 47808
 
 func broadcastAddr(n *net.IPNet) (net.IP, error) {
@@ -56,78 +54,207 @@ func broadcastAddr(n *net.IPNet) (net.IP, error) {
 }
 
 // NewClient creates a new bacnet client. It binds on the given port
-// and network interface or cidr addr. If Port is 0, a random port is used
+// and network interface or cidr addr. If Port is 0, a random port is used.
+// When the interface has no IPv4 address, the client runs on a
+// BACnet/IPv6 link joining DefaultIPv6Group on this interface. See
+// NewClientWithOptions for the other settings.
 func NewClient(netInterface string, port int, logger Logger) (*Client, error) {
-	c := &Client{subscriptions: &Subscriptions{},
-		transactions: NewTransactions(),
-		logger:       logger,
-		runFlag:      atomic.Bool{},
-		wg:           sync.WaitGroup{},
+	return NewClientWithOptions(WithInterface(netInterface), WithPort(port), WithLogger(logger))
+}
+
+// NewClientWithOptions creates a new BACnet/IP or BACnet/IPv6 client.
+// The network is given by WithInterface or WithBindIP. Without them,
+// the client binds on all the IPv4 addresses and the broadcast
+// address must be given with WithBroadcast.
+func NewClientWithOptions(opts ...ClientOption) (*Client, error) {
+	o := newClientOptions(opts)
+	link, err := o.dataLink()
+	if err != nil {
+		return nil, err
 	}
-	if strings.Contains(netInterface, "/") {
-		c.tryParse(netInterface)
-	} else {
-		i, err := net.InterfaceByName(netInterface)
+	c := NewClientWithDataLink(link, o.logger)
+	limits := o.limits
+	if max := link.MaxAPDU(); max < limits.MaxApdu {
+		limits.MaxApdu = max
+	}
+	c.SetAPDULimits(limits)
+	c.SetAPDUTimings(o.timings)
+	if o.device != nil {
+		c.device = o.device
+		c.vendorID = o.vendorID
+		c.Subscribe(c.answerWhoIs, ForService(UnconfirmedServiceRequest, ServiceUnconfirmedWhoIs))
+	}
+	return c, nil
+}
+
+// dataLink opens the BACnet/IP or BACnet/IPv6 link of the options
+func (o clientOptions) dataLink() (DataLink, error) {
+	var ipv4, ipv6 *net.IPNet
+	if o.netInterface != "" {
+		var err error
+		ipv4, ipv6, err = interfaceNetworks(o.netInterface)
 		if err != nil {
-			return nil, fmt.Errorf("interface %s: %w", netInterface, err)
+			return nil, err
+		}
+	} else if o.bindIP != nil && !o.bindIP.IsUnspecified() {
+		_, ipnet, err := interfaceOf(o.bindIP)
+		if err != nil && o.broadcast == nil {
+			return nil, err
 		}
-		addrs, err := i.Addrs()
+		if ipnet == nil {
+			ipnet = &net.IPNet{IP: o.bindIP}
+		}
+		if o.bindIP.To4() != nil {
+			ipv4 = ipnet
+		} else {
+			ipv6 = ipnet
+		}
+	}
+	if ipv4 == nil && ipv6 != nil {
+		ifi, _, err := interfaceOf(ipv6.IP)
 		if err != nil {
 			return nil, err
 		}
-		if len(addrs) == 0 {
-			return nil, fmt.Errorf("interface %s has no addresses", netInterface)
+		config := IPv6Config{
+			Interface: ifi,
+			Addr:      &net.UDPAddr{IP: net.IPv6unspecified, Port: o.port},
 		}
-		for _, adr := range addrs {
-			if c.tryParse(adr.String()) {
-				break
-			}
+		if o.broadcast != nil {
+			config.Group = &net.UDPAddr{IP: o.broadcast, Port: o.broadcastPort}
 		}
+		if o.device != nil {
+			vmac := VMACFromInstance(uint32(o.device.Instance))
+			config.VMAC = &vmac
+		}
+		return NewIPv6Link(config, o.logger)
 	}
-	if c.ipAddress == nil {
-		return nil, fmt.Errorf("no IPv4 address assigned to interface %s", netInterface)
+	if ipv4 == nil && o.netInterface != "" {
+		return nil, fmt.Errorf("no IPv4 address assigned to interface %s", o.netInterface)
 	}
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: port,
-	})
+	broadcast := o.broadcast
+	if broadcast == nil {
+		if ipv4 == nil || ipv4.Mask == nil {
+			return nil, errors.New("no broadcast address, see WithBroadcast")
+		}
+		var err error
+		broadcast, err = broadcastAddr(ipv4)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewIPv4Link(IPv4Config{
+		Addr:      &net.UDPAddr{IP: net.IPv4zero, Port: o.port},
+		Broadcast: &net.UDPAddr{IP: broadcast, Port: o.broadcastPort},
+	}, o.logger)
+}
+
+// interfaceNetworks returns the first IPv4 and IPv6 networks of the
+// network interface, or of the cidr address
+func interfaceNetworks(netInterface string) (ipv4, ipv6 *net.IPNet, err error) {
+	if strings.Contains(netInterface, "/") {
+		return parseIPv4(netInterface), parseIPv6(netInterface), nil
+	}
+	i, err := net.InterfaceByName(netInterface)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("interface %s: %w", netInterface, err)
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, fmt.Errorf("interface %s has no addresses", netInterface)
+	}
+	for _, adr := range addrs {
+		if ipv4 == nil {
+			ipv4 = parseIPv4(adr.String())
+		}
+		if ipv6 == nil {
+			ipv6 = parseIPv6(adr.String())
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// NewClientWithDataLink creates a new bacnet client exchanging the
+// npdus on the data link. The BACnet/IP specific functions, such as
+// the BBMD management, need an IPv4Link. The maximum APDU length
+// advertised is the one of the data link.
+func NewClientWithDataLink(link DataLink, logger Logger) *Client {
+	c := &Client{
+		link:          link,
+		dispatcher:    NewDispatcher(logger),
+		transactions:  NewTransactions(),
+		routes:        &routes{routers: map[uint16]bacnet.Address{}},
+		timings:       DefaultAPDUTimings,
+		limits:        DefaultAPDULimits,
+		deviceTimings: map[bacnet.ObjectID]APDUTimings{},
+		logger:        logger,
+	}
+	if max := link.MaxAPDU(); max < c.limits.MaxApdu {
+		c.limits.MaxApdu = max
 	}
 	c.runFlag.Store(true)
-	c.udpPort = conn.LocalAddr().(*net.UDPAddr).Port
-	c.udp = conn
+	c.Subscribe(c.learnRoutes, func(m Message) bool {
+		return m.NPDU.IsNetworkLayerMessage
+	})
 	c.wg.Add(1)
 	go c.listen()
-	return c, nil
+	return c
+}
+
+// parseIPv4 returns the IPv4 network of cidr, nil if it isn't one
+func parseIPv4(cidr string) *net.IPNet {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil
+	}
+	ipnet.IP = ip.To4()
+	return ipnet
 }
 
-func (c *Client) tryParse(cidr string) bool {
+// parseIPv6 returns the IPv6 network of cidr, nil if it isn't one
+func parseIPv6(cidr string) *net.IPNet {
 	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() != nil {
+		return nil
+	}
+	ipnet.IP = ip
+	return ipnet
+}
+
+// interfaceOf returns the network interface with the ip address, and
+// the network of this address
+func interfaceOf(ip net.IP) (*net.Interface, *net.IPNet, error) {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return false
+		return nil, nil, err
 	}
-	// To4 is nil when type is ip6
-	if ip.To4() != nil {
-		broadcast, err := broadcastAddr(ipnet)
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
 		if err != nil {
-			return false
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], ipnet, nil
+			}
 		}
-		c.ipAddress = ip.To4()
-		c.broadcastAddress = broadcast
-		return true
 	}
-	return false
+	return nil, nil, fmt.Errorf("no interface with the address %v", ip)
 }
 
-// listen for incoming bacnet packets.
+// listen for incoming npdus on the data link
 func (c *Client) listen() {
 	defer c.wg.Done()
 	for c.runFlag.Load() {
-		b := make([]byte, 2048)
-		i, addr, err := c.udp.ReadFromUDP(b)
+		data, mac, err := c.link.Receive()
 		if err != nil {
+			if !c.runFlag.Load() {
+				return
+			}
 			c.logger.Error(err.Error())
+			continue
 		}
 		go func() {
 			defer func() {
@@ -135,7 +262,7 @@ func (c *Client) listen() {
 					c.logger.Error("panic in handle message: ", r)
 				}
 			}()
-			err := c.handleMessage(addr, b[:i])
+			err := c.handleMessage(data, mac)
 			if err != nil {
 				c.logger.Error("handle msg: ", err)
 			}
@@ -145,246 +272,305 @@ func (c *Client) listen() {
 
 func (c *Client) Close() error {
 	c.runFlag.Store(false)
+	c.settingsMutex.Lock()
+	timeout := c.timings.Timeout
+	c.settingsMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := c.UnregisterForeignDevice(ctx)
+	cancel()
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		c.logger.Error(err.Error())
+	}
+	err = c.link.Close()
 	c.wg.Wait()
-	return c.udp.Close()
+	return err
 }
 
-func (c *Client) handleMessage(src *net.UDPAddr, b []byte) error {
-	var bvlc BVLC
-	err := bvlc.UnmarshalBinary(b)
-	if err != nil && errors.Is(err, ErrNotBAcnetIP) {
+// handleMessage handles the npdu received from the node of the local
+// network with the MAC address mac
+func (c *Client) handleMessage(data []byte, mac []byte) error {
+	var npdu NPDU
+	err := npdu.UnmarshallBinary(data)
+	if err != nil {
 		return err
 	}
-	apdu := bvlc.NPDU.ADPU
-	if apdu == nil {
-		c.logger.Info(fmt.Sprintf("Received network packet %+v", bvlc.NPDU))
+	return c.handleNPDU(bacnet.Address{Mac: mac}, npdu)
+}
+
+// handleNPDU handles a npdu sent by the node of the local network
+// with the address src
+func (c *Client) handleNPDU(src bacnet.Address, npdu NPDU) error {
+	if npdu.Source != nil && npdu.Source.IsRemote() {
+		// The message was forwarded by a router to the source
+		// network
+		c.routes.set(npdu.Source.Net, src)
+	}
+	apdu := npdu.ADPU
+	if npdu.IsNetworkLayerMessage || apdu.DataType == ConfirmedServiceRequest || apdu.DataType == UnconfirmedServiceRequest {
+		c.dispatcher.dispatch(Message{
+			Source: sourceAddress(npdu, src),
+			NPDU:   npdu,
+		})
 		return nil
 	}
-	c.subscriptions.RLock()
-	if c.subscriptions.f != nil {
-		//If f block, there is a deadlock here
-		c.subscriptions.f(bvlc, *src)
+	if apdu.DataType == ComplexAck || apdu.DataType == SimpleAck || apdu.DataType == Error ||
+		apdu.DataType == Reject || apdu.DataType == Abort {
+		return c.transactions.Deliver(sourceAddress(npdu, src), *apdu)
+	}
+	return nil
+}
+
+// TransactionStats returns the number of answers received, by
+// outcome. It allows to monitor duplicate, late and unmatched answers
+func (c *Client) TransactionStats() TransactionStats {
+	return c.transactions.Stats()
+}
+
+// sourceAddress returns the bacnet address of the sender of the
+// npdu. If the sender is behind a router, the address is the one
+// given by the npdu source fields.
+func sourceAddress(npdu NPDU, addr bacnet.Address) bacnet.Address {
+	if npdu.Source != nil && npdu.Source.Net != 0 {
+		addr.Net = npdu.Source.Net
+		addr.Adr = npdu.Source.Adr
 	}
-	c.subscriptions.RUnlock()
-	if apdu.DataType == ComplexAck || apdu.DataType == SimpleAck || apdu.DataType == Error {
-		invokeID := bvlc.NPDU.ADPU.InvokeID
-		tx, ok := c.transactions.GetTransaction(invokeID)
+	return addr
+}
+
+// Subscribe calls handler for each unsolicited message matching all
+// the filters. See Dispatcher.Subscribe
+func (c *Client) Subscribe(handler func(Message), filters ...Filter) (unsubscribe func()) {
+	return c.dispatcher.Subscribe(handler, filters...)
+}
+
+// WhoIs broadcasts a WhoIs request and returns the devices answering
+// before the timeout. The request is broadcast on the local network,
+// unless another network is given with WithNetwork.
+func (c *Client) WhoIs(data WhoIs, timeout time.Duration, opts ...RequestOption) ([]bacnet.Device, error) {
+	//Use a set to deduplicate results
+	set := map[Iam]bacnet.Address{}
+	err := c.collect(NPDU{
+		ADPU: &APDU{
+			DataType:    UnconfirmedServiceRequest,
+			ServiceType: ServiceUnconfirmedWhoIs,
+			Payload:     &data,
+		},
+	}, ForService(UnconfirmedServiceRequest, ServiceUnconfirmedIAm), timeout, newRequestOptions(opts), func(r Message) error {
+		iam, ok := r.NPDU.ADPU.Payload.(*Iam)
 		if !ok {
-			return fmt.Errorf("no transaction found for id %d", invokeID)
+			return fmt.Errorf("unexpected payload type %T", r.NPDU.ADPU.Payload)
 		}
-		select {
-		case tx.APDU <- *apdu:
-			return nil
-		case <-tx.Ctx.Done():
-			return fmt.Errorf("handler for tx %d: %w", invokeID, tx.Ctx.Err())
+		//Only add a result that we are interested in. Well-
+		//behaved devices should not answer if their
+		//InstanceID isn't in the given range. But because
+		//the IAM response is in broadcast mode, we might
+		//receive an answer triggered by another whois
+		if data.High != nil && data.Low != nil {
+			if iam.ObjectID.Instance >= bacnet.ObjectInstance(*data.Low) &&
+				iam.ObjectID.Instance <= bacnet.ObjectInstance(*data.High) {
+				set[*iam] = r.Source
+			}
+		} else {
+			set[*iam] = r.Source
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	result := []bacnet.Device{}
+	for iam, addr := range set {
+		result = append(result, bacnet.Device{
+			ID:           iam.ObjectID,
+			MaxApdu:      iam.MaxApduLength,
+			Segmentation: iam.SegmentationSupport,
+			Vendor:       iam.VendorID,
+			Addr:         addr,
+		})
+	}
+	return result, nil
 }
 
-func (c *Client) WhoIs(data WhoIs, timeout time.Duration) ([]bacnet.Device, error) {
-	npdu := NPDU{
-		Version:               Version1,
-		IsNetworkLayerMessage: false,
-		ExpectingReply:        false,
-		Priority:              Normal,
-		Destination:           nil,
-		Source:                nil,
+// answerWhoIs answers the WhoIs including the device of the client
+// with an IAm, broadcast on the network of the sender
+func (c *Client) answerWhoIs(m Message) {
+	whoIs, ok := m.NPDU.ADPU.Payload.(*WhoIs)
+	if !ok {
+		return
+	}
+	instance := uint32(c.device.Instance)
+	if whoIs.Low != nil && whoIs.High != nil && (instance < *whoIs.Low || instance > *whoIs.High) {
+		return
+	}
+	c.settingsMutex.Lock()
+	limits := c.limits
+	c.settingsMutex.Unlock()
+	segmentation := bacnet.SegmentationSupportNone
+	if limits.SegmentedResponseAccepted {
+		segmentation = bacnet.SegmentationSupportReceive
+	}
+	_, err := c.broadcastTo(NPDU{
+		Version:  Version1,
+		HopCount: 255,
 		ADPU: &APDU{
 			DataType:    UnconfirmedServiceRequest,
-			ServiceType: ServiceUnconfirmedWhoIs,
-			Payload:     &data,
+			ServiceType: ServiceUnconfirmedIAm,
+			Payload: &Iam{
+				ObjectID:            *c.device,
+				MaxApduLength:       uint32(limits.MaxApdu),
+				SegmentationSupport: segmentation,
+				VendorID:            c.vendorID,
+			},
 		},
+	}, m.Source.Net)
+	if err != nil {
+		c.logger.Error("answer WhoIs: ", err)
 	}
+}
 
-	rChan := make(chan struct {
-		bvlc BVLC
-		src  net.UDPAddr
-	})
-	c.subscriptions.Lock()
-	//TODO:  add errgroup ?, ensure all f are done and not blocked
-	c.subscriptions.f = func(bvlc BVLC, src net.UDPAddr) {
-		rChan <- struct {
-			bvlc BVLC
-			src  net.UDPAddr
-		}{
-			bvlc: bvlc,
-			src:  src,
+// WhoHasResult is an answer to WhoHas
+type WhoHasResult struct {
+	IHave
+	// Addr is the address of the device having the object
+	Addr bacnet.Address
+}
+
+// WhoHas broadcasts a WhoHas request and returns the objects found
+// before the timeout. The request is broadcast on the local network,
+// unless another network is given with WithNetwork.
+func (c *Client) WhoHas(data WhoHas, timeout time.Duration, opts ...RequestOption) ([]WhoHasResult, error) {
+	set := map[IHave]bacnet.Address{}
+	err := c.collect(NPDU{
+		ADPU: &APDU{
+			DataType:    UnconfirmedServiceRequest,
+			ServiceType: ServiceUnconfirmedWhoHas,
+			Payload:     &data,
+		},
+	}, ForService(UnconfirmedServiceRequest, ServiceUnconfirmedIHave), timeout, newRequestOptions(opts), func(r Message) error {
+		ihave, ok := r.NPDU.ADPU.Payload.(*IHave)
+		if !ok {
+			return fmt.Errorf("unexpected payload type %T", r.NPDU.ADPU.Payload)
 		}
-	}
-	c.subscriptions.Unlock()
-	defer func() {
-		c.subscriptions.f = nil
-	}()
-	_, err := c.broadcast(npdu)
+		if data.ObjectID != nil && ihave.ObjectID != *data.ObjectID ||
+			data.ObjectID == nil && ihave.ObjectName != data.ObjectName {
+			// Answer to another WhoHas
+			return nil
+		}
+		set[*ihave] = r.Source
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	result := []WhoHasResult{}
+	for ihave, addr := range set {
+		result = append(result, WhoHasResult{IHave: ihave, Addr: addr})
+	}
+	return result, nil
+}
+
+// collect broadcasts the npdu and calls handle for each answer
+// matching the filter received before the timeout.
+func (c *Client) collect(npdu NPDU, answers Filter, timeout time.Duration, opts requestOptions, handle func(Message) error) error {
+	npdu.Version = Version1
+	npdu.Priority = opts.priority
+	npdu.HopCount = opts.hopCount
+	npdu.ExpectingReply = opts.expecting(false)
+	rChan := make(chan Message)
+	done := make(chan struct{})
+	defer close(done)
+	unsubscribe := c.Subscribe(func(m Message) {
+		select {
+		case rChan <- m:
+		case <-done:
+		}
+	}, answers)
+	defer unsubscribe()
+	_, err := c.broadcastTo(npdu, opts.network)
+	if err != nil {
+		return err
+	}
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
-	//Use a set to deduplicate results
-	set := map[Iam]bacnet.Address{}
 	for {
 		select {
 		case <-timer.C:
-			result := []bacnet.Device{}
-			for iam, addr := range set {
-				result = append(result, bacnet.Device{
-					ID:           iam.ObjectID,
-					MaxApdu:      iam.MaxApduLength,
-					Segmentation: iam.SegmentationSupport,
-					Vendor:       iam.VendorID,
-					Addr:         addr,
-				})
-			}
-			return result, nil
+			return nil
 		case r := <-rChan:
-			//clean/filter  network answers here
-			apdu := r.bvlc.NPDU.ADPU
-			if apdu != nil {
-				if apdu.DataType == UnconfirmedServiceRequest &&
-					apdu.ServiceType == ServiceUnconfirmedIAm {
-					iam, ok := apdu.Payload.(*Iam)
-					if !ok {
-						return nil, fmt.Errorf("unexpected payload type %T", apdu.Payload)
-					}
-					//Only add a result that we are interested in. Well-
-					//behaved devices should not answer if their
-					//InstanceID isn't in the given range. But because
-					//the IAM response is in broadcast mode, we might
-					//receive an answer triggered by another whois
-					if data.High != nil && data.Low != nil {
-						if iam.ObjectID.Instance >= bacnet.ObjectInstance(*data.Low) &&
-							iam.ObjectID.Instance <= bacnet.ObjectInstance(*data.High) {
-							addr := bacnet.AddressFromUDP(r.src)
-							set[*iam] = *addr
-						}
-					} else {
-						addr := bacnet.AddressFromUDP(r.src)
-						set[*iam] = *addr
-					}
-
-				}
+			err := handle(r)
+			if err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (c *Client) ReadProperty(ctx context.Context, device bacnet.Device, readProp ReadProperty) (interface{}, error) {
-	invokeID := c.transactions.GetID()
-	defer c.transactions.FreeID(invokeID)
-	npdu := NPDU{
-		Version:               Version1,
-		IsNetworkLayerMessage: false,
-		ExpectingReply:        true,
-		Priority:              Normal,
-		Destination:           &device.Addr,
-		Source: bacnet.AddressFromUDP(net.UDPAddr{
-			IP:   c.ipAddress,
-			Port: c.udpPort,
-		}),
-		HopCount: 255,
-		ADPU: &APDU{
-			DataType:    ConfirmedServiceRequest,
-			ServiceType: ServiceConfirmedReadProperty,
-			InvokeID:    invokeID,
-			Payload:     &readProp,
-		},
-	}
-	rChan := make(chan APDU)
-	c.transactions.SetTransaction(invokeID, rChan, ctx)
-	defer c.transactions.StopTransaction(invokeID)
-	_, err := c.send(npdu)
+func (c *Client) ReadProperty(ctx context.Context, device bacnet.Device, readProp ReadProperty, opts ...RequestOption) (interface{}, error) {
+	payload, err := c.Do(ctx, device, ServiceConfirmedReadProperty, &readProp, opts...)
 	if err != nil {
 		return nil, err
 	}
-	select {
-	case apdu := <-rChan:
-		//Todo: ensure response validity, ensure conversion cannot panic
-		if apdu.DataType == Error {
-			return nil, *apdu.Payload.(*ApduError)
-		}
-		if apdu.DataType == ComplexAck && apdu.ServiceType == ServiceConfirmedReadProperty {
-			data := apdu.Payload.(*ReadProperty).Data
-			return data, nil
-		}
-		return nil, errors.New("invalid answer")
-	case <-ctx.Done():
-		return nil, ctx.Err()
+	rp, ok := payload.(*ReadProperty)
+	if !ok {
+		return nil, fmt.Errorf("unexpected payload type %T", payload)
 	}
+	return rp.Data, nil
 }
 
-func (c *Client) WriteProperty(ctx context.Context, device bacnet.Device, writeProp WriteProperty) error {
-	invokeID := c.transactions.GetID()
-	defer c.transactions.FreeID(invokeID)
-	npdu := NPDU{
-		Version:               Version1,
-		IsNetworkLayerMessage: false,
-		ExpectingReply:        true,
-		Priority:              Normal,
-		Destination:           &device.Addr,
-		Source: bacnet.AddressFromUDP(net.UDPAddr{
-			IP:   c.ipAddress,
-			Port: c.udpPort,
-		}),
-		HopCount: 255,
-		ADPU: &APDU{
-			DataType:    ConfirmedServiceRequest,
-			ServiceType: ServiceConfirmedWriteProperty,
-			InvokeID:    invokeID,
-			Payload:     &writeProp,
-		},
-	}
-	rChan := make(chan APDU)
-	c.transactions.SetTransaction(invokeID, rChan, ctx)
-	defer c.transactions.StopTransaction(invokeID)
-	_, err := c.send(npdu)
+func (c *Client) WriteProperty(ctx context.Context, device bacnet.Device, writeProp WriteProperty, opts ...RequestOption) error {
+	payload, err := c.Do(ctx, device, ServiceConfirmedWriteProperty, &writeProp, opts...)
 	if err != nil {
 		return err
 	}
-	select {
-	case apdu := <-rChan:
-		//Todo: ensure response validity, ensure conversion cannot panic
-		if apdu.DataType == Error {
-			return *apdu.Payload.(*ApduError)
-		}
-		if apdu.DataType == SimpleAck {
-			return nil
-		}
+	if payload != nil {
 		return errors.New("invalid answer")
-	case <-ctx.Done():
-		return ctx.Err()
 	}
+	return nil
 }
 
+// send sends the npdu to its destination. When the destination is on
+// a remote network, the npdu is sent to the router given by the
+// destination MAC address. If this router is unknown, the npdu is
+// broadcast on the local network and the routers for the destination
+// network forward it.
 func (c *Client) send(npdu NPDU) (int, error) {
-	bytes, err := BVLC{
-		Type:     TypeBacnetIP,
-		Function: BacFuncUnicast,
-		NPDU:     npdu,
-	}.MarshalBinary()
-	if err != nil {
-		return 0, err
+	if npdu.Destination != nil && npdu.Destination.IsRemote() && len(npdu.Destination.Mac) == 0 {
+		return c.broadcast(npdu)
 	}
 	if npdu.Destination == nil {
 		return 0, fmt.Errorf("destination bacnet address should be not nil to send unicast")
 	}
-	addr := bacnet.UDPFromAddress(*npdu.Destination)
-	return c.udp.WriteToUDP(bytes, &addr)
+	data, err := npdu.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	return len(data), c.link.Send(npdu.Destination.Mac, data)
+}
 
+// broadcastTo broadcasts the npdu on the given network. Network 0 is
+// the local network and GlobalBroadcastNetwork reaches all the
+// networks. A remote network broadcast is sent to the router of the
+// network if it is known. Otherwise it is broadcast locally and
+// forwarded by the router.
+func (c *Client) broadcastTo(npdu NPDU, network uint16) (int, error) {
+	if network == 0 {
+		return c.broadcast(npdu)
+	}
+	npdu.Destination = &bacnet.Address{Net: network}
+	if network != GlobalBroadcastNetwork {
+		if router, ok := c.routes.get(network); ok {
+			npdu.Destination.Mac = router.Mac
+			return c.send(npdu)
+		}
+	}
+	return c.broadcast(npdu)
 }
 
+// broadcast sends the npdu to all the devices of the local network
 func (c *Client) broadcast(npdu NPDU) (int, error) {
-	bytes, err := BVLC{
-		Type:     TypeBacnetIP,
-		Function: BacFuncBroadcast,
-		NPDU:     npdu,
-	}.MarshalBinary()
+	data, err := npdu.MarshalBinary()
 	if err != nil {
 		return 0, err
 	}
-	return c.udp.WriteToUDP(bytes, &net.UDPAddr{
-		IP:   c.broadcastAddress,
-		Port: DefaultUDPPort,
-	})
+	return len(data), c.link.Broadcast(data)
 }
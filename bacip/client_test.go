@@ -0,0 +1,386 @@
+package bacip
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+// fakeDevice is a bacnet/IP device listening on the loopback
+// interface. The handler is called for each received NPDU and the
+// returned NPDUs are sent back to the sender.
+type fakeDevice struct {
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	handler func(req NPDU) []NPDU
+}
+
+func newFakeDevice(t *testing.T, handler func(req NPDU) []NPDU) (bacnet.Device, *fakeDevice) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDevice{conn: conn, handler: handler}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	return bacnet.Device{
+		ID:   bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 1234},
+		Addr: *bacnet.AddressFromUDP(net.UDPAddr{IP: addr.IP.To4(), Port: addr.Port}),
+	}, d
+}
+
+func (d *fakeDevice) serve() {
+	b := make([]byte, 2048)
+	for {
+		n, src, err := d.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		var bvlc BVLC
+		if bvlc.UnmarshalBinary(b[:n]) != nil {
+			continue
+		}
+		d.mutex.Lock()
+		answers := d.handler(bvlc.NPDU)
+		d.mutex.Unlock()
+		for _, a := range answers {
+			data, err := BVLC{Type: TypeBacnetIP, Function: BacFuncUnicast, NPDU: a}.MarshalBinary()
+			if err != nil {
+				panic(err)
+			}
+			_, _ = d.conn.WriteToUDP(data, src)
+		}
+	}
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	c, err := NewClient("127.0.0.1/8", 0, NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func answer(apdu APDU) NPDU {
+	return NPDU{Version: Version1, ADPU: &apdu}
+}
+
+// readPropertyAck is a ReadProperty answer with the value 98
+const readPropertyAck = "0c00401fb919753e91623f"
+
+var testReadProperty = ReadProperty{
+	ObjectID: bacnet.ObjectID{Type: bacnet.AnalogOutput, Instance: 8121},
+	Property: bacnet.PropertyIdentifier{Type: bacnet.Units},
+}
+
+func TestConfirmedRequestRetry(t *testing.T) {
+	is := is.New(t)
+	ack, _ := hex.DecodeString(readPropertyAck)
+	requests := 0
+	device, d := newFakeDevice(t, func(req NPDU) []NPDU {
+		requests++
+		if requests < 3 {
+			return nil // Simulate lost packets
+		}
+		return []NPDU{answer(APDU{
+			DataType:    ComplexAck,
+			ServiceType: ServiceConfirmedReadProperty,
+			InvokeID:    req.ADPU.InvokeID,
+			Payload:     &DataPayload{Bytes: ack},
+		})}
+	})
+	c := newTestClient(t)
+	c.SetDeviceAPDUTimings(device.ID, APDUTimings{Timeout: 50 * time.Millisecond, Retries: 2})
+	v, err := c.ReadProperty(context.Background(), device, testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	is.Equal(requests, 3)
+}
+
+func TestConfirmedRequestTimeout(t *testing.T) {
+	is := is.New(t)
+	requests := 0
+	device, d := newFakeDevice(t, func(req NPDU) []NPDU {
+		requests++
+		return nil
+	})
+	c := newTestClient(t)
+	c.SetAPDUTimings(APDUTimings{Timeout: 20 * time.Millisecond, Retries: 2})
+	_, err := c.ReadProperty(context.Background(), device, testReadProperty)
+	is.True(errors.Is(err, ErrAPDUTimeout))
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	is.Equal(requests, 3) // First request and two retries
+}
+
+func TestConfirmedRequestSegmented(t *testing.T) {
+	is := is.New(t)
+	ack, _ := hex.DecodeString(readPropertyAck)
+	segments := [][]byte{ack[:5], ack[5:]}
+	acked := []byte{}
+	device, d := newFakeDevice(t, func(req NPDU) []NPDU {
+		seq := 0
+		switch req.ADPU.DataType {
+		case ConfirmedServiceRequest:
+		case SegmentAck:
+			acked = append(acked, req.ADPU.SequenceNumber)
+			seq = int(req.ADPU.SequenceNumber) + 1
+			if seq == len(segments) {
+				return nil
+			}
+		default:
+			return nil
+		}
+		return []NPDU{answer(APDU{
+			DataType:       ComplexAck,
+			ServiceType:    ServiceConfirmedReadProperty,
+			InvokeID:       req.ADPU.InvokeID,
+			Segmented:      true,
+			MoreFollows:    seq < len(segments)-1,
+			SequenceNumber: byte(seq),
+			WindowSize:     1,
+			Payload:        &DataPayload{Bytes: segments[seq]},
+		})}
+	})
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, device, testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+	time.Sleep(10 * time.Millisecond) // Let the device receive the last ack
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	is.Equal(acked, []byte{0, 1})
+}
+
+func TestRequestPriority(t *testing.T) {
+	is := is.New(t)
+	received := make(chan NPDU, 1)
+	device, _ := newFakeDevice(t, func(req NPDU) []NPDU {
+		received <- req
+		return []NPDU{answer(APDU{
+			DataType:    SimpleAck,
+			ServiceType: ServiceConfirmedWriteProperty,
+			InvokeID:    req.ADPU.InvokeID,
+		})}
+	})
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := c.WriteProperty(ctx, device, WriteProperty{
+		ObjectID:      bacnet.ObjectID{Type: bacnet.BinaryOutput, Instance: 1},
+		Property:      bacnet.PropertyIdentifier{Type: bacnet.PresentValue},
+		PropertyValue: bacnet.PropertyValue{Type: 0x09, Value: 1},
+		Priority:      bacnet.ManualLifeSafety1,
+	}, WithPriority(LifeSafety))
+	is.NoErr(err)
+	req := <-received
+	is.Equal(req.Priority, LifeSafety)
+	is.True(req.ExpectingReply)
+
+	err = c.WriteProperty(ctx, device, WriteProperty{
+		ObjectID:      bacnet.ObjectID{Type: bacnet.BinaryOutput, Instance: 1},
+		Property:      bacnet.PropertyIdentifier{Type: bacnet.PresentValue},
+		PropertyValue: bacnet.PropertyValue{Type: 0x09, Value: 1},
+	}, WithExpectingReply(false))
+	is.NoErr(err)
+	req = <-received
+	is.Equal(req.Priority, Normal)
+	is.True(!req.ExpectingReply)
+}
+
+func TestRoutedReadProperty(t *testing.T) {
+	is := is.New(t)
+	ack, _ := hex.DecodeString(readPropertyAck)
+	received := make(chan NPDU, 1)
+	router, _ := newFakeDevice(t, func(req NPDU) []NPDU {
+		received <- req
+		// The router answers for the MS/TP device 12 on network 5
+		a := answer(APDU{
+			DataType:    ComplexAck,
+			ServiceType: ServiceConfirmedReadProperty,
+			InvokeID:    req.ADPU.InvokeID,
+			Payload:     &DataPayload{Bytes: ack},
+		})
+		a.Source = &bacnet.Address{Net: 5, Adr: []byte{12}}
+		return []NPDU{a}
+	})
+	device := bacnet.Device{
+		ID:   bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 5012},
+		Addr: bacnet.Address{Mac: router.Addr.Mac, Net: 5, Adr: []byte{12}},
+	}
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, device, testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+	req := <-received
+	is.Equal(req.Destination.Net, uint16(5))
+	is.Equal(req.Destination.Adr, []byte{12})
+	is.Equal(req.HopCount, byte(255))
+}
+
+func TestWhoIsRecordsRemoteAddress(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t)
+	routerIP := net.UDPAddr{IP: net.IPv4(127, 0, 0, 2).To4(), Port: DefaultUDPPort}
+	iam, err := BVLC{
+		Type:     TypeBacnetIP,
+		Function: BacFuncBroadcast,
+		NPDU: NPDU{
+			Version: Version1,
+			Source:  &bacnet.Address{Net: 5, Adr: []byte{12}},
+			ADPU: &APDU{
+				DataType:    UnconfirmedServiceRequest,
+				ServiceType: ServiceUnconfirmedIAm,
+				Payload: &Iam{
+					ObjectID:            bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 5012},
+					MaxApduLength:       480,
+					SegmentationSupport: bacnet.SegmentationSupportNone,
+					VendorID:            7,
+				},
+			},
+		},
+	}.MarshalBinary()
+	is.NoErr(err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = handleBVLC(c, &routerIP, iam)
+	}()
+	devices, err := c.WhoIs(WhoIs{}, 100*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(len(devices), 1)
+	is.Equal(devices[0].Addr, bacnet.Address{
+		Mac: []byte{4, 127, 0, 0, 2, 0xba, 0xc0},
+		Net: 5,
+		Adr: []byte{12},
+	})
+}
+
+func TestWhoHasRemoteNetwork(t *testing.T) {
+	is := is.New(t)
+	received := make(chan NPDU, 1)
+	router, _ := newFakeDevice(t, func(req NPDU) []NPDU {
+		received <- req
+		// The MS/TP device 12 on network 5 has the object
+		a := answer(APDU{
+			DataType:    UnconfirmedServiceRequest,
+			ServiceType: ServiceUnconfirmedIHave,
+			Payload: &IHave{
+				DeviceID:   bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 5012},
+				ObjectID:   bacnet.ObjectID{Type: bacnet.AnalogInput, Instance: 1},
+				ObjectName: "Temp",
+			},
+		})
+		a.Source = &bacnet.Address{Net: 5, Adr: []byte{12}}
+		return []NPDU{a}
+	})
+	c := newTestClient(t)
+	c.routes.set(5, router.Addr)
+	results, err := c.WhoHas(WhoHas{ObjectName: "Temp"}, 100*time.Millisecond, WithNetwork(5))
+	is.NoErr(err)
+	is.Equal(len(results), 1)
+	is.Equal(results[0].DeviceID.Instance, bacnet.ObjectInstance(5012))
+	is.Equal(results[0].Addr, bacnet.Address{Mac: router.Addr.Mac, Net: 5, Adr: []byte{12}})
+	// The request is a broadcast on the network 5 only
+	req := <-received
+	is.Equal(req.Destination.Net, uint16(5))
+	is.Equal(len(req.Destination.Adr), 0)
+	is.Equal(req.HopCount, byte(255))
+}
+
+// handleBVLC handles the BVLC as if the client received it from src
+func handleBVLC(c *Client, src *net.UDPAddr, b []byte) error {
+	r, ok, err := c.link.(*IPv4Link).handleMessage(src, b)
+	if err != nil || !ok {
+		return err
+	}
+	return c.handleMessage(r.npdu, r.mac)
+}
+
+func TestNewClientWithOptions(t *testing.T) {
+	is := is.New(t)
+	_, err := NewClientWithOptions()
+	is.True(err != nil) // no broadcast address
+
+	// The broadcasts are sent to the network given explicitly
+	network, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer network.Close()
+	c, err := NewClientWithOptions(
+		WithBindIP(net.IPv4(127, 0, 0, 1)),
+		WithBroadcast(net.IPv4(127, 0, 0, 1)),
+		WithBroadcastPort(network.LocalAddr().(*net.UDPAddr).Port),
+		WithDeviceInstance(4194),
+		WithVendorID(260),
+		WithAPDUTimeout(time.Second),
+		WithAPDURetries(1),
+		WithMaxAPDU(480),
+		WithSegmentation(false, 0),
+	)
+	is.NoErr(err)
+	defer c.Close()
+	is.Equal(c.timings, APDUTimings{Timeout: time.Second, SegmentTimeout: DefaultAPDUTimings.SegmentTimeout, Retries: 1})
+	is.Equal(c.limits, APDULimits{MaxApdu: 480})
+	// The socket listens on all the addresses to receive the broadcasts
+	is.True(c.link.(*IPv4Link).Addr().IP.IsUnspecified())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.link.(*IPv4Link).Addr().Port}
+
+	receive := func() BVLC {
+		b := make([]byte, 2048)
+		_ = network.SetReadDeadline(time.Now().Add(time.Second))
+		i, _, err := network.ReadFromUDP(b)
+		is.NoErr(err)
+		var bvlc BVLC
+		is.NoErr(bvlc.UnmarshalBinary(b[:i]))
+		return bvlc
+	}
+	_, _ = c.WhoIs(WhoIs{}, 10*time.Millisecond)
+	bvlc := receive()
+	is.Equal(bvlc.Function, BacFuncBroadcast)
+	is.Equal(bvlc.NPDU.ADPU.ServiceType, ServiceUnconfirmedWhoIs)
+
+	// The client answers the WhoIs for its device
+	low, high := uint32(4000), uint32(5000)
+	data, err := BVLC{Type: TypeBacnetIP, Function: BacFuncBroadcast, NPDU: NPDU{
+		Version: Version1,
+		ADPU: &APDU{
+			DataType:    UnconfirmedServiceRequest,
+			ServiceType: ServiceUnconfirmedWhoIs,
+			Payload:     &WhoIs{Low: &low, High: &high},
+		},
+	}}.MarshalBinary()
+	is.NoErr(err)
+	_, err = network.WriteToUDP(data, addr)
+	is.NoErr(err)
+	bvlc = receive()
+	is.Equal(bvlc.NPDU.ADPU.ServiceType, ServiceUnconfirmedIAm)
+
+	// The own broadcasts of the client are dropped, it doesn't answer
+	// its own WhoIs
+	_, ok, err := c.link.(*IPv4Link).handleMessage(addr, data)
+	is.NoErr(err)
+	is.True(!ok)
+	is.Equal(*bvlc.NPDU.ADPU.Payload.(*Iam), Iam{
+		ObjectID:            bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 4194},
+		MaxApduLength:       480,
+		SegmentationSupport: bacnet.SegmentationSupportNone,
+		VendorID:            260,
+	})
+}
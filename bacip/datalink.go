@@ -0,0 +1,21 @@
+package bacip
+
+// DataLink is a data link layer the client exchanges the npdus on,
+// such as BACnet/IP, BACnet/IPv6 or MS/TP. The MAC addresses are the ones of
+// the data link: they are the Mac of the bacnet.Address of the devices
+// found on the local network.
+type DataLink interface {
+	// Send sends the npdu to the node of the local network with the
+	// given MAC address
+	Send(mac []byte, npdu []byte) error
+	// Broadcast sends the npdu to all the nodes of the local network
+	Broadcast(npdu []byte) error
+	// Receive waits for the next npdu and returns it with the MAC
+	// address of its sender. It returns net.ErrClosed once the link
+	// is closed.
+	Receive() (npdu []byte, mac []byte, err error)
+	// MaxAPDU returns the maximum length of the APDUs the link
+	// conveys
+	MaxAPDU() uint
+	Close() error
+}
@@ -0,0 +1,137 @@
+package bacip
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/REQUEA/bacnet"
+)
+
+// Message is an unsolicited message received by the client, i.e. a
+// confirmed or unconfirmed service request sent by another device,
+// or a network layer message
+type Message struct {
+	// Source is the bacnet address of the sender
+	Source bacnet.Address
+	NPDU   NPDU
+}
+
+// Filter selects the messages delivered to a handler
+type Filter func(Message) bool
+
+// ForService matches the messages of the given service
+func ForService(dataType PDUType, service ServiceType) Filter {
+	return func(m Message) bool {
+		apdu := m.NPDU.ADPU
+		return apdu != nil && apdu.DataType == dataType && apdu.ServiceType == service
+	}
+}
+
+// ForNetworkMessage matches the network layer messages of the given
+// type
+func ForNetworkMessage(t NetworkMessageType) Filter {
+	return func(m Message) bool {
+		return m.NPDU.IsNetworkLayerMessage && m.NPDU.NetworkMessageType == t
+	}
+}
+
+// FromSource matches the messages sent from the given address
+func FromSource(addr bacnet.Address) Filter {
+	return func(m Message) bool {
+		if addr.Net != 0 || m.Source.Net != 0 {
+			return addr.Net == m.Source.Net && bytes.Equal(addr.Adr, m.Source.Adr)
+		}
+		return bytes.Equal(addr.Mac, m.Source.Mac)
+	}
+}
+
+// subscriptionQueueSize is the number of messages a handler can lag
+// behind before messages are dropped
+const subscriptionQueueSize = 256
+
+// Dispatcher delivers the unsolicited messages to any number of
+// handlers. Each handler runs in its own goroutine, so a slow handler
+// doesn't block the reception of messages nor the other handlers.
+type Dispatcher struct {
+	sync.RWMutex
+	logger        Logger
+	nextID        uint64
+	subscriptions map[uint64]*subscription
+}
+
+type subscription struct {
+	filters []Filter
+	queue   chan Message
+	done    chan struct{}
+}
+
+func NewDispatcher(logger Logger) *Dispatcher {
+	return &Dispatcher{
+		logger:        logger,
+		subscriptions: map[uint64]*subscription{},
+	}
+}
+
+// Subscribe calls handler for each message matching all the
+// filters, or all messages if no filter is given. The handler is
+// called for one message at a time. The messages received are decoded
+// concurrently, so messages received close together may be delivered
+// out of order. If the handler is too slow, messages are dropped. The returned function removes the
+// subscription, it can be safely called from the handler.
+func (d *Dispatcher) Subscribe(handler func(Message), filters ...Filter) (unsubscribe func()) {
+	s := &subscription{
+		filters: filters,
+		queue:   make(chan Message, subscriptionQueueSize),
+		done:    make(chan struct{}),
+	}
+	d.Lock()
+	id := d.nextID
+	d.nextID++
+	d.subscriptions[id] = s
+	d.Unlock()
+	go func() {
+		for {
+			select {
+			case m := <-s.queue:
+				handler(m)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.Lock()
+			delete(d.subscriptions, id)
+			d.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// dispatch queues the message for all the matching handlers. It
+// never blocks.
+func (d *Dispatcher) dispatch(m Message) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, s := range d.subscriptions {
+		if !s.match(m) {
+			continue
+		}
+		select {
+		case s.queue <- m:
+		default:
+			d.logger.Error("subscription queue full, message dropped")
+		}
+	}
+}
+
+func (s *subscription) match(m Message) bool {
+	for _, f := range s.filters {
+		if !f(m) {
+			return false
+		}
+	}
+	return true
+}
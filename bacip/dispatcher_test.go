@@ -0,0 +1,108 @@
+package bacip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+func unconfirmed(service ServiceType, src bacnet.Address) Message {
+	return Message{
+		Source: src,
+		NPDU: NPDU{
+			Version: Version1,
+			ADPU:    &APDU{DataType: UnconfirmedServiceRequest, ServiceType: service},
+		},
+	}
+}
+
+func receive(t *testing.T, c <-chan Message) (Message, bool) {
+	t.Helper()
+	select {
+	case m := <-c:
+		return m, true
+	case <-time.After(50 * time.Millisecond):
+		return Message{}, false
+	}
+}
+
+func TestDispatcherFilters(t *testing.T) {
+	is := is.New(t)
+	d := NewDispatcher(NoOpLogger{})
+	deviceA := bacnet.Address{Mac: []byte{4, 10, 0, 0, 1, 0xba, 0xc0}}
+	deviceB := bacnet.Address{Mac: []byte{4, 10, 0, 0, 2, 0xba, 0xc0}}
+
+	iams := make(chan Message, 10)
+	unsubscribeIam := d.Subscribe(func(m Message) { iams <- m }, ForService(UnconfirmedServiceRequest, ServiceUnconfirmedIAm))
+	fromA := make(chan Message, 10)
+	d.Subscribe(func(m Message) { fromA <- m }, FromSource(deviceA))
+
+	d.dispatch(unconfirmed(ServiceUnconfirmedIAm, deviceB))
+	m, ok := receive(t, iams)
+	is.True(ok)
+	is.Equal(m.Source, deviceB)
+	_, ok = receive(t, fromA)
+	is.True(!ok) // Not sent by device A
+
+	d.dispatch(unconfirmed(ServiceUnconfirmedCOVNotification, deviceA))
+	_, ok = receive(t, fromA)
+	is.True(ok)
+	_, ok = receive(t, iams)
+	is.True(!ok) // Not an IAm
+
+	unsubscribeIam()
+	unsubscribeIam() // Calling it twice is harmless
+	d.dispatch(unconfirmed(ServiceUnconfirmedIAm, deviceA))
+	_, ok = receive(t, iams)
+	is.True(!ok)
+	_, ok = receive(t, fromA)
+	is.True(ok)
+}
+
+func TestDispatcherSlowHandler(t *testing.T) {
+	is := is.New(t)
+	d := NewDispatcher(NoOpLogger{})
+	block := make(chan struct{})
+	defer close(block)
+	d.Subscribe(func(m Message) { <-block })
+	received := make(chan Message, 2*subscriptionQueueSize)
+	d.Subscribe(func(m Message) { received <- m })
+	done := make(chan struct{})
+	go func() {
+		// More messages than the blocked handler can queue
+		for x := 0; x < 2*subscriptionQueueSize; x++ {
+			d.dispatch(unconfirmed(ServiceUnconfirmedIAm, bacnet.Address{}))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked by a slow handler")
+	}
+	// The other handler gets at least a full queue of messages
+	count := 0
+	for _, ok := receive(t, received); ok; _, ok = receive(t, received) {
+		count++
+	}
+	is.True(count >= subscriptionQueueSize)
+}
+
+func TestDispatcherUnsubscribeFromHandler(t *testing.T) {
+	is := is.New(t)
+	d := NewDispatcher(NoOpLogger{})
+	calls := make(chan struct{}, 10)
+	var unsubscribe func()
+	unsubscribe = d.Subscribe(func(m Message) {
+		unsubscribe()
+		calls <- struct{}{}
+	})
+	d.dispatch(unconfirmed(ServiceUnconfirmedIAm, bacnet.Address{}))
+	<-calls
+	d.dispatch(unconfirmed(ServiceUnconfirmedIAm, bacnet.Address{}))
+	time.Sleep(20 * time.Millisecond)
+	is.Equal(len(calls), 0)
+}
@@ -0,0 +1,126 @@
+package bacip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// foreignDevice is the registration of a BACnet/IP link to a BBMD
+type foreignDevice struct {
+	bbmd *net.UDPAddr
+	// ctx is canceled when the registration stops, it aborts the
+	// renewal in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// RegisterForeignDevice registers the client as a foreign device of
+// the BBMD for ttl. The registration is renewed until
+// UnregisterForeignDevice is called or the client is closed. While
+// registered, the broadcasts are distributed by the BBMD on its
+// network instead of being sent on the local network, so a client
+// outside of the building subnet can discover the devices.
+func (c *Client) RegisterForeignDevice(ctx context.Context, bbmd *net.UDPAddr, ttl time.Duration) error {
+	link, ok := c.link.(*IPv4Link)
+	if !ok {
+		return errors.New("register foreign device: needs a BACnet/IP client")
+	}
+	c.settingsMutex.Lock()
+	timings := c.timings
+	c.settingsMutex.Unlock()
+	return link.registerForeignDevice(ctx, bbmd, ttl, timings)
+}
+
+// UnregisterForeignDevice stops renewing the foreign device
+// registration and asks the BBMD to delete it. The broadcasts are
+// sent on the local network again.
+func (c *Client) UnregisterForeignDevice(ctx context.Context) error {
+	link, ok := c.link.(*IPv4Link)
+	if !ok {
+		return nil
+	}
+	c.settingsMutex.Lock()
+	timings := c.timings
+	c.settingsMutex.Unlock()
+	return link.unregisterForeignDevice(ctx, timings)
+}
+
+// registerForeignDevice registers the link to the BBMD and renews the
+// registration until it is unregistered or closed
+func (l *IPv4Link) registerForeignDevice(ctx context.Context, bbmd *net.UDPAddr, ttl time.Duration, timings APDUTimings) error {
+	seconds := ttl / time.Second
+	if seconds < 1 || seconds > 0xFFFF {
+		return fmt.Errorf("invalid foreign device TTL %v", ttl)
+	}
+	request := BVLC{
+		Function: BacFuncRegisterForeignDevice,
+		Payload:  &RegisterForeignDevice{TTL: uint16(seconds)},
+	}
+	_, err := l.request(ctx, bbmd, request, timings)
+	if err != nil {
+		return fmt.Errorf("register foreign device to %v: %w", bbmd, err)
+	}
+	fd := &foreignDevice{bbmd: bbmd}
+	fd.ctx, fd.cancel = context.WithCancel(context.Background())
+	l.mutex.Lock()
+	previous := l.foreign
+	l.foreign = fd
+	l.mutex.Unlock()
+	if previous != nil {
+		previous.cancel()
+	}
+	l.wg.Add(1)
+	go l.renewRegistration(fd, request, seconds*time.Second, timings)
+	return nil
+}
+
+// unregisterForeignDevice stops the renewal of the registration and
+// deletes the entry of the link from the table of the BBMD
+func (l *IPv4Link) unregisterForeignDevice(ctx context.Context, timings APDUTimings) error {
+	l.mutex.Lock()
+	fd := l.foreign
+	l.foreign = nil
+	l.mutex.Unlock()
+	if fd == nil {
+		return nil
+	}
+	fd.cancel()
+	addr, err := l.localAddrTo(fd.bbmd)
+	if err != nil {
+		return fmt.Errorf("unregister foreign device from %v: %w", fd.bbmd, err)
+	}
+	_, err = l.request(ctx, fd.bbmd, BVLC{
+		Function: BacFuncDeleteForeignDeviceTableEntry,
+		Payload:  &DeleteForeignDeviceTableEntry{Addr: *addr},
+	}, timings)
+	if err != nil {
+		return fmt.Errorf("unregister foreign device from %v: %w", fd.bbmd, err)
+	}
+	return nil
+}
+
+// renewRegistration renews the registration at half of the TTL, so a
+// lost request can be retried before the BBMD drops the registration
+func (l *IPv4Link) renewRegistration(fd *foreignDevice, request BVLC, ttl time.Duration, timings APDUTimings) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(fd.ctx, ttl/2)
+			_, err := l.request(ctx, fd.bbmd, request, timings)
+			cancel()
+			if err != nil && !errors.Is(err, net.ErrClosed) && fd.ctx.Err() == nil {
+				l.logger.Error(fmt.Sprintf("renew foreign device registration to %v: %v", fd.bbmd, err))
+			}
+		case <-fd.ctx.Done():
+			return
+		case <-l.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package bacip
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+// fakeBBMD is a BBMD listening on the loopback interface. The handler
+// is called for each received BVLC and the returned messages are sent
+// back to the sender.
+type fakeBBMD struct {
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	handler func(req BVLC) [][]byte
+}
+
+func newFakeBBMD(t *testing.T, handler func(req BVLC) [][]byte) *fakeBBMD {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBBMD{conn: conn, handler: handler}
+	t.Cleanup(func() { conn.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *fakeBBMD) addr() *net.UDPAddr {
+	return b.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (b *fakeBBMD) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var bvlc BVLC
+		if bvlc.UnmarshalBinary(buf[:n]) != nil {
+			continue
+		}
+		b.mutex.Lock()
+		answers := b.handler(bvlc)
+		b.mutex.Unlock()
+		for _, a := range answers {
+			_, _ = b.conn.WriteToUDP(a, src)
+		}
+	}
+}
+
+func bvlcResult(t *testing.T, code BVLCResultCode) []byte {
+	t.Helper()
+	b, err := BVLC{Type: TypeBacnetIP, Function: BacFuncResult, Payload: &BVLCResult{Code: code}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// forwardedNPDU returns the Forwarded-NPDU of the npdu sent by the
+// device at origin
+func forwardedNPDU(t *testing.T, origin net.UDPAddr, npdu NPDU) []byte {
+	t.Helper()
+	b, err := BVLC{Type: TypeBacnetIP, Function: BacFuncForwardedNPDU, Origin: &origin, NPDU: npdu}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestForeignDevice(t *testing.T) {
+	is := is.New(t)
+	requests := make(chan BVLC, 10)
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte {
+		switch req.Function {
+		case BacFuncRegisterForeignDevice, BacFuncDeleteForeignDeviceTableEntry:
+			requests <- req
+			return [][]byte{bvlcResult(t, BVLCResultSuccessful)}
+		case BacFuncDistributeBroadcastToNetwork:
+			requests <- req
+			// A device of the BBMD network answers
+			return [][]byte{forwardedNPDU(t, net.UDPAddr{IP: net.IPv4(10, 0, 0, 12), Port: DefaultUDPPort}, NPDU{
+				Version: Version1,
+				ADPU: &APDU{
+					DataType:    UnconfirmedServiceRequest,
+					ServiceType: ServiceUnconfirmedIAm,
+					Payload: &Iam{
+						ObjectID:            bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 12},
+						MaxApduLength:       1476,
+						SegmentationSupport: bacnet.SegmentationSupportBoth,
+						VendorID:            7,
+					},
+				},
+			})}
+		}
+		return nil
+	})
+	next := func() BVLC {
+		select {
+		case req := <-requests:
+			return req
+		case <-time.After(2 * time.Second):
+			t.Fatal("no request received by the BBMD")
+			return BVLC{}
+		}
+	}
+	c := newTestClient(t)
+	is.NoErr(c.RegisterForeignDevice(context.Background(), bbmd.addr(), time.Second))
+	is.Equal(next().Payload, &RegisterForeignDevice{TTL: 1})
+	devices, err := c.WhoIs(WhoIs{}, 100*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(len(devices), 1)
+	is.Equal(devices[0].ID.Instance, bacnet.ObjectInstance(12))
+	// The device address is the originating address, not the BBMD one
+	is.Equal(devices[0].Addr, bacnet.Address{Mac: []byte{4, 10, 0, 0, 12, 0xba, 0xc0}})
+	distributed := next()
+	is.Equal(distributed.Function, BacFuncDistributeBroadcastToNetwork)
+	is.Equal(distributed.NPDU.ADPU.ServiceType, ServiceUnconfirmedWhoIs)
+
+	// The registration is renewed at half of the TTL
+	is.Equal(next().Payload, &RegisterForeignDevice{TTL: 1})
+
+	// The BBMD is asked to delete the entry of the client
+	is.NoErr(c.UnregisterForeignDevice(context.Background()))
+	deleted := next().Payload.(*DeleteForeignDeviceTableEntry).Addr
+	is.True(deleted.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	is.Equal(deleted.Port, c.link.(*IPv4Link).Addr().Port)
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected %v after unregistration", req.Function)
+	case <-time.After(700 * time.Millisecond): // more than TTL/2
+	}
+}
+
+func TestForeignDeviceClose(t *testing.T) {
+	is := is.New(t)
+	registrations := make(chan struct{}, 10)
+	first := true
+	// The BBMD stops answering after the registration
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte {
+		if req.Function != BacFuncRegisterForeignDevice {
+			return nil
+		}
+		registrations <- struct{}{}
+		if !first {
+			return nil
+		}
+		first = false
+		return [][]byte{bvlcResult(t, BVLCResultSuccessful)}
+	})
+	c := newTestClient(t)
+	c.SetAPDUTimings(APDUTimings{Timeout: 200 * time.Millisecond, Retries: 10})
+	is.NoErr(c.RegisterForeignDevice(context.Background(), bbmd.addr(), time.Second))
+	<-registrations
+	<-registrations // the renewal is in progress
+	start := time.Now()
+	is.NoErr(c.Close())
+	// The renewal is aborted and the deletion waits one timeout
+	is.True(time.Since(start) < time.Second)
+}
+
+func TestForeignDeviceNAK(t *testing.T) {
+	is := is.New(t)
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte {
+		return [][]byte{bvlcResult(t, BVLCResultRegisterForeignDeviceNAK)}
+	})
+	c := newTestClient(t)
+	err := c.RegisterForeignDevice(context.Background(), bbmd.addr(), time.Minute)
+	var result BVLCResult
+	is.True(errors.As(err, &result))
+	is.Equal(result.Code, BVLCResultRegisterForeignDeviceNAK)
+	is.Equal(result.Error(), "bvlc result: Register-Foreign-Device NAK")
+}
+
+func TestForeignDeviceTimeout(t *testing.T) {
+	is := is.New(t)
+	bbmd := newFakeBBMD(t, func(req BVLC) [][]byte { return nil })
+	c := newTestClient(t)
+	c.SetAPDUTimings(APDUTimings{Timeout: 20 * time.Millisecond, Retries: 1})
+	err := c.RegisterForeignDevice(context.Background(), bbmd.addr(), time.Minute)
+	is.True(errors.Is(err, ErrAPDUTimeout))
+}
+
+func TestBVLCResultCoherency(t *testing.T) {
+	is := is.New(t)
+	data := []byte{0x81, 0x00, 0x00, 0x06, 0x00, 0x30}
+	var bvlc BVLC
+	is.NoErr(bvlc.UnmarshalBinary(data))
+	is.Equal(bvlc.Payload, &BVLCResult{Code: BVLCResultRegisterForeignDeviceNAK})
+	b, err := bvlc.MarshalBinary()
+	is.NoErr(err)
+	is.Equal(b, data)
+}
+
+func TestForwardedAnswer(t *testing.T) {
+	is := is.New(t)
+	ack, _ := hex.DecodeString(readPropertyAck)
+	requests := make(chan NPDU, 1)
+	// The device answers through a BBMD
+	device, _ := newFakeDevice(t, func(req NPDU) []NPDU {
+		requests <- req
+		return nil
+	})
+	c := newTestClient(t)
+	go func() {
+		req := <-requests
+		bbmd := net.UDPAddr{IP: net.IPv4(127, 0, 0, 2).To4(), Port: DefaultUDPPort}
+		_ = handleBVLC(c, &bbmd, forwardedNPDU(t, bacnet.UDPFromAddress(device.Addr), answer(APDU{
+			DataType:    ComplexAck,
+			ServiceType: ServiceConfirmedReadProperty,
+			InvokeID:    req.ADPU.InvokeID,
+			Payload:     &DataPayload{Bytes: ack},
+		})))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, device, testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+}
+
+func TestDistributeBroadcastDropped(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t)
+	low, high := uint32(0), uint32(4194303)
+	// A foreign device asks a BBMD to distribute its broadcast, the
+	// client isn't one
+	b, err := BVLC{Type: TypeBacnetIP, Function: BacFuncDistributeBroadcastToNetwork, NPDU: NPDU{
+		Version: Version1,
+		ADPU: &APDU{
+			DataType:    UnconfirmedServiceRequest,
+			ServiceType: ServiceUnconfirmedWhoIs,
+			Payload:     &WhoIs{Low: &low, High: &high},
+		},
+	}}.MarshalBinary()
+	is.NoErr(err)
+	_, ok, err := c.link.(*IPv4Link).handleMessage(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2).To4(), Port: DefaultUDPPort}, b)
+	is.NoErr(err)
+	is.True(!ok) // not passed up
+}
+
+func TestForeignDeviceNotIPv4(t *testing.T) {
+	is := is.New(t)
+	c := NewClientWithDataLink((&LoopbackNetwork{}).Link(), NoOpLogger{})
+	defer c.Close()
+	err := c.RegisterForeignDevice(context.Background(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: DefaultUDPPort}, time.Minute)
+	is.True(err != nil)
+	is.NoErr(c.UnregisterForeignDevice(context.Background()))
+}
@@ -0,0 +1,292 @@
+package bacip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+)
+
+// IPv4Config is the configuration of a BACnet/IP data link
+type IPv4Config struct {
+	// Addr is the local address. Default is a random port on all the
+	// addresses.
+	Addr *net.UDPAddr
+	// Broadcast is the address the broadcasts are sent to, usually
+	// the directed broadcast address of the subnet on DefaultUDPPort
+	Broadcast *net.UDPAddr
+}
+
+// IPv4Link is a BACnet/IP data link (Annex J). The MAC addresses are
+// the ones of bacnet.AddressFromUDP. While the client is registered
+// as foreign device, the broadcasts are distributed by its BBMD.
+type IPv4Link struct {
+	conn      *net.UDPConn
+	broadcast *net.UDPAddr
+	logger    Logger
+	bvll      *bvllRequests
+	// localIPs are the addresses of the interfaces, the link receives
+	// its own broadcasts from one of them
+	localIPs  []net.IP
+	mutex     sync.Mutex
+	foreign   *foreignDevice
+	incoming  chan received
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewIPv4Link opens a BACnet/IP data link
+func NewIPv4Link(config IPv4Config, logger Logger) (*IPv4Link, error) {
+	if config.Broadcast == nil {
+		return nil, fmt.Errorf("no broadcast address")
+	}
+	addr := config.Addr
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	localIPs, err := interfaceIPs()
+	if err != nil {
+		return nil, fmt.Errorf("interface addresses: %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &IPv4Link{
+		conn:      conn,
+		broadcast: config.Broadcast,
+		logger:    logger,
+		localIPs:  localIPs,
+		bvll:      &bvllRequests{pending: map[string]*pendingBVLL{}},
+		incoming:  make(chan received),
+		closed:    make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.listen()
+	return l, nil
+}
+
+// Addr returns the local address of the link
+func (l *IPv4Link) Addr() *net.UDPAddr {
+	return l.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// localAddrTo returns the address of the link as seen by dst when
+// there is no NAT between them. The IP of a link listening on all the
+// addresses is the one of the interface routing to dst.
+func (l *IPv4Link) localAddrTo(dst *net.UDPAddr) (*net.UDPAddr, error) {
+	addr := *l.Addr()
+	if !addr.IP.IsUnspecified() {
+		return &addr, nil
+	}
+	conn, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	addr.IP = conn.LocalAddr().(*net.UDPAddr).IP
+	return &addr, nil
+}
+
+// MaxAPDU returns the maximum APDU length of BACnet/IP
+func (l *IPv4Link) MaxAPDU() uint {
+	return 1476
+}
+
+// Close closes the link
+func (l *IPv4Link) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+		l.wg.Wait()
+	})
+	return err
+}
+
+// Send sends the npdu to the node with the MAC address mac
+func (l *IPv4Link) Send(mac []byte, npdu []byte) error {
+	addr := bacnet.UDPFromAddress(bacnet.Address{Mac: mac})
+	if addr.IP == nil {
+		return fmt.Errorf("invalid BACnet/IP MAC address %x", mac)
+	}
+	return l.write(&addr, BacFuncUnicast, npdu)
+}
+
+// Broadcast sends the npdu to all the nodes of the local network. A
+// foreign device asks its BBMD to distribute the npdu instead.
+func (l *IPv4Link) Broadcast(npdu []byte) error {
+	function := BacFuncBroadcast
+	dst := l.broadcast
+	l.mutex.Lock()
+	if l.foreign != nil {
+		function = BacFuncDistributeBroadcastToNetwork
+		dst = l.foreign.bbmd
+	}
+	l.mutex.Unlock()
+	return l.write(dst, function, npdu)
+}
+
+func (l *IPv4Link) write(dst *net.UDPAddr, function Function, npdu []byte) error {
+	data, err := BVLC{Type: TypeBacnetIP, Function: function}.marshalFrame(npdu)
+	if err != nil {
+		return err
+	}
+	_, err = l.conn.WriteToUDP(data, dst)
+	return err
+}
+
+// Receive returns the next npdu and the MAC address of its sender
+func (l *IPv4Link) Receive() ([]byte, []byte, error) {
+	select {
+	case r := <-l.incoming:
+		return r.npdu, r.mac, nil
+	case <-l.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (l *IPv4Link) listen() {
+	defer l.wg.Done()
+	b := make([]byte, 2048)
+	for {
+		i, addr, err := l.conn.ReadFromUDP(b)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			l.logger.Error(err.Error())
+			continue
+		}
+		r, ok, err := l.handleMessage(addr, b[:i])
+		if err != nil {
+			l.logger.Error("handle bvlc msg: ", err)
+		}
+		if !ok {
+			continue
+		}
+		select {
+		case l.incoming <- r:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// handleMessage decodes the BVLC received from src. It returns false
+// when it holds no npdu for the upper layers.
+func (l *IPv4Link) handleMessage(src *net.UDPAddr, b []byte) (received, bool, error) {
+	var bvlc BVLC
+	npdu, err := bvlc.unmarshalFrame(b)
+	if err != nil {
+		return received{}, false, err
+	}
+	switch bvlc.Function {
+	case BacFuncUnicast, BacFuncBroadcast, BacFuncForwardedNPDU:
+		if bvlc.Origin != nil {
+			// The npdu was forwarded by a BBMD, the sender is the
+			// originating device
+			src = bvlc.Origin
+		}
+		if l.isOwn(src) {
+			// Our own broadcasts
+			return received{}, false, nil
+		}
+		return received{npdu: append([]byte{}, npdu...), mac: bacnet.AddressFromUDP(*src).Mac}, true, nil
+	case BacFuncResult, BacFuncBroadcastDistributionTableAck, BacFuncReadForeignDeviceTableAck:
+		if l.bvll.deliver(src.String(), bvlc) {
+			return received{}, false, nil
+		}
+		if result, ok := bvlc.Payload.(*BVLCResult); ok {
+			// The NAK of a Distribute-Broadcast-To-Network
+			if result.Code == BVLCResultSuccessful {
+				return received{}, false, nil
+			}
+			return received{}, false, fmt.Errorf("%v: %w", src, *result)
+		}
+		return received{}, false, fmt.Errorf("unexpected %v from %v", bvlc.Function, src)
+	}
+	// BBMD functions, Distribute-Broadcast-To-Network included, the
+	// link isn't a BBMD
+	return received{}, false, nil
+}
+
+// isOwn is true if addr is the address of the link, on any of the
+// interfaces if it listens on all of them
+func (l *IPv4Link) isOwn(addr *net.UDPAddr) bool {
+	local := l.Addr()
+	if addr.Port != local.Port {
+		return false
+	}
+	if !local.IP.IsUnspecified() {
+		return addr.IP.Equal(local.IP)
+	}
+	for _, ip := range l.localIPs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceIPs returns the addresses of the local interfaces
+func interfaceIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// request sends the BVLL request to the BBMD and waits for its
+// answer. The request is retried as a confirmed request. A NAK is
+// returned as a BVLCResult error.
+func (l *IPv4Link) request(ctx context.Context, bbmd *net.UDPAddr, request BVLC, timings APDUTimings) (BVLC, error) {
+	peer := bbmd.String()
+	answers, err := l.bvll.start(ctx, peer)
+	if err != nil {
+		return BVLC{}, err
+	}
+	defer l.bvll.stop(peer)
+	request.Type = TypeBacnetIP
+	data, err := request.MarshalBinary()
+	if err != nil {
+		return BVLC{}, err
+	}
+	timer := time.NewTimer(timings.Timeout)
+	defer timer.Stop()
+	for attempt := 0; ; attempt++ {
+		_, err := l.conn.WriteToUDP(data, bbmd)
+		if err != nil {
+			return BVLC{}, err
+		}
+		resetTimer(timer, timings.Timeout)
+		select {
+		case answer := <-answers:
+			if result, ok := answer.Payload.(*BVLCResult); ok && result.Code != BVLCResultSuccessful {
+				return BVLC{}, *result
+			}
+			return answer, nil
+		case <-timer.C:
+			if attempt >= timings.Retries {
+				return BVLC{}, fmt.Errorf("%v to %v: %w", request.Function, bbmd, ErrAPDUTimeout)
+			}
+		case <-ctx.Done():
+			return BVLC{}, ctx.Err()
+		case <-l.closed:
+			return BVLC{}, net.ErrClosed
+		}
+	}
+}
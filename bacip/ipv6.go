@@ -0,0 +1,336 @@
+package bacip
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultIPv6Group is the link-local multicast group the BACnet/IPv6
+// broadcasts are sent to
+var DefaultIPv6Group = &net.UDPAddr{IP: net.ParseIP("ff02::bac0"), Port: DefaultUDPPort}
+
+// IPv6Config is the configuration of a BACnet/IPv6 data link
+type IPv6Config struct {
+	// Interface is the network interface the multicast group is
+	// joined on. Default is the interface chosen by the system.
+	Interface *net.Interface
+	// Addr is the local address. Default is a random port on all the
+	// addresses. When its port is the one of the group, the group
+	// socket is used to send the messages too.
+	Addr *net.UDPAddr
+	// Group is the address the broadcasts are sent to. Default is
+	// DefaultIPv6Group. A unicast address is used as is, the link
+	// then doesn't join any group.
+	Group *net.UDPAddr
+	// VMAC is the virtual MAC address of the node. Devices use their
+	// instance number, see VMACFromInstance. Default is a random VMAC
+	// outside of the range of the device instances.
+	VMAC *VMAC
+	// ResolutionTimeout is the time waited for the answer to an
+	// address resolution. Default is 3 seconds.
+	ResolutionTimeout time.Duration
+}
+
+// IPv6Link is a BACnet/IPv6 data link (Annex U). The nodes are
+// addressed by their VMAC, their IPv6 address being learnt from the
+// messages they send or found by address resolution.
+type IPv6Link struct {
+	vmac              VMAC
+	conn              *net.UDPConn
+	multicast         *net.UDPConn
+	group             *net.UDPAddr
+	resolutionTimeout time.Duration
+	logger            Logger
+	mutex             sync.Mutex
+	peers             map[VMAC]*net.UDPAddr
+	resolving         map[VMAC]chan struct{}
+	incoming          chan received
+	closed            chan struct{}
+	closeOnce         sync.Once
+	wg                sync.WaitGroup
+}
+
+// received is a npdu received by a data link
+type received struct {
+	npdu []byte
+	mac  []byte
+}
+
+// NewIPv6Link opens a BACnet/IPv6 data link
+func NewIPv6Link(config IPv6Config, logger Logger) (*IPv6Link, error) {
+	l := &IPv6Link{
+		group:             config.Group,
+		resolutionTimeout: config.ResolutionTimeout,
+		logger:            logger,
+		peers:             map[VMAC]*net.UDPAddr{},
+		resolving:         map[VMAC]chan struct{}{},
+		incoming:          make(chan received),
+		closed:            make(chan struct{}),
+	}
+	if l.group == nil {
+		group := *DefaultIPv6Group
+		l.group = &group
+	}
+	if l.group.IP.IsLinkLocalMulticast() && l.group.Zone == "" && config.Interface != nil {
+		group := *l.group
+		group.Zone = config.Interface.Name
+		l.group = &group
+	}
+	if l.resolutionTimeout == 0 {
+		l.resolutionTimeout = 3 * time.Second
+	}
+	if config.VMAC != nil {
+		l.vmac = *config.VMAC
+	} else {
+		_, err := rand.Read(l.vmac[:])
+		if err != nil {
+			return nil, err
+		}
+		l.vmac[0] |= 0x40
+	}
+	addr := config.Addr
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv6unspecified}
+	}
+	var err error
+	if l.group.IP.IsMulticast() {
+		l.multicast, err = net.ListenMulticastUDP("udp6", config.Interface, l.group)
+		if err != nil {
+			return nil, fmt.Errorf("join %v: %w", l.group, err)
+		}
+		if addr.Port == l.group.Port {
+			// Both sockets can't be bound to the same port
+			l.conn, l.multicast = l.multicast, nil
+		}
+	}
+	if l.conn == nil {
+		l.conn, err = net.ListenUDP("udp6", addr)
+		if err != nil {
+			if l.multicast != nil {
+				l.multicast.Close()
+			}
+			return nil, err
+		}
+	}
+	for _, conn := range []*net.UDPConn{l.conn, l.multicast} {
+		if conn != nil {
+			l.wg.Add(1)
+			go l.listen(conn)
+		}
+	}
+	return l, nil
+}
+
+// VMAC returns the virtual MAC address of the node
+func (l *IPv6Link) VMAC() VMAC {
+	return l.vmac
+}
+
+// Addr returns the local address of the link
+func (l *IPv6Link) Addr() *net.UDPAddr {
+	return l.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// MaxAPDU returns the maximum APDU length of BACnet/IPv6
+func (l *IPv6Link) MaxAPDU() uint {
+	return 1476
+}
+
+// Close closes the link
+func (l *IPv6Link) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+		if l.multicast != nil {
+			l.multicast.Close()
+		}
+		l.wg.Wait()
+	})
+	return err
+}
+
+// Send sends the npdu to the node with the VMAC mac. Its IPv6 address
+// is resolved first if it is unknown.
+func (l *IPv6Link) Send(mac []byte, npdu []byte) error {
+	if len(mac) != len(VMAC{}) {
+		return fmt.Errorf("invalid BACnet/IPv6 MAC address %x", mac)
+	}
+	var dst VMAC
+	copy(dst[:], mac)
+	addr, err := l.resolve(dst)
+	if err != nil {
+		return err
+	}
+	return l.write(addr, BVLL6{
+		Function:    BVLL6OriginalUnicastNPDU,
+		Source:      l.vmac,
+		Destination: dst,
+		Data:        npdu,
+	})
+}
+
+// Broadcast sends the npdu to the multicast group
+func (l *IPv6Link) Broadcast(npdu []byte) error {
+	return l.write(l.group, BVLL6{
+		Function: BVLL6OriginalBroadcastNPDU,
+		Source:   l.vmac,
+		Data:     npdu,
+	})
+}
+
+// Receive returns the next npdu and the VMAC of its sender
+func (l *IPv6Link) Receive() ([]byte, []byte, error) {
+	select {
+	case r := <-l.incoming:
+		return r.npdu, r.mac, nil
+	case <-l.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+// ErrAddressResolution is returned when no node answers the address
+// resolution of a VMAC
+var ErrAddressResolution = errors.New("address resolution timeout")
+
+// resolve returns the address of the node with the VMAC. Unknown
+// nodes are found by multicasting an Address-Resolution.
+func (l *IPv6Link) resolve(vmac VMAC) (*net.UDPAddr, error) {
+	l.mutex.Lock()
+	addr, ok := l.peers[vmac]
+	if ok {
+		l.mutex.Unlock()
+		return addr, nil
+	}
+	done, ok := l.resolving[vmac]
+	if !ok {
+		done = make(chan struct{})
+		l.resolving[vmac] = done
+	}
+	l.mutex.Unlock()
+	if !ok {
+		err := l.write(l.group, BVLL6{
+			Function:    BVLL6AddressResolution,
+			Source:      l.vmac,
+			Destination: vmac,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	timer := time.NewTimer(l.resolutionTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		l.mutex.Lock()
+		if l.resolving[vmac] == done {
+			delete(l.resolving, vmac)
+		}
+		l.mutex.Unlock()
+		return nil, fmt.Errorf("%v: %w", vmac, ErrAddressResolution)
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.peers[vmac], nil
+}
+
+// learn records the address of the node with the VMAC
+func (l *IPv6Link) learn(vmac VMAC, addr *net.UDPAddr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.peers[vmac] = addr
+	if done, ok := l.resolving[vmac]; ok {
+		close(done)
+		delete(l.resolving, vmac)
+	}
+}
+
+func (l *IPv6Link) write(dst *net.UDPAddr, bvll BVLL6) error {
+	data, err := bvll.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = l.conn.WriteToUDP(data, dst)
+	return err
+}
+
+func (l *IPv6Link) listen(conn *net.UDPConn) {
+	defer l.wg.Done()
+	b := make([]byte, 2048)
+	for {
+		i, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			l.logger.Error(err.Error())
+			continue
+		}
+		err = l.handleMessage(addr, b[:i])
+		if err != nil {
+			l.logger.Error("handle bvll6 msg: ", err)
+		}
+	}
+}
+
+func (l *IPv6Link) handleMessage(src *net.UDPAddr, data []byte) error {
+	var bvll BVLL6
+	err := bvll.UnmarshalBinary(data)
+	if err != nil {
+		return err
+	}
+	if bvll.Source == l.vmac {
+		// Our own multicast
+		return nil
+	}
+	if bvll.Origin != nil {
+		// Forwarded by a BBMD, the sender is the originating node
+		src = bvll.Origin
+	}
+	l.learn(bvll.Source, src)
+	switch bvll.Function {
+	case BVLL6OriginalUnicastNPDU:
+		if bvll.Destination != l.vmac {
+			return nil
+		}
+	case BVLL6OriginalBroadcastNPDU, BVLL6ForwardedNPDU:
+	case BVLL6AddressResolution, BVLL6ForwardedAddressResolution:
+		if bvll.Destination != l.vmac {
+			return nil
+		}
+		return l.write(src, BVLL6{
+			Function:    BVLL6AddressResolutionAck,
+			Source:      l.vmac,
+			Destination: bvll.Source,
+		})
+	case BVLL6VirtualAddressResolution:
+		return l.write(src, BVLL6{
+			Function:    BVLL6VirtualAddressResolutionAck,
+			Source:      l.vmac,
+			Destination: bvll.Source,
+		})
+	case BVLL6Result:
+		if bvll.Result != BVLL6ResultSuccessful {
+			return fmt.Errorf("%v: %w", src, BVLL6ResultError{Code: bvll.Result})
+		}
+		return nil
+	default:
+		// Address resolution answers are handled by learn, the
+		// other functions are for BBMDs
+		return nil
+	}
+	select {
+	case l.incoming <- received{npdu: bvll.Data, mac: append([]byte{}, bvll.Source[:]...)}:
+	case <-l.closed:
+	}
+	return nil
+}
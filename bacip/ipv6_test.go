@@ -0,0 +1,145 @@
+package bacip
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+// newIPv6Pair returns two BACnet/IPv6 links on the loopback interface.
+// The broadcasts of a link are sent to the other one.
+func newIPv6Pair(t *testing.T) (*IPv6Link, *IPv6Link) {
+	t.Helper()
+	listen := func(vmac VMAC) *IPv6Link {
+		l, err := NewIPv6Link(IPv6Config{
+			Addr: &net.UDPAddr{IP: net.IPv6loopback},
+			// Replaced once both links are open
+			Group:             &net.UDPAddr{IP: net.IPv6loopback, Port: 1},
+			VMAC:              &vmac,
+			ResolutionTimeout: 100 * time.Millisecond,
+		}, NoOpLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	a, b := listen(VMAC{0x00, 0x00, 0x01}), listen(VMAC{0x00, 0x04, 0xd2})
+	a.group, b.group = b.Addr(), a.Addr()
+	return a, b
+}
+
+func receiveNPDU(t *testing.T, l *IPv6Link) ([]byte, []byte) {
+	t.Helper()
+	type result struct{ npdu, mac []byte }
+	ch := make(chan result, 1)
+	go func() {
+		npdu, mac, err := l.Receive()
+		if err == nil {
+			ch <- result{npdu, mac}
+		}
+	}()
+	select {
+	case r := <-ch:
+		return r.npdu, r.mac
+	case <-time.After(time.Second):
+		t.Fatal("no npdu received")
+		return nil, nil
+	}
+}
+
+func TestIPv6Link(t *testing.T) {
+	is := is.New(t)
+	a, b := newIPv6Pair(t)
+	whoIs := []byte{0x01, 0x00, 0x10, 0x08}
+
+	is.NoErr(a.Broadcast(whoIs))
+	npdu, mac := receiveNPDU(t, b)
+	is.Equal(npdu, whoIs)
+	is.Equal(mac, []byte{0x00, 0x00, 0x01})
+
+	// The address of a is learnt from its broadcast
+	is.NoErr(b.Send(mac, whoIs))
+	npdu, mac = receiveNPDU(t, a)
+	is.Equal(npdu, whoIs)
+	is.Equal(mac, []byte{0x00, 0x04, 0xd2})
+}
+
+func TestIPv6AddressResolution(t *testing.T) {
+	is := is.New(t)
+	a, b := newIPv6Pair(t)
+	whoIs := []byte{0x01, 0x00, 0x10, 0x08}
+	// b is unknown to a, its address is resolved first
+	is.NoErr(a.Send([]byte{0x00, 0x04, 0xd2}, whoIs))
+	npdu, _ := receiveNPDU(t, b)
+	is.Equal(npdu, whoIs)
+
+	err := a.Send([]byte{0x00, 0x00, 0x05}, whoIs)
+	is.True(errors.Is(err, ErrAddressResolution))
+	is.True(a.Send([]byte{0x05}, whoIs) != nil) // not a VMAC
+}
+
+func TestIPv6Client(t *testing.T) {
+	is := is.New(t)
+	a, device := newIPv6Pair(t)
+	c := NewClientWithDataLink(a, NoOpLogger{})
+	t.Cleanup(func() { c.Close() })
+	ack, _ := hex.DecodeString(readPropertyAck)
+	go func() {
+		for {
+			data, mac, err := device.Receive()
+			if err != nil {
+				return
+			}
+			var req NPDU
+			if req.UnmarshallBinary(data) != nil {
+				continue
+			}
+			var answer NPDU
+			switch req.ADPU.ServiceType {
+			case ServiceUnconfirmedWhoIs:
+				answer = NPDU{Version: Version1, ADPU: &APDU{
+					DataType:    UnconfirmedServiceRequest,
+					ServiceType: ServiceUnconfirmedIAm,
+					Payload: &Iam{
+						ObjectID:      bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 1234},
+						MaxApduLength: 1476,
+						VendorID:      260,
+					},
+				}}
+			case ServiceConfirmedReadProperty:
+				answer = NPDU{Version: Version1, ADPU: &APDU{
+					DataType:    ComplexAck,
+					ServiceType: ServiceConfirmedReadProperty,
+					InvokeID:    req.ADPU.InvokeID,
+					Payload:     &DataPayload{Bytes: ack},
+				}}
+			default:
+				continue
+			}
+			b, _ := answer.MarshalBinary()
+			_ = device.Send(mac, b)
+		}
+	}()
+
+	devices, err := c.WhoIs(WhoIs{}, 200*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(len(devices), 1)
+	is.Equal(devices[0].Addr, bacnet.Address{Mac: []byte{0x00, 0x04, 0xd2}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, devices[0], testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+
+	_, err = c.ReadBDT(ctx, &net.UDPAddr{IP: net.IPv6loopback, Port: DefaultUDPPort})
+	is.True(err != nil) // BACnet/IP only
+}
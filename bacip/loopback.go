@@ -0,0 +1,137 @@
+package bacip
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// LoopbackNetwork is an in-memory local network, to run clients and
+// simulated devices in the same process without any socket. The zero
+// value is ready to use.
+type LoopbackNetwork struct {
+	// MaxAPDU is the maximum APDU length of the links, 1476 if zero
+	MaxAPDU uint
+
+	mutex sync.Mutex
+	links map[byte]*LoopbackLink
+	next  byte
+}
+
+// Link attaches a new link to the network. The links get the one byte
+// MAC addresses 1, 2, 3...
+func (n *LoopbackNetwork) Link() *LoopbackLink {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.links == nil {
+		n.links = map[byte]*LoopbackLink{}
+	}
+	n.next++
+	l := &LoopbackLink{
+		network:  n,
+		mac:      n.next,
+		incoming: make(chan received, 32),
+		closed:   make(chan struct{}),
+	}
+	n.links[l.mac] = l
+	return l
+}
+
+// LoopbackLink is a data link on a LoopbackNetwork
+type LoopbackLink struct {
+	network   *LoopbackNetwork
+	mac       byte
+	incoming  chan received
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// MAC returns the MAC address of the link
+func (l *LoopbackLink) MAC() []byte {
+	return []byte{l.mac}
+}
+
+// MaxAPDU returns the maximum APDU length of the network
+func (l *LoopbackLink) MaxAPDU() uint {
+	if l.network.MaxAPDU == 0 {
+		return 1476
+	}
+	return l.network.MaxAPDU
+}
+
+// Close detaches the link from the network
+func (l *LoopbackLink) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.mutex.Lock()
+		delete(l.network.links, l.mac)
+		l.network.mutex.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+// Send sends the npdu to the link with the MAC address mac. The npdus
+// sent to unknown addresses are lost.
+func (l *LoopbackLink) Send(mac []byte, npdu []byte) error {
+	if len(mac) != 1 {
+		return fmt.Errorf("invalid loopback MAC address %x", mac)
+	}
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	l.network.mutex.Lock()
+	dst := l.network.links[mac[0]]
+	l.network.mutex.Unlock()
+	if dst != nil {
+		dst.deliver(l.mac, npdu)
+	}
+	return nil
+}
+
+// Broadcast sends the npdu to all the other links of the network
+func (l *LoopbackLink) Broadcast(npdu []byte) error {
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	l.network.mutex.Lock()
+	var dsts []*LoopbackLink
+	for _, dst := range l.network.links {
+		if dst != l {
+			dsts = append(dsts, dst)
+		}
+	}
+	l.network.mutex.Unlock()
+	for _, dst := range dsts {
+		dst.deliver(l.mac, npdu)
+	}
+	return nil
+}
+
+// Receive returns the next npdu and the MAC address of its sender
+func (l *LoopbackLink) Receive() ([]byte, []byte, error) {
+	select {
+	case r := <-l.incoming:
+		return r.npdu, r.mac, nil
+	case <-l.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (l *LoopbackLink) checkOpen() error {
+	select {
+	case <-l.closed:
+		return net.ErrClosed
+	default:
+		return nil
+	}
+}
+
+// deliver queues the npdu, it is dropped when the queue is full as on
+// a congested network
+func (l *LoopbackLink) deliver(src byte, npdu []byte) {
+	select {
+	case l.incoming <- received{npdu: append([]byte{}, npdu...), mac: []byte{src}}:
+	case <-l.closed:
+	default:
+	}
+}
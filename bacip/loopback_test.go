@@ -0,0 +1,104 @@
+package bacip
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/matryer/is"
+)
+
+func TestLoopbackLink(t *testing.T) {
+	is := is.New(t)
+	n := &LoopbackNetwork{}
+	a, b, c := n.Link(), n.Link(), n.Link()
+	is.Equal(a.MAC(), []byte{1})
+	is.Equal(b.MAC(), []byte{2})
+	is.Equal(a.MaxAPDU(), uint(1476))
+
+	is.NoErr(a.Send(b.MAC(), []byte{1, 0, 0x10, 0x08}))
+	npdu, mac, err := b.Receive()
+	is.NoErr(err)
+	is.Equal(npdu, []byte{1, 0, 0x10, 0x08})
+	is.Equal(mac, a.MAC())
+
+	is.NoErr(a.Broadcast([]byte{1, 0x20}))
+	for _, l := range []*LoopbackLink{b, c} {
+		npdu, mac, err := l.Receive()
+		is.NoErr(err)
+		is.Equal(npdu, []byte{1, 0x20})
+		is.Equal(mac, a.MAC())
+	}
+
+	is.NoErr(a.Send([]byte{9}, []byte{1, 0}))          // lost
+	is.True(a.Send([]byte{1, 2}, []byte{1, 0}) != nil) // not a loopback MAC
+
+	is.NoErr(c.Close())
+	is.NoErr(a.Send(c.MAC(), []byte{1, 0})) // lost
+	_, _, err = c.Receive()
+	is.True(errors.Is(err, net.ErrClosed))
+	is.True(errors.Is(c.Broadcast([]byte{1, 0}), net.ErrClosed))
+}
+
+func TestLoopbackClient(t *testing.T) {
+	is := is.New(t)
+	n := &LoopbackNetwork{MaxAPDU: 480}
+	device := n.Link()
+	c := NewClientWithDataLink(n.Link(), NoOpLogger{})
+	t.Cleanup(func() { c.Close() })
+	ack, _ := hex.DecodeString(readPropertyAck)
+	maxAPDU := make(chan uint, 1)
+	go func() {
+		for {
+			data, mac, err := device.Receive()
+			if err != nil {
+				return
+			}
+			var req NPDU
+			if req.UnmarshallBinary(data) != nil {
+				continue
+			}
+			var answer NPDU
+			switch req.ADPU.ServiceType {
+			case ServiceUnconfirmedWhoIs:
+				answer = NPDU{Version: Version1, ADPU: &APDU{
+					DataType:    UnconfirmedServiceRequest,
+					ServiceType: ServiceUnconfirmedIAm,
+					Payload: &Iam{
+						ObjectID:      bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 1234},
+						MaxApduLength: 480,
+						VendorID:      260,
+					},
+				}}
+			case ServiceConfirmedReadProperty:
+				maxAPDU <- req.ADPU.MaxApdu
+				answer = NPDU{Version: Version1, ADPU: &APDU{
+					DataType:    ComplexAck,
+					ServiceType: ServiceConfirmedReadProperty,
+					InvokeID:    req.ADPU.InvokeID,
+					Payload:     &DataPayload{Bytes: ack},
+				}}
+			default:
+				continue
+			}
+			b, _ := answer.MarshalBinary()
+			_ = device.Send(mac, b)
+		}
+	}()
+
+	devices, err := c.WhoIs(WhoIs{}, 200*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(len(devices), 1)
+	is.Equal(devices[0].Addr, bacnet.Address{Mac: device.MAC()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, devices[0], testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+	is.Equal(<-maxAPDU, uint(480)) // limited by the link
+}
@@ -0,0 +1,375 @@
+package bacip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// NetworkMessageType is the type of a network layer message
+type NetworkMessageType byte
+
+const (
+	NetworkMessageWhoIsRouterToNetwork          NetworkMessageType = 0x00
+	NetworkMessageIAmRouterToNetwork            NetworkMessageType = 0x01
+	NetworkMessageICouldBeRouterToNetwork       NetworkMessageType = 0x02
+	NetworkMessageRejectMessageToNetwork        NetworkMessageType = 0x03
+	NetworkMessageRouterBusyToNetwork           NetworkMessageType = 0x04
+	NetworkMessageRouterAvailableToNetwork      NetworkMessageType = 0x05
+	NetworkMessageInitializeRoutingTable        NetworkMessageType = 0x06
+	NetworkMessageInitializeRoutingTableAck     NetworkMessageType = 0x07
+	NetworkMessageEstablishConnectionToNetwork  NetworkMessageType = 0x08
+	NetworkMessageDisconnectConnectionToNetwork NetworkMessageType = 0x09
+	NetworkMessageWhatIsNetworkNumber           NetworkMessageType = 0x12
+	NetworkMessageNetworkNumberIs               NetworkMessageType = 0x13
+	// Messages types from 0x80 are proprietary and followed by a
+	// vendor ID
+	NetworkMessageProprietary NetworkMessageType = 0x80
+)
+
+// newNetworkMessage returns the payload type used to decode the
+// network message
+func newNetworkMessage(t NetworkMessageType) Payload {
+	switch t {
+	case NetworkMessageWhoIsRouterToNetwork:
+		return &WhoIsRouterToNetwork{}
+	case NetworkMessageIAmRouterToNetwork:
+		return &IAmRouterToNetwork{}
+	case NetworkMessageICouldBeRouterToNetwork:
+		return &ICouldBeRouterToNetwork{}
+	case NetworkMessageRejectMessageToNetwork:
+		return &RejectMessageToNetwork{}
+	case NetworkMessageRouterBusyToNetwork:
+		return &RouterBusyToNetwork{}
+	case NetworkMessageRouterAvailableToNetwork:
+		return &RouterAvailableToNetwork{}
+	case NetworkMessageInitializeRoutingTable:
+		return &InitializeRoutingTable{}
+	case NetworkMessageInitializeRoutingTableAck:
+		return &InitializeRoutingTableAck{}
+	case NetworkMessageEstablishConnectionToNetwork:
+		return &EstablishConnectionToNetwork{}
+	case NetworkMessageDisconnectConnectionToNetwork:
+		return &DisconnectConnectionToNetwork{}
+	case NetworkMessageWhatIsNetworkNumber:
+		return &WhatIsNetworkNumber{}
+	case NetworkMessageNetworkNumberIs:
+		return &NetworkNumberIs{}
+	default:
+		return &DataPayload{}
+	}
+}
+
+// WhoIsRouterToNetwork asks for the routers to a given network, or to
+// all the networks if Network is nil
+type WhoIsRouterToNetwork struct {
+	Network *uint16
+}
+
+func (w WhoIsRouterToNetwork) MarshalBinary() ([]byte, error) {
+	if w.Network == nil {
+		return []byte{}, nil
+	}
+	return binary.BigEndian.AppendUint16(nil, *w.Network), nil
+}
+
+func (w *WhoIsRouterToNetwork) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		w.Network = nil
+		return nil
+	}
+	if len(data) != 2 {
+		return fmt.Errorf("invalid Who-Is-Router-To-Network length %d", len(data))
+	}
+	w.Network = new(uint16)
+	*w.Network = binary.BigEndian.Uint16(data)
+	return nil
+}
+
+// IAmRouterToNetwork lists the networks reachable through the router
+// sending it
+type IAmRouterToNetwork struct {
+	Networks []uint16
+}
+
+func (i IAmRouterToNetwork) MarshalBinary() ([]byte, error) {
+	return marshalNetworks(i.Networks), nil
+}
+
+func (i *IAmRouterToNetwork) UnmarshalBinary(data []byte) error {
+	var err error
+	i.Networks, err = unmarshalNetworks(data)
+	return err
+}
+
+// ICouldBeRouterToNetwork is sent by half routers able to establish a
+// connection to the network
+type ICouldBeRouterToNetwork struct {
+	Network          uint16
+	PerformanceIndex byte
+}
+
+func (i ICouldBeRouterToNetwork) MarshalBinary() ([]byte, error) {
+	return append(binary.BigEndian.AppendUint16(nil, i.Network), i.PerformanceIndex), nil
+}
+
+func (i *ICouldBeRouterToNetwork) UnmarshalBinary(data []byte) error {
+	if len(data) != 3 {
+		return fmt.Errorf("invalid I-Could-Be-Router-To-Network length %d", len(data))
+	}
+	i.Network = binary.BigEndian.Uint16(data)
+	i.PerformanceIndex = data[2]
+	return nil
+}
+
+// RejectMessageReason tells why a router rejected a message
+type RejectMessageReason byte
+
+const (
+	RejectMessageOther              RejectMessageReason = 0
+	RejectMessageUnknownNetwork     RejectMessageReason = 1
+	RejectMessageRouterBusy         RejectMessageReason = 2
+	RejectMessageUnknownMessageType RejectMessageReason = 3
+	RejectMessageTooLong            RejectMessageReason = 4
+	RejectMessageSecurityError      RejectMessageReason = 5
+	RejectMessageAddressingError    RejectMessageReason = 6
+)
+
+// RejectMessageToNetwork is sent by a router unable to forward a
+// message to the network
+type RejectMessageToNetwork struct {
+	Reason  RejectMessageReason
+	Network uint16
+}
+
+func (r RejectMessageToNetwork) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint16([]byte{byte(r.Reason)}, r.Network), nil
+}
+
+func (r *RejectMessageToNetwork) UnmarshalBinary(data []byte) error {
+	if len(data) != 3 {
+		return fmt.Errorf("invalid Reject-Message-To-Network length %d", len(data))
+	}
+	r.Reason = RejectMessageReason(data[0])
+	r.Network = binary.BigEndian.Uint16(data[1:])
+	return nil
+}
+
+// RouterBusyToNetwork is sent by a router that temporarily stops
+// forwarding messages to the networks. An empty list means all the
+// networks served by the router
+type RouterBusyToNetwork struct {
+	Networks []uint16
+}
+
+func (r RouterBusyToNetwork) MarshalBinary() ([]byte, error) {
+	return marshalNetworks(r.Networks), nil
+}
+
+func (r *RouterBusyToNetwork) UnmarshalBinary(data []byte) error {
+	var err error
+	r.Networks, err = unmarshalNetworks(data)
+	return err
+}
+
+// RouterAvailableToNetwork is sent by a router that forwards again
+// messages to the networks. An empty list means all the networks
+// served by the router
+type RouterAvailableToNetwork struct {
+	Networks []uint16
+}
+
+func (r RouterAvailableToNetwork) MarshalBinary() ([]byte, error) {
+	return marshalNetworks(r.Networks), nil
+}
+
+func (r *RouterAvailableToNetwork) UnmarshalBinary(data []byte) error {
+	var err error
+	r.Networks, err = unmarshalNetworks(data)
+	return err
+}
+
+// RoutingTablePort is an entry of a router routing table
+type RoutingTablePort struct {
+	Network uint16
+	PortID  byte
+	// PortInfo is used by PTP ports, it is usually empty
+	PortInfo []byte
+}
+
+// InitializeRoutingTable updates the routing table of a router, or
+// queries it when it has no entries
+type InitializeRoutingTable struct {
+	Ports []RoutingTablePort
+}
+
+func (i InitializeRoutingTable) MarshalBinary() ([]byte, error) {
+	return marshalRoutingTable(i.Ports)
+}
+
+func (i *InitializeRoutingTable) UnmarshalBinary(data []byte) error {
+	var err error
+	i.Ports, err = unmarshalRoutingTable(data)
+	return err
+}
+
+// InitializeRoutingTableAck is the answer to InitializeRoutingTable.
+// It contains the routing table if it was queried
+type InitializeRoutingTableAck struct {
+	Ports []RoutingTablePort
+}
+
+func (i InitializeRoutingTableAck) MarshalBinary() ([]byte, error) {
+	return marshalRoutingTable(i.Ports)
+}
+
+func (i *InitializeRoutingTableAck) UnmarshalBinary(data []byte) error {
+	var err error
+	i.Ports, err = unmarshalRoutingTable(data)
+	return err
+}
+
+// EstablishConnectionToNetwork asks a half router to connect to the
+// network. TerminationTime is in minutes, 0 for a permanent
+// connection
+type EstablishConnectionToNetwork struct {
+	Network         uint16
+	TerminationTime byte
+}
+
+func (e EstablishConnectionToNetwork) MarshalBinary() ([]byte, error) {
+	return append(binary.BigEndian.AppendUint16(nil, e.Network), e.TerminationTime), nil
+}
+
+func (e *EstablishConnectionToNetwork) UnmarshalBinary(data []byte) error {
+	if len(data) != 3 {
+		return fmt.Errorf("invalid Establish-Connection-To-Network length %d", len(data))
+	}
+	e.Network = binary.BigEndian.Uint16(data)
+	e.TerminationTime = data[2]
+	return nil
+}
+
+// DisconnectConnectionToNetwork asks a half router to close its
+// connection to the network
+type DisconnectConnectionToNetwork struct {
+	Network uint16
+}
+
+func (d DisconnectConnectionToNetwork) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint16(nil, d.Network), nil
+}
+
+func (d *DisconnectConnectionToNetwork) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("invalid Disconnect-Connection-To-Network length %d", len(data))
+	}
+	d.Network = binary.BigEndian.Uint16(data)
+	return nil
+}
+
+// WhatIsNetworkNumber asks the number of the local network
+type WhatIsNetworkNumber struct{}
+
+func (WhatIsNetworkNumber) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (*WhatIsNetworkNumber) UnmarshalBinary(data []byte) error {
+	if len(data) != 0 {
+		return fmt.Errorf("invalid What-Is-Network-Number length %d", len(data))
+	}
+	return nil
+}
+
+// NetworkNumberIs gives the number of the local network. Configured
+// is false if the number was learned from another device
+type NetworkNumberIs struct {
+	Network    uint16
+	Configured bool
+}
+
+func (n NetworkNumberIs) MarshalBinary() ([]byte, error) {
+	var configured byte
+	if n.Configured {
+		configured = 1
+	}
+	return append(binary.BigEndian.AppendUint16(nil, n.Network), configured), nil
+}
+
+func (n *NetworkNumberIs) UnmarshalBinary(data []byte) error {
+	if len(data) != 3 {
+		return fmt.Errorf("invalid Network-Number-Is length %d", len(data))
+	}
+	n.Network = binary.BigEndian.Uint16(data)
+	n.Configured = data[2] == 1
+	return nil
+}
+
+func marshalNetworks(networks []uint16) []byte {
+	b := make([]byte, 0, 2*len(networks))
+	for _, n := range networks {
+		b = binary.BigEndian.AppendUint16(b, n)
+	}
+	return b
+}
+
+func unmarshalNetworks(data []byte) ([]uint16, error) {
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("invalid network list length %d", len(data))
+	}
+	networks := make([]uint16, len(data)/2)
+	for i := range networks {
+		networks[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return networks, nil
+}
+
+func marshalRoutingTable(ports []RoutingTablePort) ([]byte, error) {
+	if len(ports) > 0xFF {
+		return nil, fmt.Errorf("too many ports in routing table: %d", len(ports))
+	}
+	b := &bytes.Buffer{}
+	b.WriteByte(byte(len(ports)))
+	for _, p := range ports {
+		if len(p.PortInfo) > 0xFF {
+			return nil, fmt.Errorf("port info of network %d too long", p.Network)
+		}
+		_ = binary.Write(b, binary.BigEndian, p.Network)
+		b.WriteByte(p.PortID)
+		b.WriteByte(byte(len(p.PortInfo)))
+		b.Write(p.PortInfo)
+	}
+	return b.Bytes(), nil
+}
+
+func unmarshalRoutingTable(data []byte) ([]RoutingTablePort, error) {
+	buf := bytes.NewBuffer(data)
+	count, err := buf.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read routing table port count: %w", err)
+	}
+	ports := make([]RoutingTablePort, 0, count)
+	for x := 0; x < int(count); x++ {
+		var p RoutingTablePort
+		err := binary.Read(buf, binary.BigEndian, &p.Network)
+		if err != nil {
+			return nil, fmt.Errorf("read routing table network: %w", err)
+		}
+		p.PortID, err = buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read routing table port ID: %w", err)
+		}
+		length, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read routing table port info length: %w", err)
+		}
+		p.PortInfo = make([]byte, length)
+		n, _ := buf.Read(p.PortInfo)
+		if n != int(length) {
+			return nil, fmt.Errorf("read routing table port info: short read %d instead of %d", n, length)
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
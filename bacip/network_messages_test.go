@@ -0,0 +1,104 @@
+package bacip
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestNetworkMessagesCoherency(t *testing.T) {
+	network := uint16(5)
+	ttc := []struct {
+		name    string
+		npdu    NPDU
+		encoded string //hex string
+	}{
+		{
+			name:    "WhoIsRouterToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageWhoIsRouterToNetwork, NetworkMessage: &WhoIsRouterToNetwork{}},
+			encoded: "018000",
+		},
+		{
+			name:    "WhoIsRouterToNetworkWithNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageWhoIsRouterToNetwork, NetworkMessage: &WhoIsRouterToNetwork{Network: &network}},
+			encoded: "0180000005",
+		},
+		{
+			name:    "IAmRouterToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageIAmRouterToNetwork, NetworkMessage: &IAmRouterToNetwork{Networks: []uint16{5, 0x1234}}},
+			encoded: "01800100051234",
+		},
+		{
+			name:    "ICouldBeRouterToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageICouldBeRouterToNetwork, NetworkMessage: &ICouldBeRouterToNetwork{Network: 5, PerformanceIndex: 10}},
+			encoded: "01800200050a",
+		},
+		{
+			name:    "RejectMessageToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageRejectMessageToNetwork, NetworkMessage: &RejectMessageToNetwork{Reason: RejectMessageUnknownNetwork, Network: 5}},
+			encoded: "018003010005",
+		},
+		{
+			name:    "RouterBusyToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageRouterBusyToNetwork, NetworkMessage: &RouterBusyToNetwork{Networks: []uint16{}}},
+			encoded: "018004",
+		},
+		{
+			name:    "RouterAvailableToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageRouterAvailableToNetwork, NetworkMessage: &RouterAvailableToNetwork{Networks: []uint16{5}}},
+			encoded: "0180050005",
+		},
+		{
+			name: "InitializeRoutingTable",
+			npdu: NPDU{NetworkMessageType: NetworkMessageInitializeRoutingTable, NetworkMessage: &InitializeRoutingTable{Ports: []RoutingTablePort{
+				{Network: 5, PortID: 1, PortInfo: []byte{}},
+				{Network: 6, PortID: 2, PortInfo: []byte{0xaa}},
+			}}},
+			encoded: "018006020005010000060201aa",
+		},
+		{
+			name:    "InitializeRoutingTableAck",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageInitializeRoutingTableAck, NetworkMessage: &InitializeRoutingTableAck{Ports: []RoutingTablePort{}}},
+			encoded: "01800700",
+		},
+		{
+			name:    "EstablishConnectionToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageEstablishConnectionToNetwork, NetworkMessage: &EstablishConnectionToNetwork{Network: 5, TerminationTime: 30}},
+			encoded: "01800800051e",
+		},
+		{
+			name:    "DisconnectConnectionToNetwork",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageDisconnectConnectionToNetwork, NetworkMessage: &DisconnectConnectionToNetwork{Network: 5}},
+			encoded: "0180090005",
+		},
+		{
+			name:    "WhatIsNetworkNumber",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageWhatIsNetworkNumber, NetworkMessage: &WhatIsNetworkNumber{}},
+			encoded: "018012",
+		},
+		{
+			name:    "NetworkNumberIs",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageNetworkNumberIs, NetworkMessage: &NetworkNumberIs{Network: 5, Configured: true}},
+			encoded: "018013000501",
+		},
+		{
+			name:    "Proprietary",
+			npdu:    NPDU{NetworkMessageType: NetworkMessageProprietary, VendorID: 260, NetworkMessage: &DataPayload{Bytes: []byte{1, 2}}},
+			encoded: "01808001040102",
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			tc.npdu.Version = Version1
+			tc.npdu.IsNetworkLayerMessage = true
+			result, err := tc.npdu.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(tc.encoded, hex.EncodeToString(result))
+			npdu := NPDU{}
+			is.NoErr(npdu.UnmarshallBinary(result))
+			is.Equal(npdu, tc.npdu)
+		})
+	}
+}
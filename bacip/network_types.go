@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 
 	"github.com/REQUEA/bacnet"
 )
@@ -33,9 +34,11 @@ type NPDU struct {
 	Destination *bacnet.Address
 	Source      *bacnet.Address
 	HopCount    byte
-	//The two are only significant if IsNetworkLayerMessage is true
-	NetworkMessageType byte
-	VendorID           uint16
+	//The three are only significant if IsNetworkLayerMessage is true
+	NetworkMessageType NetworkMessageType
+	//Only significant for proprietary network messages
+	VendorID       uint16
+	NetworkMessage Payload
 
 	ADPU *APDU
 }
@@ -79,10 +82,17 @@ func (npdu NPDU) MarshalBinary() ([]byte, error) {
 		b.WriteByte(npdu.HopCount)
 	}
 	if isNetworkMessage {
-		b.WriteByte(npdu.NetworkMessageType)
-		if npdu.NetworkMessageType >= 0x80 {
+		b.WriteByte(byte(npdu.NetworkMessageType))
+		if npdu.NetworkMessageType >= NetworkMessageProprietary {
 			_ = binary.Write(b, binary.BigEndian, npdu.VendorID)
 		}
+		if npdu.NetworkMessage != nil {
+			data, err := npdu.NetworkMessage.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			b.Write(data)
+		}
 	}
 	bytes := b.Bytes()
 	if npdu.ADPU != nil {
@@ -96,17 +106,32 @@ func (npdu NPDU) MarshalBinary() ([]byte, error) {
 }
 
 func (npdu *NPDU) UnmarshallBinary(data []byte) error {
+	apdu, err := npdu.UnmarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if !npdu.IsNetworkLayerMessage {
+		npdu.ADPU = &APDU{}
+		return npdu.ADPU.UnmarshalBinary(apdu)
+	}
+	return nil
+}
+
+// UnmarshalHeader decodes the NPDU, including the network layer
+// message, but not the APDU. It returns the undecoded APDU, so it can
+// be forwarded unchanged by a router.
+func (npdu *NPDU) UnmarshalHeader(data []byte) ([]byte, error) {
 	buf := bytes.NewBuffer(data)
 	err := binary.Read(buf, binary.BigEndian, &npdu.Version)
 	if err != nil {
-		return fmt.Errorf("read NPDU version: %w", err)
+		return nil, fmt.Errorf("read NPDU version: %w", err)
 	}
 	if npdu.Version != Version1 {
-		return fmt.Errorf("invalid NPDU version %d", npdu.Version)
+		return nil, fmt.Errorf("invalid NPDU version %d", npdu.Version)
 	}
 	control, err := buf.ReadByte()
 	if err != nil {
-		return fmt.Errorf("read NPDU control byte:  %w", err)
+		return nil, fmt.Errorf("read NPDU control byte:  %w", err)
 	}
 	if control&(1<<7) > 0 {
 		npdu.IsNetworkLayerMessage = true
@@ -120,17 +145,17 @@ func (npdu *NPDU) UnmarshallBinary(data []byte) error {
 		npdu.Destination = &bacnet.Address{}
 		err := binary.Read(buf, binary.BigEndian, &npdu.Destination.Net)
 		if err != nil {
-			return fmt.Errorf("read NPDU dest Address.Net: %w", err)
+			return nil, fmt.Errorf("read NPDU dest Address.Net: %w", err)
 		}
 		var length byte
 		err = binary.Read(buf, binary.BigEndian, &length)
 		if err != nil {
-			return fmt.Errorf("read NPDU dest Address.Len: %w", err)
+			return nil, fmt.Errorf("read NPDU dest Address.Len: %w", err)
 		}
 		npdu.Destination.Adr = make([]byte, int(length))
 		err = binary.Read(buf, binary.BigEndian, &npdu.Destination.Adr)
 		if err != nil {
-			return fmt.Errorf("read NPDU dest Address.Net: %w", err)
+			return nil, fmt.Errorf("read NPDU dest Address.Net: %w", err)
 		}
 	}
 
@@ -138,44 +163,46 @@ func (npdu *NPDU) UnmarshallBinary(data []byte) error {
 		npdu.Source = &bacnet.Address{}
 		err := binary.Read(buf, binary.BigEndian, &npdu.Source.Net)
 		if err != nil {
-			return fmt.Errorf("read NPDU src Address.Net: %w", err)
+			return nil, fmt.Errorf("read NPDU src Address.Net: %w", err)
 		}
 		var length byte
 		err = binary.Read(buf, binary.BigEndian, &length)
 		if err != nil {
-			return fmt.Errorf("read NPDU src Address.Len: %w", err)
+			return nil, fmt.Errorf("read NPDU src Address.Len: %w", err)
 		}
 		npdu.Source.Adr = make([]byte, int(length))
 		err = binary.Read(buf, binary.BigEndian, &npdu.Source.Adr)
 		if err != nil {
-			return fmt.Errorf("read NPDU src Address.Net: %w", err)
+			return nil, fmt.Errorf("read NPDU src Address.Net: %w", err)
 		}
 	}
 
 	if npdu.Destination != nil {
 		err := binary.Read(buf, binary.BigEndian, &npdu.HopCount)
 		if err != nil {
-			return fmt.Errorf("read NPDU HopCount: %w", err)
+			return nil, fmt.Errorf("read NPDU HopCount: %w", err)
 		}
 	}
 
 	if npdu.IsNetworkLayerMessage {
 		err := binary.Read(buf, binary.BigEndian, &npdu.NetworkMessageType)
 		if err != nil {
-			return fmt.Errorf("read NPDU NetworkMessageType: %w", err)
+			return nil, fmt.Errorf("read NPDU NetworkMessageType: %w", err)
 		}
-		if npdu.NetworkMessageType > 0x80 {
+		if npdu.NetworkMessageType >= NetworkMessageProprietary {
 			err := binary.Read(buf, binary.BigEndian, &npdu.VendorID)
 			if err != nil {
-				return fmt.Errorf("read NPDU VendorId: %w", err)
+				return nil, fmt.Errorf("read NPDU VendorId: %w", err)
 			}
 		}
-	} else {
-		npdu.ADPU = &APDU{}
-		return npdu.ADPU.UnmarshalBinary(buf.Bytes())
-
+		npdu.NetworkMessage = newNetworkMessage(npdu.NetworkMessageType)
+		err = npdu.NetworkMessage.UnmarshalBinary(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("read NPDU network message: %w", err)
+		}
+		return nil, nil
 	}
-	return nil
+	return buf.Bytes(), nil
 }
 
 // //go:generate stringer -type=PDUType
@@ -267,64 +294,217 @@ type APDU struct {
 	Payload     Payload
 	//Only meaningfully for confirmed and ack
 	InvokeID byte
-	// MaxSegs
-	// Segmented message
-	// MoreFollow
-	// SegmentedResponseAccepted
-	// MaxApdu int
-	// Sequence                  uint8
-	// WindowNumber              uint8
+	//Only meaningfully for confirmed request. MaxSegs is the
+	//maximum number of segments accepted in the answer, 0 if
+	//unspecified. MaxApdu is the maximum APDU length accepted in
+	//bytes
+	MaxSegs                   uint
+	MaxApdu                   uint
+	SegmentedResponseAccepted bool
+
+	//Only meaningfully for confirmed request and complex ack
+	Segmented   bool
+	MoreFollows bool
+	//Only meaningfully for segmented messages and segment ack
+	SequenceNumber byte
+	WindowSize     byte
+	//Only meaningfully for segment ack
+	NegativeAck bool
+	//Only meaningfully for segment ack and abort, true if the
+	//message is sent by the server
+	Server bool
+}
+
+// hasServiceChoice returns true if the APDU type carries a service
+// choice byte before its payload
+func (apdu APDU) hasServiceChoice() bool {
+	return apdu.DataType != SegmentAck && apdu.DataType != Reject && apdu.DataType != Abort
 }
 
 func (apdu APDU) MarshalBinary() ([]byte, error) {
 	b := &bytes.Buffer{}
-	b.WriteByte(byte(apdu.DataType))
-	if apdu.DataType == ConfirmedServiceRequest {
-		b.WriteByte(5) //Todo: Write other  control flag here
+	control := byte(apdu.DataType)
+	if apdu.Segmented {
+		control |= 1 << 3
+	}
+	if apdu.MoreFollows {
+		control |= 1 << 2
+	}
+	switch apdu.DataType {
+	case ConfirmedServiceRequest:
+		if apdu.SegmentedResponseAccepted {
+			control |= 1 << 1
+		}
+		maxApdu, err := encodeMaxApdu(apdu.MaxApdu)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteByte(control)
+		b.WriteByte(encodeMaxSegs(apdu.MaxSegs)<<4 | maxApdu)
+		b.WriteByte(apdu.InvokeID)
+	case ComplexAck:
+		b.WriteByte(control)
+		b.WriteByte(apdu.InvokeID)
+	case SimpleAck, Error, Reject:
+		b.WriteByte(byte(apdu.DataType))
+		b.WriteByte(apdu.InvokeID)
+	case SegmentAck:
+		control = byte(apdu.DataType)
+		if apdu.NegativeAck {
+			control |= 1 << 1
+		}
+		if apdu.Server {
+			control |= 1
+		}
+		b.WriteByte(control)
 		b.WriteByte(apdu.InvokeID)
+		b.WriteByte(apdu.SequenceNumber)
+		b.WriteByte(apdu.WindowSize)
+		return b.Bytes(), nil
+	case Abort:
+		control = byte(apdu.DataType)
+		if apdu.Server {
+			control |= 1
+		}
+		b.WriteByte(control)
+		b.WriteByte(apdu.InvokeID)
+	default:
+		b.WriteByte(byte(apdu.DataType))
 	}
-	b.WriteByte(byte(apdu.ServiceType))
-	bytes, err := apdu.Payload.MarshalBinary()
-	if err != nil {
-		return nil, err
+	if apdu.Segmented {
+		b.WriteByte(apdu.SequenceNumber)
+		b.WriteByte(apdu.WindowSize)
+	}
+	if apdu.hasServiceChoice() {
+		b.WriteByte(byte(apdu.ServiceType))
+	}
+	if apdu.Payload != nil {
+		bytes, err := apdu.Payload.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b.Write(bytes)
 	}
-	b.Write(bytes)
 	return b.Bytes(), nil
 }
+
 func (apdu *APDU) UnmarshalBinary(data []byte) error {
 	buf := bytes.NewBuffer(data)
-	err := binary.Read(buf, binary.BigEndian, &apdu.DataType)
+	control, err := buf.ReadByte()
 	if err != nil {
 		return fmt.Errorf("read APDU DataType: %w", err)
 	}
-	if apdu.DataType == ComplexAck || apdu.DataType == Error {
+	apdu.DataType = PDUType(control & 0xF0)
+	switch apdu.DataType {
+	case ConfirmedServiceRequest, ComplexAck:
+		apdu.Segmented = control&(1<<3) > 0
+		apdu.MoreFollows = control&(1<<2) > 0
+		if apdu.DataType == ConfirmedServiceRequest {
+			apdu.SegmentedResponseAccepted = control&(1<<1) > 0
+			maxSegsApdu, err := buf.ReadByte()
+			if err != nil {
+				return fmt.Errorf("read APDU max segments/max apdu: %w", err)
+			}
+			apdu.MaxSegs = decodeMaxSegs(maxSegsApdu >> 4 & 0x7)
+			apdu.MaxApdu, err = decodeMaxApdu(maxSegsApdu & 0xF)
+			if err != nil {
+				return err
+			}
+		}
+	case SegmentAck:
+		apdu.NegativeAck = control&(1<<1) > 0
+		apdu.Server = control&1 > 0
+	case Abort:
+		apdu.Server = control&1 > 0
+	}
+	if apdu.DataType != UnconfirmedServiceRequest {
 		apdu.InvokeID, err = buf.ReadByte()
 		if err != nil {
-			return err
+			return fmt.Errorf("read APDU InvokeID: %w", err)
 		}
 	}
-	//Todo refactor
-	err = binary.Read(buf, binary.BigEndian, &apdu.ServiceType)
-	if err != nil {
-		return fmt.Errorf("read APDU ServiceType: %w", err)
+	if apdu.Segmented || apdu.DataType == SegmentAck {
+		apdu.SequenceNumber, err = buf.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read APDU SequenceNumber: %w", err)
+		}
+		apdu.WindowSize, err = buf.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read APDU WindowSize: %w", err)
+		}
 	}
-	if apdu.DataType == UnconfirmedServiceRequest && apdu.ServiceType == ServiceUnconfirmedWhoIs {
-		apdu.Payload = &WhoIs{}
+	if apdu.DataType == SegmentAck {
+		return nil
+	}
+	if apdu.hasServiceChoice() {
+		err = binary.Read(buf, binary.BigEndian, &apdu.ServiceType)
+		if err != nil {
+			return fmt.Errorf("read APDU ServiceType: %w", err)
+		}
+	}
+	if apdu.Segmented {
+		// A segment can't be decoded on its own, the payload is
+		// decoded once all the segments are received
+		apdu.Payload = &DataPayload{}
+	} else {
+		apdu.Payload = newPayload(apdu.DataType, apdu.ServiceType)
+	}
+	return apdu.Payload.UnmarshalBinary(buf.Bytes())
+}
 
-	} else if apdu.DataType == UnconfirmedServiceRequest && apdu.ServiceType == ServiceUnconfirmedIAm {
-		apdu.Payload = &Iam{}
+// MoreThan64Segments is the MaxSegs value used when a device accepts
+// more than 64 segments
+const MoreThan64Segments = 65
 
-	} else if apdu.DataType == ComplexAck && apdu.ServiceType == ServiceConfirmedReadProperty {
-		apdu.Payload = &ReadProperty{}
+// maxApduLengths are the possible values of the max APDU length
+// accepted, indexed by their encoding
+var maxApduLengths = []uint{50, 128, 206, 480, 1024, 1476}
 
-	} else if apdu.DataType == Error {
-		apdu.Payload = &ApduError{}
-	} else {
-		// Just pass raw data, decoding is not yet ready
-		apdu.Payload = &DataPayload{}
+// encodeMaxSegs returns the encoding of the greatest number of
+// segments not above n
+func encodeMaxSegs(n uint) byte {
+	if n == 0 {
+		return 0
 	}
-	return apdu.Payload.UnmarshalBinary(buf.Bytes())
+	if n > 64 {
+		return 7
+	}
+	var code byte
+	for segs := uint(2); segs <= n; segs *= 2 {
+		code++
+	}
+	return code
+}
 
+func decodeMaxSegs(code byte) uint {
+	switch code {
+	case 0:
+		return 0
+	case 7:
+		return MoreThan64Segments
+	default:
+		return 1 << code
+	}
+}
+
+// encodeMaxApdu returns the encoding of the greatest APDU length not
+// above n
+func encodeMaxApdu(n uint) (byte, error) {
+	if n < maxApduLengths[0] {
+		return 0, fmt.Errorf("invalid max APDU length %d, minimum is %d", n, maxApduLengths[0])
+	}
+	var code byte
+	for int(code)+1 < len(maxApduLengths) && maxApduLengths[code+1] <= n {
+		code++
+	}
+	return code, nil
+}
+
+func decodeMaxApdu(code byte) (uint, error) {
+	if int(code) >= len(maxApduLengths) {
+		return 0, fmt.Errorf("invalid max APDU length encoding %d", code)
+	}
+	return maxApduLengths[code], nil
 }
 
 type Payload interface {
@@ -359,6 +539,11 @@ const (
 	BacFuncBroadcastDistributionTable      Function = 2
 	BacFuncBroadcastDistributionTableAck   Function = 3
 	BacFuncForwardedNPDU                   Function = 4
+	BacFuncRegisterForeignDevice           Function = 5
+	BacFuncReadForeignDeviceTable          Function = 6
+	BacFuncReadForeignDeviceTableAck       Function = 7
+	BacFuncDeleteForeignDeviceTableEntry   Function = 8
+	BacFuncDistributeBroadcastToNetwork    Function = 9
 	BacFuncUnicast                         Function = 10
 	BacFuncBroadcast                       Function = 11
 )
@@ -367,13 +552,51 @@ type BVLC struct {
 	Type     BVLCType
 	Function Function
 	NPDU     NPDU
+	// Payload is the content of the functions not carrying a NPDU,
+	// such as BVLC-Result or Register-Foreign-Device
+	Payload Payload
+	// Origin is the address of the device which sent the NPDU of a
+	// Forwarded-NPDU. The UDP source of the message is the one of the
+	// BBMD which forwarded it
+	Origin *net.UDPAddr
+}
+
+// hasNPDU is true for the functions carrying a NPDU
+func (f Function) hasNPDU() bool {
+	return f == BacFuncUnicast || f == BacFuncBroadcast ||
+		f == BacFuncForwardedNPDU || f == BacFuncDistributeBroadcastToNetwork
 }
 
 func (bvlc BVLC) MarshalBinary() ([]byte, error) {
+	var npdu []byte
+	if bvlc.Function.hasNPDU() {
+		var err error
+		npdu, err = bvlc.NPDU.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bvlc.marshalFrame(npdu)
+}
+
+// marshalFrame encodes the BVLC with the raw npdu of the functions
+// carrying one
+func (bvlc BVLC) marshalFrame(npdu []byte) ([]byte, error) {
 	b := &bytes.Buffer{}
 	b.WriteByte(byte(bvlc.Type))
 	b.WriteByte(byte(bvlc.Function))
-	data, err := bvlc.NPDU.MarshalBinary()
+	var data []byte
+	var err error
+	if bvlc.Function == BacFuncForwardedNPDU {
+		if bvlc.Origin == nil {
+			return nil, errors.New("forwarded npdu without origin address")
+		}
+		data = append(appendBIPAddress(nil, *bvlc.Origin), npdu...)
+	} else if bvlc.Function.hasNPDU() {
+		data = npdu
+	} else if bvlc.Payload != nil {
+		data, err = bvlc.Payload.MarshalBinary()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -386,29 +609,53 @@ func (bvlc BVLC) MarshalBinary() ([]byte, error) {
 var ErrNotBAcnetIP = errors.New("packet isn't a bacnet/IP payload ")
 
 func (bvlc *BVLC) UnmarshalBinary(data []byte) error {
+	npdu, err := bvlc.unmarshalFrame(data)
+	if err != nil || !bvlc.Function.hasNPDU() {
+		return err
+	}
+	return bvlc.NPDU.UnmarshallBinary(npdu)
+}
+
+// unmarshalFrame decodes the BVLC except the npdu of the functions
+// carrying one, which is returned raw
+func (bvlc *BVLC) unmarshalFrame(data []byte) ([]byte, error) {
 	buf := bytes.NewBuffer(data)
 	bvlcType, err := buf.ReadByte()
 	if err != nil {
-		return fmt.Errorf("read bvlc type: %w", err)
+		return nil, fmt.Errorf("read bvlc type: %w", err)
 	}
 	bvlc.Type = BVLCType(bvlcType)
 	if bvlc.Type != TypeBacnetIP {
-		return ErrNotBAcnetIP
+		return nil, ErrNotBAcnetIP
 	}
 	bvlcFunc, err := buf.ReadByte()
 	if err != nil {
-		return fmt.Errorf("read bvlc func: %w", err)
+		return nil, fmt.Errorf("read bvlc func: %w", err)
 	}
 	var length uint16
 	err = binary.Read(buf, binary.BigEndian, &length)
 	if err != nil {
-		return fmt.Errorf("read bvlc length: %w", err)
+		return nil, fmt.Errorf("read bvlc length: %w", err)
 	}
 	remaining := buf.Bytes()
 
 	bvlc.Function = Function(bvlcFunc)
 	if len(remaining) != int(length)-4 {
-		return fmt.Errorf("incoherent Length field in BVCL. Advertized payload size is %d, real size  %d", length-4, len(remaining))
+		return nil, fmt.Errorf("incoherent Length field in BVCL. Advertized payload size is %d, real size  %d", length-4, len(remaining))
+	}
+	if !bvlc.Function.hasNPDU() {
+		bvlc.Payload = newBVLCPayload(bvlc.Function)
+		return nil, bvlc.Payload.UnmarshalBinary(remaining)
+	}
+	if bvlc.Function == BacFuncForwardedNPDU {
+		// The NPDU is preceded by the address of the originating
+		// device
+		if len(remaining) < bipAddressLength {
+			return nil, fmt.Errorf("read bvlc forwarded npdu: short payload of %d bytes", len(remaining))
+		}
+		origin := decodeBIPAddress(remaining)
+		bvlc.Origin = &origin
+		remaining = remaining[bipAddressLength:]
 	}
-	return bvlc.NPDU.UnmarshallBinary(remaining)
+	return remaining, nil
 }
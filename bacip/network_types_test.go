@@ -80,3 +80,113 @@ func TestFullEncodingAndCoherency(t *testing.T) {
 		})
 	}
 }
+
+func TestAPDUHeaderCoherency(t *testing.T) {
+	ttc := []struct {
+		name    string
+		apdu    APDU
+		encoded string //hex string
+	}{
+		{
+			name: "SimpleAck",
+			apdu: APDU{
+				DataType:    SimpleAck,
+				InvokeID:    12,
+				ServiceType: ServiceConfirmedWriteProperty,
+				Payload:     &DataPayload{Bytes: []byte{}},
+			},
+			encoded: "200c0f",
+		},
+		{
+			name: "ConfirmedRequest",
+			apdu: APDU{
+				DataType:                  ConfirmedServiceRequest,
+				InvokeID:                  7,
+				MaxSegs:                   64,
+				MaxApdu:                   1476,
+				SegmentedResponseAccepted: true,
+				ServiceType:               ServiceConfirmedReadProperty,
+				Payload:                   &DataPayload{Bytes: []byte{0x0c, 0x00}},
+			},
+			encoded: "0265070c0c00",
+		},
+		{
+			name: "ConfirmedRequestSmallDevice",
+			apdu: APDU{
+				DataType:    ConfirmedServiceRequest,
+				InvokeID:    1,
+				MaxSegs:     0,
+				MaxApdu:     480,
+				ServiceType: ServiceConfirmedReadProperty,
+				Payload:     &DataPayload{Bytes: []byte{}},
+			},
+			encoded: "0003010c",
+		},
+		{
+			name: "SegmentedComplexAck",
+			apdu: APDU{
+				DataType:       ComplexAck,
+				InvokeID:       1,
+				Segmented:      true,
+				MoreFollows:    true,
+				SequenceNumber: 2,
+				WindowSize:     4,
+				ServiceType:    ServiceConfirmedReadProperty,
+				Payload:        &DataPayload{Bytes: []byte{0x0c, 0x00}},
+			},
+			encoded: "3c0102040c0c00",
+		},
+		{
+			name: "SegmentAck",
+			apdu: APDU{
+				DataType:       SegmentAck,
+				InvokeID:       1,
+				NegativeAck:    true,
+				SequenceNumber: 2,
+				WindowSize:     1,
+			},
+			encoded: "42010201",
+		},
+		{
+			name: "Abort",
+			apdu: APDU{
+				DataType: Abort,
+				InvokeID: 3,
+				Server:   true,
+				Payload:  &ApduAbort{Reason: AbortReasonSegmentationNotSupported},
+			},
+			encoded: "710304",
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			result, err := tc.apdu.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(tc.encoded, hex.EncodeToString(result))
+			apdu := APDU{}
+			is.NoErr(apdu.UnmarshalBinary(result))
+			is.Equal(apdu, tc.apdu)
+		})
+	}
+}
+
+func TestMaxSegsAndApduEncoding(t *testing.T) {
+	is := is.New(t)
+	is.Equal(encodeMaxSegs(0), byte(0))
+	is.Equal(encodeMaxSegs(2), byte(1))
+	is.Equal(encodeMaxSegs(5), byte(2)) // Rounded down to 4 segments
+	is.Equal(encodeMaxSegs(64), byte(6))
+	is.Equal(encodeMaxSegs(200), byte(7))
+	is.Equal(decodeMaxSegs(7), uint(MoreThan64Segments))
+	code, err := encodeMaxApdu(1500)
+	is.NoErr(err)
+	is.Equal(code, byte(5))
+	code, err = encodeMaxApdu(500)
+	is.NoErr(err)
+	is.Equal(code, byte(3))
+	_, err = encodeMaxApdu(49)
+	is.True(err != nil)
+	_, err = decodeMaxApdu(6)
+	is.True(err != nil)
+}
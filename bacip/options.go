@@ -0,0 +1,204 @@
+package bacip
+
+import (
+	"net"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+)
+
+// RequestOption customizes how a request is sent
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	priority       NPDUPriority
+	hopCount       byte
+	network        uint16
+	expectingReply *bool
+}
+
+func newRequestOptions(opts []RequestOption) requestOptions {
+	o := requestOptions{
+		priority: Normal,
+		hopCount: 255,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithPriority sets the network priority of the request. Routers
+// forward the messages with the highest priority first. Life safety
+// and critical equipment messages should use the matching priority.
+func WithPriority(p NPDUPriority) RequestOption {
+	return func(o *requestOptions) {
+		o.priority = p
+	}
+}
+
+// WithHopCount sets the maximum number of routers the request can go
+// through before being discarded. Default is 255.
+func WithHopCount(hopCount byte) RequestOption {
+	return func(o *requestOptions) {
+		o.hopCount = hopCount
+	}
+}
+
+// WithNetwork sets the network a broadcast request (WhoIs, WhoHas) is
+// sent to. By default, the request is only broadcast on the local
+// network. A remote network is reached through its router, which
+// broadcasts the request on this network only. Use
+// GlobalBroadcastNetwork to reach all the networks.
+func WithNetwork(network uint16) RequestOption {
+	return func(o *requestOptions) {
+		o.network = network
+	}
+}
+
+// WithExpectingReply sets the expecting reply bit of the NPDU of the
+// request. By default, it is set for the confirmed requests only. On
+// MS/TP, a device waits for the answer to the requests expecting a
+// reply before passing the token.
+func WithExpectingReply(expectingReply bool) RequestOption {
+	return func(o *requestOptions) {
+		o.expectingReply = &expectingReply
+	}
+}
+
+// expecting returns the expecting reply bit of the request, def if
+// WithExpectingReply isn't given
+func (o requestOptions) expecting(def bool) bool {
+	if o.expectingReply != nil {
+		return *o.expectingReply
+	}
+	return def
+}
+
+// ClientOption configures a client created by NewClientWithOptions
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	netInterface  string
+	bindIP        net.IP
+	port          int
+	broadcast     net.IP
+	broadcastPort int
+	device        *bacnet.ObjectID
+	vendorID      uint32
+	timings       APDUTimings
+	limits        APDULimits
+	logger        Logger
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	o := clientOptions{
+		broadcastPort: DefaultUDPPort,
+		timings:       DefaultAPDUTimings,
+		limits:        DefaultAPDULimits,
+		logger:        NoOpLogger{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithInterface sets the network interface, by name or as a cidr
+// address such as 192.168.1.10/24, the broadcast address is computed
+// from
+func WithInterface(netInterface string) ClientOption {
+	return func(o *clientOptions) {
+		o.netInterface = netInterface
+	}
+}
+
+// WithBindIP sets the local address of the client. Without
+// WithInterface, the network and the broadcast address are the ones
+// of this address. The socket still listens on all the addresses, as
+// the broadcasts aren't received on a unicast address.
+func WithBindIP(ip net.IP) ClientOption {
+	return func(o *clientOptions) {
+		o.bindIP = ip
+	}
+}
+
+// WithPort sets the local UDP port. Default is 0, a random port.
+func WithPort(port int) ClientOption {
+	return func(o *clientOptions) {
+		o.port = port
+	}
+}
+
+// WithBroadcast sets the address the broadcasts are sent to, instead
+// of the one computed from the network interface
+func WithBroadcast(ip net.IP) ClientOption {
+	return func(o *clientOptions) {
+		o.broadcast = ip
+	}
+}
+
+// WithBroadcastPort sets the UDP port the broadcasts are sent to.
+// Default is DefaultUDPPort.
+func WithBroadcastPort(port int) ClientOption {
+	return func(o *clientOptions) {
+		o.broadcastPort = port
+	}
+}
+
+// WithDeviceInstance gives a device instance to the client. It answers
+// the WhoIs including it with an IAm, and a BACnet/IPv6 client uses
+// the matching VMAC.
+func WithDeviceInstance(instance bacnet.ObjectInstance) ClientOption {
+	return func(o *clientOptions) {
+		o.device = &bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: instance}
+	}
+}
+
+// WithVendorID sets the vendor identifier advertised in the IAm of
+// the client, see WithDeviceInstance
+func WithVendorID(vendorID uint32) ClientOption {
+	return func(o *clientOptions) {
+		o.vendorID = vendorID
+	}
+}
+
+// WithAPDUTimeout sets the time to wait for an answer before
+// retransmitting a confirmed request. See SetAPDUTimings.
+func WithAPDUTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.timings.Timeout = timeout
+	}
+}
+
+// WithAPDURetries sets the number of retransmissions of a confirmed
+// request before giving up. See SetAPDUTimings.
+func WithAPDURetries(retries int) ClientOption {
+	return func(o *clientOptions) {
+		o.timings.Retries = retries
+	}
+}
+
+// WithMaxAPDU sets the maximum APDU length accepted by the client. It
+// is limited to the one of the data link.
+func WithMaxAPDU(maxAPDU uint) ClientOption {
+	return func(o *clientOptions) {
+		o.limits.MaxApdu = maxAPDU
+	}
+}
+
+// WithSegmentation sets whether the devices can send segmented
+// answers, with at most maxSegments segments (0 if unspecified)
+func WithSegmentation(accepted bool, maxSegments uint) ClientOption {
+	return func(o *clientOptions) {
+		o.limits.SegmentedResponseAccepted = accepted
+		o.limits.MaxSegments = maxSegments
+	}
+}
+
+// WithLogger sets the logger of the client. Default is NoOpLogger.
+func WithLogger(logger Logger) ClientOption {
+	return func(o *clientOptions) {
+		o.logger = logger
+	}
+}
@@ -0,0 +1,88 @@
+package bacip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/REQUEA/bacnet"
+)
+
+type serviceKey struct {
+	dataType PDUType
+	service  ServiceType
+}
+
+// registry maps a service to the function creating the payload used
+// to decode it
+var registry = struct {
+	sync.RWMutex
+	payloads map[serviceKey]func() Payload
+}{
+	payloads: map[serviceKey]func() Payload{
+		{UnconfirmedServiceRequest, ServiceUnconfirmedWhoIs}:  func() Payload { return &WhoIs{} },
+		{UnconfirmedServiceRequest, ServiceUnconfirmedIAm}:    func() Payload { return &Iam{} },
+		{UnconfirmedServiceRequest, ServiceUnconfirmedWhoHas}: func() Payload { return &WhoHas{} },
+		{UnconfirmedServiceRequest, ServiceUnconfirmedIHave}:  func() Payload { return &IHave{} },
+		{ComplexAck, ServiceConfirmedReadProperty}:            func() Payload { return &ReadProperty{} },
+	},
+}
+
+// RegisterPayload sets the payload type used to decode the APDUs with
+// the given PDU type and service choice. newPayload must return a
+// pointer to a new zero value at each call. It allows to support
+// services that are proprietary or not implemented by this package.
+// A registration replaces the previous one for the same service,
+// including the built-in ones.
+func RegisterPayload(dataType PDUType, service ServiceType, newPayload func() Payload) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.payloads[serviceKey{dataType: dataType, service: service}] = newPayload
+}
+
+// newPayload returns the payload type used to decode the given
+// service. Unknown services are decoded as raw data
+func newPayload(dataType PDUType, serviceType ServiceType) Payload {
+	switch dataType {
+	case Reject:
+		return &ApduReject{}
+	case Abort:
+		return &ApduAbort{}
+	}
+	registry.RLock()
+	f, ok := registry.payloads[serviceKey{dataType: dataType, service: serviceType}]
+	registry.RUnlock()
+	if ok {
+		return f()
+	}
+	if dataType == Error {
+		return &ApduError{}
+	}
+	return &DataPayload{}
+}
+
+// Do sends a confirmed request for the given service to the device
+// and returns the payload of the answer. The payload is nil if the
+// device answered with a simple ack. The answer payload of services
+// unknown to this package is a *DataPayload unless a payload type
+// has been registered with RegisterPayload.
+func (c *Client) Do(ctx context.Context, device bacnet.Device, serviceChoice ServiceType, request Payload, opts ...RequestOption) (Payload, error) {
+	apdu, err := c.confirmedRequest(ctx, device, APDU{
+		ServiceType: serviceChoice,
+		Payload:     request,
+	}, newRequestOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	if apdu.ServiceType != serviceChoice {
+		return nil, fmt.Errorf("invalid answer: service %d instead of %d", apdu.ServiceType, serviceChoice)
+	}
+	switch apdu.DataType {
+	case SimpleAck:
+		return nil, nil
+	case ComplexAck:
+		return apdu.Payload, nil
+	}
+	return nil, errors.New("invalid answer")
+}
@@ -0,0 +1,91 @@
+package bacip
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// vendorPayload is a proprietary service payload made of a single
+// byte
+type vendorPayload struct {
+	Value byte
+}
+
+func (p vendorPayload) MarshalBinary() ([]byte, error) {
+	return []byte{p.Value}, nil
+}
+
+func (p *vendorPayload) UnmarshalBinary(data []byte) error {
+	if len(data) > 0 {
+		p.Value = data[0]
+	}
+	return nil
+}
+
+const vendorService ServiceType = 0x40
+
+// registerVendorPayload registers vendorPayload for the answers of
+// vendorService until the end of the test
+func registerVendorPayload(t *testing.T) {
+	t.Helper()
+	key := serviceKey{dataType: ComplexAck, service: vendorService}
+	registry.RLock()
+	previous, ok := registry.payloads[key]
+	registry.RUnlock()
+	t.Cleanup(func() {
+		registry.Lock()
+		defer registry.Unlock()
+		if ok {
+			registry.payloads[key] = previous
+		} else {
+			delete(registry.payloads, key)
+		}
+	})
+	RegisterPayload(ComplexAck, vendorService, func() Payload { return &vendorPayload{} })
+}
+
+func TestRegisterPayload(t *testing.T) {
+	is := is.New(t)
+	registerVendorPayload(t)
+	b, err := hex.DecodeString("30054021")
+	is.NoErr(err)
+	apdu := APDU{}
+	is.NoErr(apdu.UnmarshalBinary(b))
+	is.Equal(apdu.Payload, &vendorPayload{Value: 0x21})
+
+	// Unregistered services are still decoded as raw data
+	b, err = hex.DecodeString("30054121")
+	is.NoErr(err)
+	is.NoErr(apdu.UnmarshalBinary(b))
+	is.Equal(apdu.Payload, &DataPayload{Bytes: []byte{0x21}})
+}
+
+func TestDo(t *testing.T) {
+	is := is.New(t)
+	registerVendorPayload(t)
+	device, _ := newFakeDevice(t, func(req NPDU) []NPDU {
+		request, ok := req.ADPU.Payload.(*DataPayload)
+		if !ok || req.ADPU.ServiceType != vendorService {
+			return []NPDU{answer(APDU{DataType: Reject, InvokeID: req.ADPU.InvokeID, Payload: &ApduReject{Reason: RejectReasonUnrecognizedService}})}
+		}
+		return []NPDU{answer(APDU{
+			DataType:    ComplexAck,
+			ServiceType: vendorService,
+			InvokeID:    req.ADPU.InvokeID,
+			Payload:     &vendorPayload{Value: request.Bytes[0] + 1},
+		})}
+	})
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := c.Do(ctx, device, vendorService, &vendorPayload{Value: 41})
+	is.NoErr(err)
+	is.Equal(resp, &vendorPayload{Value: 42})
+
+	_, err = c.Do(ctx, device, ServiceConfirmedReadRange, &DataPayload{})
+	is.Equal(err, ApduReject{Reason: RejectReasonUnrecognizedService})
+}
@@ -0,0 +1,216 @@
+package bacip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+)
+
+// GlobalBroadcastNetwork is the network number used to reach all the
+// networks
+const GlobalBroadcastNetwork uint16 = 0xFFFF
+
+// routes caches the routers to the remote networks. It is learnt from
+// I-Am-Router-To-Network messages and from the source of the messages
+// forwarded by routers.
+type routes struct {
+	sync.Mutex
+	routers map[uint16]bacnet.Address
+	// searches holds when the routers to the networks were last
+	// searched, to not search them at each request
+	searches map[uint16]time.Time
+}
+
+// routeSearchInterval is the minimum interval between two searches of
+// the router to a network
+const routeSearchInterval = time.Minute
+
+func (r *routes) set(network uint16, router bacnet.Address) {
+	r.Lock()
+	defer r.Unlock()
+	r.routers[network] = bacnet.Address{Mac: router.Mac}
+}
+
+func (r *routes) get(network uint16) (bacnet.Address, bool) {
+	r.Lock()
+	defer r.Unlock()
+	router, ok := r.routers[network]
+	return router, ok
+}
+
+func (r *routes) invalidate(network uint16) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.routers, network)
+	delete(r.searches, network)
+}
+
+// startSearch is true if the router to the network should be searched
+// now
+func (r *routes) startSearch(network uint16) bool {
+	r.Lock()
+	defer r.Unlock()
+	if last, ok := r.searches[network]; ok && time.Since(last) < routeSearchInterval {
+		return false
+	}
+	if r.searches == nil {
+		r.searches = map[uint16]time.Time{}
+	}
+	r.searches[network] = time.Now()
+	return true
+}
+
+// learnRoutes updates the routes from the network messages received
+// by the client
+func (c *Client) learnRoutes(m Message) {
+	switch p := m.NPDU.NetworkMessage.(type) {
+	case *IAmRouterToNetwork:
+		for _, n := range p.Networks {
+			c.routes.set(n, m.Source)
+		}
+	case *RejectMessageToNetwork:
+		c.logger.Info(fmt.Sprintf("router %v rejected message to network %d with reason %d", m.Source.Mac, p.Network, p.Reason))
+		c.routes.invalidate(p.Network)
+	}
+}
+
+// Routes returns the known routers to the remote networks, by
+// network number
+func (c *Client) Routes() map[uint16]bacnet.Address {
+	c.routes.Lock()
+	defer c.routes.Unlock()
+	result := make(map[uint16]bacnet.Address, len(c.routes.routers))
+	for n, r := range c.routes.routers {
+		result[n] = r
+	}
+	return result
+}
+
+// FindRouter returns the router to the given network. If the router
+// isn't known yet, a Who-Is-Router-To-Network is broadcast and the
+// first router answering is used.
+func (c *Client) FindRouter(ctx context.Context, network uint16) (bacnet.Address, error) {
+	if router, ok := c.routes.get(network); ok {
+		return router, nil
+	}
+	found := make(chan bacnet.Address, 1)
+	unsubscribe := c.Subscribe(func(m Message) {
+		iam, ok := m.NPDU.NetworkMessage.(*IAmRouterToNetwork)
+		if !ok {
+			return
+		}
+		for _, n := range iam.Networks {
+			if n == network {
+				select {
+				case found <- bacnet.Address{Mac: m.Source.Mac}:
+				default:
+				}
+				return
+			}
+		}
+	}, ForNetworkMessage(NetworkMessageIAmRouterToNetwork))
+	defer unsubscribe()
+	_, err := c.broadcast(NPDU{
+		Version:               Version1,
+		IsNetworkLayerMessage: true,
+		Priority:              Normal,
+		NetworkMessageType:    NetworkMessageWhoIsRouterToNetwork,
+		NetworkMessage:        &WhoIsRouterToNetwork{Network: &network},
+	})
+	if err != nil {
+		return bacnet.Address{}, err
+	}
+	select {
+	case router := <-found:
+		return router, nil
+	case <-ctx.Done():
+		return bacnet.Address{}, fmt.Errorf("find router to network %d: %w", network, ctx.Err())
+	}
+}
+
+// Router is a router answering to Who-Is-Router-To-Network
+type Router struct {
+	Addr bacnet.Address
+	// Networks are the networks reachable through the router
+	Networks []uint16
+}
+
+// WhoIsRouter broadcasts a Who-Is-Router-To-Network and returns the
+// routers answering before the timeout. The request is broadcast on
+// the local network, unless another network is given with
+// WithNetwork. The routers on a remote network have a remote address.
+func (c *Client) WhoIsRouter(timeout time.Duration, opts ...RequestOption) ([]Router, error) {
+	//Use a map to merge the answers of a router
+	set := map[string]*Router{}
+	err := c.collect(NPDU{
+		IsNetworkLayerMessage: true,
+		NetworkMessageType:    NetworkMessageWhoIsRouterToNetwork,
+		NetworkMessage:        &WhoIsRouterToNetwork{},
+	}, ForNetworkMessage(NetworkMessageIAmRouterToNetwork), timeout, newRequestOptions(opts), func(m Message) error {
+		iam, ok := m.NPDU.NetworkMessage.(*IAmRouterToNetwork)
+		if !ok {
+			return fmt.Errorf("unexpected payload type %T", m.NPDU.NetworkMessage)
+		}
+		key := fmt.Sprintf("%x/%d/%x", m.Source.Mac, m.Source.Net, m.Source.Adr)
+		r, ok := set[key]
+		if !ok {
+			r = &Router{Addr: m.Source}
+			set[key] = r
+		}
+		for _, n := range iam.Networks {
+			if !containsNetwork(r.Networks, n) {
+				r.Networks = append(r.Networks, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := []Router{}
+	for _, r := range set {
+		result = append(result, *r)
+	}
+	return result, nil
+}
+
+func containsNetwork(networks []uint16, n uint16) bool {
+	for _, x := range networks {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the destination address to use to reach addr. For a
+// device on a remote network, the MAC address is the one of the
+// router to this network. While this router is unknown, the address
+// given by the caller is used and the router is searched in the
+// background.
+func (c *Client) route(addr bacnet.Address) bacnet.Address {
+	if !addr.IsRemote() || addr.Net == GlobalBroadcastNetwork {
+		return addr
+	}
+	if router, ok := c.routes.get(addr.Net); ok {
+		addr.Mac = router.Mac
+		return addr
+	}
+	if c.routes.startSearch(addr.Net) {
+		c.settingsMutex.Lock()
+		timeout := c.timings.Timeout
+		c.settingsMutex.Unlock()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			// The router found is cached by learnRoutes
+			_, _ = c.FindRouter(ctx, addr.Net)
+		}()
+	}
+	// Without a router MAC address, send broadcasts the request on
+	// the local network
+	return addr
+}
@@ -0,0 +1,126 @@
+package bacip
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+func networkMessage(t *testing.T, msgType NetworkMessageType, msg Payload) []byte {
+	t.Helper()
+	b, err := BVLC{
+		Type:     TypeBacnetIP,
+		Function: BacFuncUnicast,
+		NPDU: NPDU{
+			Version:               Version1,
+			IsNetworkLayerMessage: true,
+			NetworkMessageType:    msgType,
+			NetworkMessage:        msg,
+		},
+	}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRouterDiscovery(t *testing.T) {
+	is := is.New(t)
+	ack, _ := hex.DecodeString(readPropertyAck)
+	router, _ := newFakeDevice(t, func(req NPDU) []NPDU {
+		if req.Destination == nil || req.Destination.Net != 5 {
+			return nil
+		}
+		a := answer(APDU{
+			DataType:    ComplexAck,
+			ServiceType: ServiceConfirmedReadProperty,
+			InvokeID:    req.ADPU.InvokeID,
+			Payload:     &DataPayload{Bytes: ack},
+		})
+		a.Source = &bacnet.Address{Net: 5, Adr: []byte{12}}
+		return []NPDU{a}
+	})
+	routerUDP := bacnet.UDPFromAddress(router.Addr)
+	c := newTestClient(t)
+	// The first request is broadcast while the router is searched,
+	// it is retransmitted to the router found
+	c.SetAPDUTimings(APDUTimings{Timeout: 100 * time.Millisecond, Retries: 3})
+	// The device address doesn't contain the router address
+	device := bacnet.Device{
+		ID:   bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 5012},
+		Addr: bacnet.Address{Net: 5, Adr: []byte{12}},
+	}
+	go func() {
+		// Answer to the Who-Is-Router-To-Network broadcast
+		time.Sleep(20 * time.Millisecond)
+		_ = handleBVLC(c, &routerUDP, networkMessage(t, NetworkMessageIAmRouterToNetwork, &IAmRouterToNetwork{Networks: []uint16{4, 5}}))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, device, testReadProperty)
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+	time.Sleep(20 * time.Millisecond) // Routes are updated asynchronously
+	is.Equal(c.Routes(), map[uint16]bacnet.Address{
+		4: {Mac: router.Addr.Mac},
+		5: {Mac: router.Addr.Mac},
+	})
+
+	// The router doesn't know the network 4 anymore
+	_ = handleBVLC(c, &routerUDP, networkMessage(t, NetworkMessageRejectMessageToNetwork, &RejectMessageToNetwork{
+		Reason:  RejectMessageUnknownNetwork,
+		Network: 4,
+	}))
+	time.Sleep(20 * time.Millisecond) // Routes are updated asynchronously
+	is.Equal(c.Routes(), map[uint16]bacnet.Address{
+		5: {Mac: router.Addr.Mac},
+	})
+}
+
+func TestRoutesLearntFromSource(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t)
+	routerUDP := net.UDPAddr{IP: net.IPv4(127, 0, 0, 2).To4(), Port: DefaultUDPPort}
+	b, err := BVLC{
+		Type:     TypeBacnetIP,
+		Function: BacFuncUnicast,
+		NPDU: NPDU{
+			Version: Version1,
+			Source:  &bacnet.Address{Net: 7, Adr: []byte{1}},
+			ADPU: &APDU{
+				DataType:    UnconfirmedServiceRequest,
+				ServiceType: ServiceUnconfirmedWhoIs,
+				Payload:     &WhoIs{},
+			},
+		},
+	}.MarshalBinary()
+	is.NoErr(err)
+	is.NoErr(handleBVLC(c, &routerUDP, b))
+	router, err := c.FindRouter(context.Background(), 7)
+	is.NoErr(err)
+	is.Equal(router, bacnet.Address{Mac: []byte{4, 127, 0, 0, 2, 0xba, 0xc0}})
+}
+
+func TestWhoIsRouter(t *testing.T) {
+	is := is.New(t)
+	c := newTestClient(t)
+	routerIP := net.UDPAddr{IP: net.IPv4(127, 0, 0, 2).To4(), Port: DefaultUDPPort}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = handleBVLC(c, &routerIP, networkMessage(t, NetworkMessageIAmRouterToNetwork, &IAmRouterToNetwork{Networks: []uint16{4, 5}}))
+		// The networks announced in several messages are merged
+		_ = handleBVLC(c, &routerIP, networkMessage(t, NetworkMessageIAmRouterToNetwork, &IAmRouterToNetwork{Networks: []uint16{5, 6}}))
+	}()
+	routers, err := c.WhoIsRouter(100 * time.Millisecond)
+	is.NoErr(err)
+	is.Equal(routers, []Router{{
+		Addr:     bacnet.Address{Mac: []byte{4, 127, 0, 0, 2, 0xba, 0xc0}},
+		Networks: []uint16{4, 5, 6},
+	}})
+}
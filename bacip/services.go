@@ -66,6 +66,79 @@ func (iam *Iam) UnmarshalBinary(data []byte) error {
 	return decoder.Error()
 }
 
+// WhoHas asks the devices having the given object to answer with
+// IHave. The object is given by its identifier or, if ObjectID is
+// nil, by its name.
+type WhoHas struct {
+	Low, High  *uint32 //may be null if we want to check all range
+	ObjectID   *bacnet.ObjectID
+	ObjectName string
+}
+
+func (w WhoHas) MarshalBinary() ([]byte, error) {
+	encoder := encoding.NewEncoder()
+	if w.Low != nil && w.High != nil {
+		if *w.Low > bacnet.MaxInstance || *w.High > bacnet.MaxInstance {
+			return nil, fmt.Errorf("invalid WhoHas range: [%d, %d]: max value is %d", *w.Low, *w.High, bacnet.MaxInstance)
+		}
+		if *w.Low > *w.High {
+			return nil, fmt.Errorf("invalid WhoHas range: [%d, %d]: low limit is higher than high limit", *w.Low, *w.High)
+		}
+		encoder.ContextUnsigned(0, *w.Low)
+		encoder.ContextUnsigned(1, *w.High)
+	}
+	if w.ObjectID != nil {
+		encoder.ContextObjectID(2, *w.ObjectID)
+	} else {
+		encoder.ContextCharacterString(3, w.ObjectName)
+	}
+	return encoder.Bytes(), encoder.Error()
+}
+
+func (w *WhoHas) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty WhoHas")
+	}
+	decoder := encoding.NewDecoder(data)
+	// The range is optional, it starts with context tag 0
+	if data[0]>>4 == 0 {
+		w.Low = new(uint32)
+		w.High = new(uint32)
+		decoder.ContextValue(0, w.Low)
+		decoder.ContextValue(1, w.High)
+	}
+	decoder.ContextCharacterString(3, &w.ObjectName)
+	if errors.As(decoder.Error(), &encoding.ErrorIncorrectTagID{}) {
+		decoder.ResetError()
+		w.ObjectID = &bacnet.ObjectID{}
+		decoder.ContextObjectID(2, w.ObjectID)
+	}
+	return decoder.Error()
+}
+
+// IHave is the answer of a device to a WhoHas
+type IHave struct {
+	DeviceID   bacnet.ObjectID
+	ObjectID   bacnet.ObjectID
+	ObjectName string
+}
+
+func (ih IHave) MarshalBinary() ([]byte, error) {
+	encoder := encoding.NewEncoder()
+	encoder.AppData(ih.DeviceID)
+	encoder.AppData(ih.ObjectID)
+	encoder.AppData(ih.ObjectName)
+	return encoder.Bytes(), encoder.Error()
+}
+
+func (ih *IHave) UnmarshalBinary(data []byte) error {
+	decoder := encoding.NewDecoder(data)
+	decoder.AppData(&ih.DeviceID)
+	decoder.AppData(&ih.ObjectID)
+	decoder.AppData(&ih.ObjectName)
+	return decoder.Error()
+}
+
 type ReadProperty struct {
 	ObjectID bacnet.ObjectID
 	Property bacnet.PropertyIdentifier
@@ -146,3 +219,81 @@ func (e *ApduError) UnmarshalBinary(data []byte) error {
 	decoder.AppData(&e.Code)
 	return decoder.Error()
 }
+
+// RejectReason is the reason sent by a device rejecting a request
+type RejectReason byte
+
+const (
+	RejectReasonOther                    RejectReason = 0
+	RejectReasonBufferOverflow           RejectReason = 1
+	RejectReasonInconsistentParameters   RejectReason = 2
+	RejectReasonInvalidParameterDataType RejectReason = 3
+	RejectReasonInvalidTag               RejectReason = 4
+	RejectReasonMissingRequiredParameter RejectReason = 5
+	RejectReasonParameterOutOfRange      RejectReason = 6
+	RejectReasonTooManyArguments         RejectReason = 7
+	RejectReasonUndefinedEnumeration     RejectReason = 8
+	RejectReasonUnrecognizedService      RejectReason = 9
+)
+
+// ApduReject is the payload of a Reject PDU. It is returned as an
+// error by the confirmed services
+type ApduReject struct {
+	Reason RejectReason
+}
+
+func (r ApduReject) Error() string {
+	return fmt.Sprintf("apdu rejected with reason %d", r.Reason)
+}
+
+func (r ApduReject) MarshalBinary() ([]byte, error) {
+	return []byte{byte(r.Reason)}, nil
+}
+
+func (r *ApduReject) UnmarshalBinary(data []byte) error {
+	if len(data) != 1 {
+		return fmt.Errorf("invalid reject payload length %d", len(data))
+	}
+	r.Reason = RejectReason(data[0])
+	return nil
+}
+
+// AbortReason is the reason sent by a peer aborting a transaction
+type AbortReason byte
+
+const (
+	AbortReasonOther                         AbortReason = 0
+	AbortReasonBufferOverflow                AbortReason = 1
+	AbortReasonInvalidApduInThisState        AbortReason = 2
+	AbortReasonPreemptedByHigherPriorityTask AbortReason = 3
+	AbortReasonSegmentationNotSupported      AbortReason = 4
+	AbortReasonSecurityError                 AbortReason = 5
+	AbortReasonInsufficientSecurity          AbortReason = 6
+	AbortReasonWindowSizeOutOfRange          AbortReason = 7
+	AbortReasonApplicationExceededReplyTime  AbortReason = 8
+	AbortReasonOutOfResources                AbortReason = 9
+	AbortReasonTSMTimeout                    AbortReason = 10
+	AbortReasonApduTooLong                   AbortReason = 11
+)
+
+// ApduAbort is the payload of an Abort PDU. It is returned as an
+// error by the confirmed services
+type ApduAbort struct {
+	Reason AbortReason
+}
+
+func (a ApduAbort) Error() string {
+	return fmt.Sprintf("apdu aborted with reason %d", a.Reason)
+}
+
+func (a ApduAbort) MarshalBinary() ([]byte, error) {
+	return []byte{byte(a.Reason)}, nil
+}
+
+func (a *ApduAbort) UnmarshalBinary(data []byte) error {
+	if len(data) != 1 {
+		return fmt.Errorf("invalid abort payload length %d", len(data))
+	}
+	a.Reason = AbortReason(data[0])
+	return nil
+}
@@ -76,6 +76,69 @@ func TestWhoIsCoherency(t *testing.T) {
 		})
 	}
 }
+
+func TestWhoHasCoherency(t *testing.T) {
+	ttc := []struct {
+		data   string //hex string
+		name   string
+		whoHas WhoHas
+	}{
+		{
+			data:   "3d050054656d70",
+			name:   "Name",
+			whoHas: WhoHas{ObjectName: "Temp"},
+		},
+		{
+			data:   "2c00000001",
+			name:   "ObjectID",
+			whoHas: WhoHas{ObjectID: &bacnet.ObjectID{Type: bacnet.AnalogInput, Instance: 1}},
+		},
+		{
+			data:   "09001affff2c00000001",
+			name:   "Range and ObjectID",
+			whoHas: WhoHas{Low: ptr(uint32(0)), High: ptr(uint32(0xFFFF)), ObjectID: &bacnet.ObjectID{Type: bacnet.AnalogInput, Instance: 1}},
+		},
+		{
+			data:   "0901190a3b004149",
+			name:   "Range and Name",
+			whoHas: WhoHas{Low: ptr(uint32(1)), High: ptr(uint32(10)), ObjectName: "AI"},
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			b, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			w := WhoHas{}
+			is.NoErr(w.UnmarshalBinary(b))
+			is.Equal(w, tc.whoHas)
+			b2, err := w.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(hex.EncodeToString(b2), tc.data)
+		})
+	}
+}
+
+func TestIHaveCoherency(t *testing.T) {
+	is := is.New(t)
+	b, err := hex.DecodeString("c4020004d2c40000000175050054656d70")
+	is.NoErr(err)
+	ih := IHave{}
+	is.NoErr(ih.UnmarshalBinary(b))
+	is.Equal(ih, IHave{
+		DeviceID:   bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 1234},
+		ObjectID:   bacnet.ObjectID{Type: bacnet.AnalogInput, Instance: 1},
+		ObjectName: "Temp",
+	})
+	b2, err := ih.MarshalBinary()
+	is.NoErr(err)
+	is.Equal(b2, b)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
 func TestIamEncodingAndCoherency(t *testing.T) {
 	ttc := []struct {
 		data string //hex string
@@ -184,7 +247,7 @@ func TestWritePropertyReq(t *testing.T) {
 				},
 				PropertyValue: bacnet.PropertyValue{
 					Type:  0x09,
-					Value: 0,
+					Value: uint32(0),
 				},
 				Priority: 0,
 			},
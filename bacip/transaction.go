@@ -2,62 +2,295 @@ package bacip
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 	"sync"
+	"time"
+
+	"github.com/REQUEA/bacnet"
 )
 
 type Tx struct {
 	APDU chan<- APDU
-	Ctx  context.Context
+	// answered is true once the final answer has been delivered
+	answered bool
+}
+
+// txKey identifies a transaction. Invoke IDs are only unique for a
+// given peer
+type txKey struct {
+	peer string
+	id   byte
 }
+
+// Transactions keeps track of the ongoing confirmed requests. The
+// standard only requires invoke IDs to be unique per peer, so each
+// peer has its own pool of 256 IDs.
 type Transactions struct {
 	sync.Mutex
-	currents     map[byte]Tx
-	freeInvokeID chan byte
+	currents map[txKey]*Tx
+	// ended keeps the recently stopped transactions, to tell late
+	// answers from unmatched ones
+	ended map[txKey]time.Time
+	// endedOrder holds the stopped transactions by end time, to
+	// purge ended
+	endedOrder []endedTx
+	pools      map[string]*invokeIDPool
+	// next is the next invoke ID of the peers without pool, so the
+	// IDs keep rotating when the pool is released between requests
+	next  map[string]byte
+	stats TransactionStats
+}
+
+// TransactionStats counts the answers received by the client
+type TransactionStats struct {
+	// Delivered is the number of answers delivered to a transaction
+	Delivered uint64
+	// Duplicates is the number of answers dropped because their
+	// transaction already got its answer
+	Duplicates uint64
+	// Late is the number of answers received after the end of their
+	// transaction
+	Late uint64
+	// Unmatched is the number of answers matching no transaction
+	Unmatched uint64
+}
+
+type endedTx struct {
+	key txKey
+	end time.Time
+}
+
+// lateAnswerWindow is how long a stopped transaction is remembered
+// to classify its answers as late
+const lateAnswerWindow = time.Minute
+
+// AnswerKind tells why an answer could not be delivered
+type AnswerKind int
+
+const (
+	AnswerUnmatched AnswerKind = iota
+	AnswerLate
+	AnswerDuplicate
+)
+
+// UnexpectedAnswer is returned when an answer cannot be delivered to
+// a transaction
+type UnexpectedAnswer struct {
+	Kind     AnswerKind
+	Source   bacnet.Address
+	InvokeID byte
+}
+
+func (e UnexpectedAnswer) Error() string {
+	switch e.Kind {
+	case AnswerLate:
+		return fmt.Sprintf("late answer from %s for invoke ID %d", peerKey(e.Source), e.InvokeID)
+	case AnswerDuplicate:
+		return fmt.Sprintf("duplicate answer from %s for invoke ID %d", peerKey(e.Source), e.InvokeID)
+	default:
+		return fmt.Sprintf("unmatched answer from %s for invoke ID %d", peerKey(e.Source), e.InvokeID)
+	}
+}
+
+type invokeIDPool struct {
+	free chan byte
+	//number of IDs in use or waited for. The pool is released when
+	//it reaches 0
+	users int
 }
 
 func NewTransactions() *Transactions {
-	t := Transactions{
-		currents:     map[byte]Tx{},
-		freeInvokeID: make(chan byte, 256), //The chan should be able to handle all possible values
+	return &Transactions{
+		currents: map[txKey]*Tx{},
+		ended:    map[txKey]time.Time{},
+		pools:    map[string]*invokeIDPool{},
+		next:     map[string]byte{},
+	}
+}
+
+// peerKey returns a string uniquely identifying the bacnet address,
+// suitable to be used as a map key
+func peerKey(addr bacnet.Address) string {
+	if addr.Net != 0 {
+		return fmt.Sprintf("%d:%s", addr.Net, hex.EncodeToString(addr.Adr))
+	}
+	return hex.EncodeToString(addr.Mac)
+}
+
+// GetID returns a free InvokeID to use for a Confirmed service
+// request sent to the peer. Blocks until such ID is available or
+// the context is done.
+func (t *Transactions) GetID(ctx context.Context, peer bacnet.Address) (byte, error) {
+	key := peerKey(peer)
+	t.Lock()
+	pool, ok := t.pools[key]
+	if !ok {
+		pool = &invokeIDPool{
+			free: make(chan byte, 256), //The chan should be able to handle all possible values
+		}
+		next := t.next[key]
+		for x := 0; x < 256; x++ {
+			pool.free <- next + byte(x)
+		}
+		delete(t.next, key)
+		t.pools[key] = pool
 	}
-	for x := 0; x < 256; x++ {
-		t.freeInvokeID <- byte(x)
+	pool.users++
+	t.Unlock()
+	select {
+	case id := <-pool.free:
+		t.Lock()
+		id = t.notEnded(key, pool, id)
+		t.Unlock()
+		return id, nil
+	case <-ctx.Done():
+		t.Lock()
+		t.release(key, pool)
+		t.Unlock()
+		return 0, fmt.Errorf("no free invoke ID for peer %s: %w", key, ctx.Err())
 	}
-	return &t
 }
 
-//GetID returns a free InvokeID to use fr a Confirmed service
-//request. Blocks until such ID is available
-func (t *Transactions) GetID() byte {
-	return <-t.freeInvokeID
+// notEnded returns id, or another free ID of the pool if the
+// transaction with id ended recently: a late answer to it would be
+// taken for the answer to the new request. id is kept if all the free
+// IDs ended recently. It must be called with the lock held.
+func (t *Transactions) notEnded(peer string, pool *invokeIDPool, id byte) byte {
+	if !t.recentlyEnded(txKey{peer: peer, id: id}) {
+		return id
+	}
+	for n := len(pool.free); n > 0; n-- {
+		var other byte
+		select {
+		case other = <-pool.free:
+		default:
+			return id
+		}
+		if !t.recentlyEnded(txKey{peer: peer, id: other}) {
+			pool.free <- id
+			return other
+		}
+		pool.free <- other
+	}
+	return id
 }
 
-//FreeID puts back the id in the pool of available invoke ID
-func (t *Transactions) FreeID(id byte) {
-	t.freeInvokeID <- id
+// recentlyEnded is true if the transaction ended less than
+// lateAnswerWindow ago. It must be called with the lock held.
+func (t *Transactions) recentlyEnded(key txKey) bool {
+	end, ok := t.ended[key]
+	return ok && time.Since(end) <= lateAnswerWindow
 }
 
-//nolint: revive
-//SetTransaction set up the channel passed as parameter as a callback for the bacnet response.
-//All call to SetTransaction must be followed by a StopTransaction to prevent leaks
-func (t *Transactions) SetTransaction(id byte, apdu chan<- APDU, ctx context.Context) {
+// FreeID puts back the id in the pool of available invoke ID of the
+// peer
+func (t *Transactions) FreeID(peer bacnet.Address, id byte) {
+	key := peerKey(peer)
 	t.Lock()
 	defer t.Unlock()
-	t.currents[id] = Tx{
+	pool, ok := t.pools[key]
+	if !ok {
+		return
+	}
+	pool.free <- id
+	t.release(key, pool)
+}
+
+// release must be called with the lock held
+func (t *Transactions) release(key string, pool *invokeIDPool) {
+	pool.users--
+	if pool.users == 0 {
+		// All the IDs are back, the first one is the next to use
+		t.next[key] = <-pool.free
+		delete(t.pools, key)
+	}
+}
+
+// SetTransaction set up the channel passed as parameter as a callback for the bacnet response.
+// All call to SetTransaction must be followed by a StopTransaction to prevent leaks.
+// The channel must be buffered, answers that cannot be delivered
+// immediately are dropped.
+func (t *Transactions) SetTransaction(peer bacnet.Address, id byte, apdu chan<- APDU) {
+	t.Lock()
+	defer t.Unlock()
+	key := txKey{peer: peerKey(peer), id: id}
+	t.currents[key] = &Tx{
 		APDU: apdu,
-		Ctx:  ctx,
 	}
 }
 
-func (t *Transactions) StopTransaction(id byte) {
+func (t *Transactions) StopTransaction(peer bacnet.Address, id byte) {
 	t.Lock()
 	defer t.Unlock()
-	delete(t.currents, id)
+	key := txKey{peer: peerKey(peer), id: id}
+	delete(t.currents, key)
+	now := time.Now()
+	i := 0
+	for ; i < len(t.endedOrder) && now.Sub(t.endedOrder[i].end) > lateAnswerWindow; i++ {
+		e := t.endedOrder[i]
+		// The transaction may have been restarted or stopped again
+		if end, ok := t.ended[e.key]; ok && end.Equal(e.end) {
+			delete(t.ended, e.key)
+		}
+	}
+	t.endedOrder = append(t.endedOrder[i:], endedTx{key: key, end: now})
+	t.ended[key] = now
+}
+
+func (t *Transactions) GetTransaction(peer bacnet.Address, id byte) (Tx, bool) {
+	t.Lock()
+	defer t.Unlock()
+	c, ok := t.currents[txKey{peer: peerKey(peer), id: id}]
+	if !ok {
+		return Tx{}, false
+	}
+	return *c, true
+}
+
+// Deliver passes the answer to the transaction matching both the
+// source address and the invoke ID. It never blocks. Once the final
+// answer of a transaction is delivered, the next answers for the same
+// transaction are dropped as duplicates. An UnexpectedAnswer error is
+// returned if the answer isn't delivered.
+func (t *Transactions) Deliver(source bacnet.Address, apdu APDU) error {
+	t.Lock()
+	defer t.Unlock()
+	key := txKey{peer: peerKey(source), id: apdu.InvokeID}
+	tx, ok := t.currents[key]
+	if !ok {
+		kind := AnswerUnmatched
+		if _, late := t.ended[key]; late {
+			kind = AnswerLate
+			t.stats.Late++
+		} else {
+			t.stats.Unmatched++
+		}
+		return UnexpectedAnswer{Kind: kind, Source: source, InvokeID: apdu.InvokeID}
+	}
+	if tx.answered {
+		t.stats.Duplicates++
+		return UnexpectedAnswer{Kind: AnswerDuplicate, Source: source, InvokeID: apdu.InvokeID}
+	}
+	select {
+	case tx.APDU <- apdu:
+	default:
+		//The previous answer isn't consumed yet
+		t.stats.Duplicates++
+		return UnexpectedAnswer{Kind: AnswerDuplicate, Source: source, InvokeID: apdu.InvokeID}
+	}
+	t.stats.Delivered++
+	// Only the intermediate segments of an answer are expected to
+	// be followed by other answers
+	if !(apdu.DataType == ComplexAck && apdu.Segmented && apdu.MoreFollows) {
+		tx.answered = true
+	}
+	return nil
 }
 
-func (t *Transactions) GetTransaction(id byte) (Tx, bool) {
+// Stats returns the number of answers received, by outcome
+func (t *Transactions) Stats() TransactionStats {
 	t.Lock()
 	defer t.Unlock()
-	c, ok := t.currents[id]
-	return c, ok
+	return t.stats
 }
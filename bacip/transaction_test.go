@@ -0,0 +1,179 @@
+package bacip
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+func TestInvokeIDPerPeer(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	peerA := bacnet.Address{Mac: []byte{4, 10, 0, 0, 1, 0xba, 0xc0}}
+	peerB := bacnet.Address{Mac: []byte{4, 10, 0, 0, 2, 0xba, 0xc0}}
+	ctx := context.Background()
+	seen := map[byte]bool{}
+	for x := 0; x < 256; x++ {
+		id, err := tx.GetID(ctx, peerA)
+		is.NoErr(err)
+		is.True(!seen[id]) // IDs are unique for a peer
+		seen[id] = true
+	}
+
+	// Pool of peer A is exhausted
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := tx.GetID(timeoutCtx, peerA)
+	is.True(errors.Is(err, context.DeadlineExceeded))
+
+	// Peer B has its own pool
+	_, err = tx.GetID(ctx, peerB)
+	is.NoErr(err)
+
+	tx.FreeID(peerA, 42)
+	id, err := tx.GetID(ctx, peerA)
+	is.NoErr(err)
+	is.Equal(id, byte(42))
+}
+
+func TestInvokeIDPoolRelease(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	peer := bacnet.Address{Net: 5, Adr: []byte{3}}
+	id, err := tx.GetID(context.Background(), peer)
+	is.NoErr(err)
+	is.Equal(len(tx.pools), 1)
+	tx.FreeID(peer, id)
+	is.Equal(len(tx.pools), 0)
+}
+
+func TestInvokeIDRotation(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	peer := bacnet.Address{Mac: []byte{4, 10, 0, 0, 1, 0xba, 0xc0}}
+	// Requests in a row get the next IDs, even though the pool is
+	// released in between
+	for x := 0; x < 300; x++ {
+		id, err := tx.GetID(context.Background(), peer)
+		is.NoErr(err)
+		is.Equal(id, byte(x))
+		tx.FreeID(peer, id)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	deviceA := bacnet.Address{Mac: []byte{4, 10, 0, 0, 1, 0xba, 0xc0}}
+	deviceB := bacnet.Address{Mac: []byte{4, 10, 0, 0, 2, 0xba, 0xc0}}
+	ack := APDU{DataType: SimpleAck, InvokeID: 3, ServiceType: ServiceConfirmedWriteProperty}
+
+	var unexpected UnexpectedAnswer
+	err := tx.Deliver(deviceA, ack)
+	is.True(errors.As(err, &unexpected))
+	is.Equal(unexpected.Kind, AnswerUnmatched)
+
+	rChan := make(chan APDU, 1)
+	tx.SetTransaction(deviceA, 3, rChan)
+	// Same invoke ID, but from another device
+	err = tx.Deliver(deviceB, ack)
+	is.True(errors.As(err, &unexpected))
+	is.Equal(unexpected.Kind, AnswerUnmatched)
+
+	is.NoErr(tx.Deliver(deviceA, ack))
+	is.Equal(<-rChan, ack)
+	err = tx.Deliver(deviceA, ack)
+	is.True(errors.As(err, &unexpected))
+	is.Equal(unexpected.Kind, AnswerDuplicate)
+	is.Equal(len(rChan), 0)
+
+	tx.StopTransaction(deviceA, 3)
+	err = tx.Deliver(deviceA, ack)
+	is.True(errors.As(err, &unexpected))
+	is.Equal(unexpected.Kind, AnswerLate)
+
+	is.Equal(tx.Stats(), TransactionStats{Delivered: 1, Duplicates: 1, Late: 1, Unmatched: 2})
+}
+
+func TestLateAnswerWindow(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	device := bacnet.Address{Mac: []byte{4, 10, 0, 0, 1, 0xba, 0xc0}}
+	for id := byte(0); id < 3; id++ {
+		tx.SetTransaction(device, id, make(chan APDU, 1))
+		tx.StopTransaction(device, id)
+	}
+	// The first two transactions ended long ago, the second one was
+	// restarted and stopped again since
+	old := time.Now().Add(-2 * lateAnswerWindow)
+	for i := 0; i < 2; i++ {
+		tx.endedOrder[i].end = old
+		tx.ended[tx.endedOrder[i].key] = old
+	}
+	tx.SetTransaction(device, 1, make(chan APDU, 1))
+	tx.StopTransaction(device, 1)
+	tx.SetTransaction(device, 3, make(chan APDU, 1))
+	tx.StopTransaction(device, 3)
+
+	is.Equal(len(tx.endedOrder), 3) // 2, 1 and 3
+	var unexpected UnexpectedAnswer
+	for id, kind := range []AnswerKind{AnswerUnmatched, AnswerLate, AnswerLate, AnswerLate} {
+		err := tx.Deliver(device, APDU{DataType: SimpleAck, InvokeID: byte(id)})
+		is.True(errors.As(err, &unexpected))
+		is.Equal(unexpected.Kind, kind)
+	}
+}
+
+func TestLateAnswerAfterNextRequest(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	device := bacnet.Address{Mac: []byte{4, 10, 0, 0, 1, 0xba, 0xc0}}
+	ctx := context.Background()
+	first, err := tx.GetID(ctx, device)
+	is.NoErr(err)
+	tx.SetTransaction(device, first, make(chan APDU, 1))
+	tx.StopTransaction(device, first)
+	tx.FreeID(device, first)
+
+	next, err := tx.GetID(ctx, device)
+	is.NoErr(err)
+	is.True(next != first)
+	rChan := make(chan APDU, 1)
+	tx.SetTransaction(device, next, rChan)
+	// The answer to the first request isn't taken for the answer to
+	// the next one
+	var unexpected UnexpectedAnswer
+	err = tx.Deliver(device, APDU{DataType: SimpleAck, InvokeID: first})
+	is.True(errors.As(err, &unexpected))
+	is.Equal(unexpected.Kind, AnswerLate)
+	is.Equal(len(rChan), 0)
+
+	// A free ID whose transaction ended recently isn't used again
+	other := bacnet.Address{Mac: []byte{4, 10, 0, 0, 2, 0xba, 0xc0}}
+	tx.SetTransaction(other, 0, make(chan APDU, 1))
+	tx.StopTransaction(other, 0)
+	id, err := tx.GetID(ctx, other)
+	is.NoErr(err)
+	is.Equal(id, byte(1))
+}
+
+func TestDeliverSegments(t *testing.T) {
+	is := is.New(t)
+	tx := NewTransactions()
+	device := bacnet.Address{Net: 2, Adr: []byte{12}}
+	rChan := make(chan APDU, 1)
+	tx.SetTransaction(device, 0, rChan)
+	segment := APDU{DataType: ComplexAck, Segmented: true, MoreFollows: true}
+	is.NoErr(tx.Deliver(device, segment))
+	<-rChan
+	segment.SequenceNumber = 1
+	segment.MoreFollows = false
+	is.NoErr(tx.Deliver(device, segment))
+	<-rChan
+	is.True(tx.Deliver(device, segment) != nil) // Answer is complete
+}
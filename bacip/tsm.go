@@ -0,0 +1,316 @@
+package bacip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+)
+
+// APDUTimings controls how a confirmed request is retransmitted when
+// the device doesn't answer.
+type APDUTimings struct {
+	// Timeout is the time to wait for an answer before
+	// retransmitting the request
+	Timeout time.Duration
+	// SegmentTimeout is the time to wait for the next segment of a
+	// segmented answer
+	SegmentTimeout time.Duration
+	// Retries is the number of retransmissions before giving up
+	Retries int
+}
+
+// DefaultAPDUTimings are the default values of the APDU_Timeout,
+// APDU_Segment_Timeout and Number_Of_APDU_Retries properties of a
+// Device object
+var DefaultAPDUTimings = APDUTimings{
+	Timeout:        3 * time.Second,
+	SegmentTimeout: 2 * time.Second,
+	Retries:        3,
+}
+
+var (
+	// ErrAPDUTimeout is returned when a device doesn't answer a
+	// confirmed request after all the retries
+	ErrAPDUTimeout = errors.New("no answer received from device after all retries")
+	// ErrSegmentTimeout is returned when a device stops sending the
+	// segments of a segmented answer
+	ErrSegmentTimeout = errors.New("timeout while waiting for the next segment")
+)
+
+// APDULimits describes the answers the client is able to receive. It
+// is advertised in each confirmed request.
+type APDULimits struct {
+	// MaxApdu is the maximum APDU length accepted, in bytes
+	MaxApdu uint
+	// MaxSegments is the maximum number of segments accepted in a
+	// segmented answer, 0 if unspecified
+	MaxSegments uint
+	// SegmentedResponseAccepted allows the device to send segmented
+	// answers
+	SegmentedResponseAccepted bool
+}
+
+// DefaultAPDULimits are the limits of a client on BACnet/IP
+var DefaultAPDULimits = APDULimits{
+	MaxApdu:                   1476,
+	MaxSegments:               64,
+	SegmentedResponseAccepted: true,
+}
+
+// SetAPDULimits sets the limits advertised in confirmed requests
+func (c *Client) SetAPDULimits(l APDULimits) {
+	c.settingsMutex.Lock()
+	defer c.settingsMutex.Unlock()
+	c.limits = l
+}
+
+// SetAPDUTimings sets the timings used for the devices without
+// specific timings
+func (c *Client) SetAPDUTimings(t APDUTimings) {
+	c.settingsMutex.Lock()
+	defer c.settingsMutex.Unlock()
+	c.timings = t
+}
+
+// SetDeviceAPDUTimings sets the timings used for the requests sent
+// to the given device
+func (c *Client) SetDeviceAPDUTimings(device bacnet.ObjectID, t APDUTimings) {
+	c.settingsMutex.Lock()
+	defer c.settingsMutex.Unlock()
+	c.deviceTimings[device] = t
+}
+
+// DeviceAPDUTimings returns the timings used for the requests sent
+// to the given device
+func (c *Client) DeviceAPDUTimings(device bacnet.ObjectID) APDUTimings {
+	c.settingsMutex.Lock()
+	defer c.settingsMutex.Unlock()
+	t, ok := c.deviceTimings[device]
+	if !ok {
+		return c.timings
+	}
+	return t
+}
+
+// LearnAPDUTimings reads the APDU_Timeout, APDU_Segment_Timeout and
+// Number_Of_APDU_Retries properties of the device and uses them for
+// the next requests sent to this device. APDU_Segment_Timeout is
+// optional, the current value is kept if the device doesn't have it.
+func (c *Client) LearnAPDUTimings(ctx context.Context, device bacnet.Device) (APDUTimings, error) {
+	t := c.DeviceAPDUTimings(device.ID)
+	read := func(prop bacnet.PropertyType) (uint32, error) {
+		d, err := c.ReadProperty(ctx, device, ReadProperty{
+			ObjectID: device.ID,
+			Property: bacnet.PropertyIdentifier{Type: prop},
+		})
+		if err != nil {
+			return 0, err
+		}
+		v, ok := d.(uint32)
+		if !ok {
+			return 0, fmt.Errorf("unexpected type %T for property %v", d, prop)
+		}
+		return v, nil
+	}
+	timeout, err := read(bacnet.ApduTimeout)
+	if err != nil {
+		return t, fmt.Errorf("read apdu timeout: %w", err)
+	}
+	retries, err := read(bacnet.NumberOfApduRetries)
+	if err != nil {
+		return t, fmt.Errorf("read number of apdu retries: %w", err)
+	}
+	t.Timeout = time.Duration(timeout) * time.Millisecond
+	t.Retries = int(retries)
+	segmentTimeout, err := read(bacnet.ApduSegmentTimeout)
+	var apduErr ApduError
+	if err != nil && !errors.As(err, &apduErr) {
+		return t, fmt.Errorf("read apdu segment timeout: %w", err)
+	}
+	if err == nil {
+		t.SegmentTimeout = time.Duration(segmentTimeout) * time.Millisecond
+	}
+	c.SetDeviceAPDUTimings(device.ID, t)
+	return t, nil
+}
+
+// confirmedRequest sends a confirmed request to the device and waits
+// for its answer. The request is retransmitted each time the APDU
+// timeout of the device expires, up to its number of retries.
+// Segmented answers are acknowledged and reassembled, the returned
+// APDU always has a decoded payload.
+func (c *Client) confirmedRequest(ctx context.Context, device bacnet.Device, apdu APDU, opts requestOptions) (APDU, error) {
+	timings := c.DeviceAPDUTimings(device.ID)
+	invokeID, err := c.transactions.GetID(ctx, device.Addr)
+	if err != nil {
+		return APDU{}, err
+	}
+	defer c.transactions.FreeID(device.Addr, invokeID)
+	destination := c.route(device.Addr)
+	c.settingsMutex.Lock()
+	limits := c.limits
+	c.settingsMutex.Unlock()
+	apdu.DataType = ConfirmedServiceRequest
+	apdu.InvokeID = invokeID
+	apdu.MaxApdu = limits.MaxApdu
+	apdu.MaxSegs = limits.MaxSegments
+	apdu.SegmentedResponseAccepted = limits.SegmentedResponseAccepted
+	npdu := NPDU{
+		Version:               Version1,
+		IsNetworkLayerMessage: false,
+		ExpectingReply:        opts.expecting(true),
+		Priority:              opts.priority,
+		Destination:           &destination,
+		HopCount:              opts.hopCount,
+		ADPU:                  &apdu,
+	}
+	rChan := make(chan APDU, 1)
+	c.transactions.SetTransaction(device.Addr, invokeID, rChan)
+	defer c.transactions.StopTransaction(device.Addr, invokeID)
+	_, err = c.send(npdu)
+	if err != nil {
+		return APDU{}, err
+	}
+	timer := time.NewTimer(timings.Timeout)
+	defer timer.Stop()
+	retries := 0
+	var segments *segmentedAnswer
+	for {
+		select {
+		case <-ctx.Done():
+			return APDU{}, ctx.Err()
+		case <-timer.C:
+			if segments != nil {
+				return APDU{}, ErrSegmentTimeout
+			}
+			if retries >= timings.Retries {
+				if device.Addr.IsRemote() {
+					// The router may have changed
+					c.routes.invalidate(device.Addr.Net)
+				}
+				return APDU{}, ErrAPDUTimeout
+			}
+			retries++
+			// The router may have been found since
+			destination = c.route(device.Addr)
+			_, err := c.send(npdu)
+			if err != nil {
+				return APDU{}, err
+			}
+			timer.Reset(timings.Timeout)
+		case answer := <-rChan:
+			if answer.DataType != ComplexAck || !answer.Segmented {
+				return answer, answerError(answer)
+			}
+			if segments == nil {
+				if answer.SequenceNumber != 0 {
+					//Not the start of the answer, wait for a
+					//retransmission of the first segment
+					continue
+				}
+				segments = &segmentedAnswer{first: answer}
+			}
+			done, err := c.receiveSegment(destination, segments, answer, opts)
+			if err != nil {
+				return APDU{}, err
+			}
+			if done {
+				return segments.assemble()
+			}
+			// The requester gives up after four times the
+			// segment timeout, see clause 5.4.4.3
+			resetTimer(timer, 4*timings.SegmentTimeout)
+		}
+	}
+}
+
+// answerError returns the error carried by Error, Reject and Abort
+// PDUs.
+func answerError(apdu APDU) error {
+	if apdu.DataType != Error && apdu.DataType != Reject && apdu.DataType != Abort {
+		return nil
+	}
+	switch p := apdu.Payload.(type) {
+	case *ApduError:
+		return *p
+	case *ApduReject:
+		return *p
+	case *ApduAbort:
+		return *p
+	case error:
+		return p
+	}
+	return fmt.Errorf("unexpected payload type %T for PDU type %d", apdu.Payload, apdu.DataType)
+}
+
+// segmentedAnswer holds the segments of an answer received so far
+type segmentedAnswer struct {
+	first APDU
+	data  bytes.Buffer
+	next  byte
+}
+
+// receiveSegment adds the segment to the answer and acknowledges it.
+// Returns true once the last segment is received
+func (c *Client) receiveSegment(destination bacnet.Address, s *segmentedAnswer, segment APDU, opts requestOptions) (bool, error) {
+	ack := APDU{
+		DataType:       SegmentAck,
+		InvokeID:       segment.InvokeID,
+		SequenceNumber: segment.SequenceNumber,
+		WindowSize:     1,
+	}
+	if segment.SequenceNumber != s.next {
+		//Ask the server to resend from the last segment received
+		ack.NegativeAck = true
+		ack.SequenceNumber = s.next - 1
+	} else {
+		payload, ok := segment.Payload.(*DataPayload)
+		if !ok {
+			return false, fmt.Errorf("unexpected segment payload type %T", segment.Payload)
+		}
+		s.data.Write(payload.Bytes)
+		s.next++
+	}
+	_, err := c.send(NPDU{
+		Version:     Version1,
+		Priority:    opts.priority,
+		Destination: &destination,
+		HopCount:    opts.hopCount,
+		ADPU:        &ack,
+	})
+	if err != nil {
+		return false, err
+	}
+	return !ack.NegativeAck && !segment.MoreFollows, nil
+}
+
+// assemble decodes the payload from all the received segments
+func (s *segmentedAnswer) assemble() (APDU, error) {
+	apdu := s.first
+	apdu.Segmented = false
+	apdu.MoreFollows = false
+	apdu.SequenceNumber = 0
+	apdu.WindowSize = 0
+	apdu.Payload = newPayload(apdu.DataType, apdu.ServiceType)
+	err := apdu.Payload.UnmarshalBinary(s.data.Bytes())
+	if err != nil {
+		return APDU{}, fmt.Errorf("decode segmented answer: %w", err)
+	}
+	return apdu, nil
+}
+
+// resetTimer resets a timer that may have already fired without
+// being drained
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,581 @@
+// Package bbmd implements a BACnet/IP Broadcast Management Device. A
+// BBMD forwards the broadcasts of its subnet to the BBMDs of the
+// other subnets and to the registered foreign devices, so that the
+// subnets of a site form a single BACnet network.
+package bbmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+)
+
+// GracePeriod is added to the TTL of the foreign devices registrations
+const GracePeriod = 30 * time.Second
+
+// Config is the configuration of a BBMD
+type Config struct {
+	// Addr is the local address the BBMD listens on. It should be
+	// the address listed in the broadcast distribution tables
+	Addr *net.UDPAddr
+	// Broadcast is the broadcast address of the local subnet
+	Broadcast *net.UDPAddr
+	// GlobalAddr is the public address of a BBMD behind a NAT router
+	// (Annex J.7.8), forwarding this port to Addr. It is the address
+	// listed in the broadcast distribution tables. The broadcasts of
+	// the local subnet are forwarded with it as originating address,
+	// since the private addresses can't be reached from the peers.
+	// Network and GlobalNetwork are required with it.
+	GlobalAddr *net.UDPAddr
+	// BDT is the initial broadcast distribution table. The entry of
+	// the BBMD itself is optional
+	BDT []bacip.BDTEntry
+	// MaxForeignDevices is the maximum number of foreign devices
+	// registered at the same time. Registrations are refused if 0.
+	MaxForeignDevices int
+	// ReadOnlyBDT refuses the Write-BDT requests
+	ReadOnlyBDT bool
+	// Network and GlobalNetwork are the BACnet network numbers of the
+	// local subnet and of the network of the peers, for a BBMD behind
+	// a NAT router. The remote devices can only reach the global
+	// address, so the BBMD routes between the two networks: the local
+	// broadcasts are forwarded with the local device in SNET/SADR,
+	// the remote broadcasts are broadcast on the subnet with the
+	// remote device in SNET/SADR, and the unicasts for one network
+	// received from the other one are relayed.
+	Network       uint16
+	GlobalNetwork uint16
+}
+
+// BBMD is a BACnet Broadcast Management Device
+type BBMD struct {
+	conn   *net.UDPConn
+	config Config
+	logger bacip.Logger
+	// localIPs are the addresses of the interfaces. A BBMD listening
+	// on all of them receives its own broadcasts from one of them.
+	localIPs []net.IP
+
+	mutex sync.Mutex
+	bdt   []bacip.BDTEntry
+	fdt   map[string]*foreignDevice
+
+	runFlag atomic.Bool
+	wg      sync.WaitGroup
+}
+
+type foreignDevice struct {
+	addr    net.UDPAddr
+	ttl     uint16
+	expires time.Time
+}
+
+// New starts a BBMD
+func New(config Config, logger bacip.Logger) (*BBMD, error) {
+	if config.Broadcast == nil {
+		return nil, errors.New("broadcast address is required")
+	}
+	if (config.GlobalAddr != nil || config.Network != 0 || config.GlobalNetwork != 0) &&
+		(config.GlobalAddr == nil || config.Network == 0 || config.GlobalNetwork == 0) {
+		return nil, errors.New("global address, network and global network numbers are required together")
+	}
+	localIPs, err := interfaceIPs()
+	if err != nil {
+		return nil, fmt.Errorf("interface addresses: %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &BBMD{
+		conn:     conn,
+		config:   config,
+		logger:   logger,
+		localIPs: localIPs,
+		bdt:      append([]bacip.BDTEntry{}, config.BDT...),
+		fdt:      map[string]*foreignDevice{},
+	}
+	b.runFlag.Store(true)
+	b.wg.Add(1)
+	go b.listen()
+	return b, nil
+}
+
+// Close stops the BBMD
+func (b *BBMD) Close() error {
+	b.runFlag.Store(false)
+	err := b.conn.Close()
+	b.wg.Wait()
+	return err
+}
+
+// Addr returns the address the BBMD listens on, see Config.GlobalAddr
+// for its address behind a NAT router
+func (b *BBMD) Addr() *net.UDPAddr {
+	return b.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// BDT returns the broadcast distribution table
+func (b *BBMD) BDT() []bacip.BDTEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]bacip.BDTEntry{}, b.bdt...)
+}
+
+// SetBDT replaces the broadcast distribution table
+func (b *BBMD) SetBDT(bdt []bacip.BDTEntry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bdt = append([]bacip.BDTEntry{}, bdt...)
+}
+
+// FDT returns the registered foreign devices
+func (b *BBMD) FDT() []bacip.FDTEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.purge()
+	entries := []bacip.FDTEntry{}
+	for _, fd := range b.fdt {
+		remaining := time.Until(fd.expires) / time.Second
+		if remaining > 0xFFFF {
+			remaining = 0xFFFF
+		}
+		entries = append(entries, bacip.FDTEntry{
+			Addr:      fd.addr,
+			TTL:       fd.ttl,
+			Remaining: uint16(remaining),
+		})
+	}
+	return entries
+}
+
+// purge removes the expired registrations. The mutex must be held
+func (b *BBMD) purge() {
+	now := time.Now()
+	for k, fd := range b.fdt {
+		if now.After(fd.expires) {
+			delete(b.fdt, k)
+		}
+	}
+}
+
+func (b *BBMD) listen() {
+	defer b.wg.Done()
+	buf := make([]byte, 2048)
+	for b.runFlag.Load() {
+		i, addr, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !b.runFlag.Load() {
+				return
+			}
+			b.logger.Error(err.Error())
+			continue
+		}
+		err = b.handleMessage(addr, buf[:i])
+		if err != nil {
+			b.logger.Error("handle msg: ", err)
+		}
+	}
+}
+
+func (b *BBMD) handleMessage(src *net.UDPAddr, data []byte) error {
+	if len(data) < 4 || bacip.BVLCType(data[0]) != bacip.TypeBacnetIP {
+		return bacip.ErrNotBAcnetIP
+	}
+	if int(binary.BigEndian.Uint16(data[2:])) != len(data) {
+		return fmt.Errorf("incoherent Length field in BVLC")
+	}
+	if b.isSelf(src) {
+		// Our own broadcasts
+		return nil
+	}
+	function := bacip.Function(data[1])
+	npdu := data[4:]
+	switch function {
+	case bacip.BacFuncBroadcast:
+		// A broadcast of the local subnet
+		origin := src
+		if b.config.GlobalAddr != nil {
+			origin = b.config.GlobalAddr
+		}
+		if b.routing() {
+			var err error
+			npdu, err = routedNPDU(npdu, b.config.Network, src)
+			if err != nil {
+				return err
+			}
+		}
+		b.forward(origin, npdu, false, nil)
+		return nil
+	case bacip.BacFuncForwardedNPDU:
+		// A broadcast of another subnet, forwarded by its BBMD
+		if len(npdu) < 6 {
+			return fmt.Errorf("short forwarded npdu")
+		}
+		origin := &net.UDPAddr{IP: net.IPv4(npdu[0], npdu[1], npdu[2], npdu[3]), Port: int(binary.BigEndian.Uint16(npdu[4:]))}
+		if b.isPeer(src) {
+			b.forwardFromPeer(origin, npdu[6:])
+		}
+		return nil
+	case bacip.BacFuncDistributeBroadcastToNetwork:
+		if !b.isRegistered(src) {
+			return b.result(src, bacip.BVLCResultDistributeBroadcastToNetworkNAK)
+		}
+		b.forward(src, npdu, true, src)
+		return nil
+	case bacip.BacFuncUnicast:
+		if b.routing() {
+			return b.relay(src, npdu)
+		}
+		return nil
+	}
+	var bvlc bacip.BVLC
+	err := bvlc.UnmarshalBinary(data)
+	if err != nil {
+		return err
+	}
+	switch p := bvlc.Payload.(type) {
+	case *bacip.RegisterForeignDevice:
+		return b.register(src, p.TTL)
+	case *bacip.BroadcastDistributionTable:
+		if function != bacip.BacFuncWriteBroadcastDistributionTable {
+			return nil
+		}
+		if b.config.ReadOnlyBDT {
+			return b.result(src, bacip.BVLCResultWriteBDTNAK)
+		}
+		b.SetBDT(p.Entries)
+		return b.result(src, bacip.BVLCResultSuccessful)
+	case *bacip.DeleteForeignDeviceTableEntry:
+		b.mutex.Lock()
+		_, ok := b.fdt[p.Addr.String()]
+		delete(b.fdt, p.Addr.String())
+		b.mutex.Unlock()
+		if !ok {
+			return b.result(src, bacip.BVLCResultDeleteFDTEntryNAK)
+		}
+		return b.result(src, bacip.BVLCResultSuccessful)
+	}
+	switch function {
+	case bacip.BacFuncBroadcastDistributionTable:
+		return b.send(src, bacip.BVLC{
+			Type:     bacip.TypeBacnetIP,
+			Function: bacip.BacFuncBroadcastDistributionTableAck,
+			Payload:  &bacip.BroadcastDistributionTable{Entries: b.BDT()},
+		})
+	case bacip.BacFuncReadForeignDeviceTable:
+		return b.send(src, bacip.BVLC{
+			Type:     bacip.TypeBacnetIP,
+			Function: bacip.BacFuncReadForeignDeviceTableAck,
+			Payload:  &bacip.ForeignDeviceTable{Entries: b.FDT()},
+		})
+	}
+	return nil
+}
+
+func (b *BBMD) register(src *net.UDPAddr, ttl uint16) error {
+	b.mutex.Lock()
+	b.purge()
+	key := src.String()
+	_, registered := b.fdt[key]
+	if !registered && len(b.fdt) >= b.config.MaxForeignDevices {
+		b.mutex.Unlock()
+		return b.result(src, bacip.BVLCResultRegisterForeignDeviceNAK)
+	}
+	b.fdt[key] = &foreignDevice{
+		addr:    *src,
+		ttl:     ttl,
+		expires: time.Now().Add(time.Duration(ttl)*time.Second + GracePeriod),
+	}
+	b.mutex.Unlock()
+	return b.result(src, bacip.BVLCResultSuccessful)
+}
+
+// forward sends the broadcast npdu of origin to the peer BBMDs and to
+// the foreign devices except origin. If local is set, the npdu is also
+// broadcast on the local subnet.
+func (b *BBMD) forward(origin *net.UDPAddr, npdu []byte, local bool, except *net.UDPAddr) {
+	msg := forwardedNPDU(origin, npdu)
+	if local {
+		b.broadcastLocal(origin, npdu)
+	}
+	for _, dst := range b.peers() {
+		b.write(dst, msg)
+	}
+	for _, dst := range b.foreignDevices(except) {
+		b.write(dst, msg)
+	}
+}
+
+// forwardFromPeer distributes the npdu forwarded by a peer BBMD to the
+// local subnet and to the foreign devices. The npdu isn't broadcast
+// again if the peers send their broadcasts directly on the subnet,
+// i.e. if the mask of the BBMD in its BDT isn't 255.255.255.255.
+func (b *BBMD) forwardFromPeer(origin *net.UDPAddr, npdu []byte) {
+	msg := forwardedNPDU(origin, npdu)
+	if b.twoHops() {
+		b.broadcastLocal(origin, npdu)
+	}
+	for _, dst := range b.foreignDevices(nil) {
+		b.write(dst, msg)
+	}
+}
+
+// broadcastLocal broadcasts the npdu of origin on the local subnet.
+// When routing, the npdu is broadcast by the BBMD as router to the
+// network of the peers, so the local devices answer through it.
+func (b *BBMD) broadcastLocal(origin *net.UDPAddr, npdu []byte) {
+	if !b.routing() {
+		b.write(b.config.Broadcast, forwardedNPDU(origin, npdu))
+		return
+	}
+	routed, err := routedNPDU(npdu, b.config.GlobalNetwork, origin)
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("broadcast npdu of %v: %v", origin, err))
+		return
+	}
+	b.write(b.config.Broadcast, bvlcMessage(bacip.BacFuncBroadcast, routed))
+}
+
+// routing is true if the BBMD routes between the local subnet and the
+// network of the peers, see Config.Network
+func (b *BBMD) routing() bool {
+	return b.config.Network != 0
+}
+
+// relay routes the unicast npdu received from src to the local subnet
+// or to the network of the peers, according to its destination
+// network. The other npdus are for the BBMD itself.
+func (b *BBMD) relay(src *net.UDPAddr, data []byte) error {
+	var npdu bacip.NPDU
+	apdu, err := npdu.UnmarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if npdu.Destination == nil {
+		return nil
+	}
+	var from uint16
+	switch npdu.Destination.Net {
+	case b.config.Network:
+		from = b.config.GlobalNetwork
+	case b.config.GlobalNetwork:
+		from = b.config.Network
+	default:
+		return nil
+	}
+	if npdu.Source == nil || npdu.Source.Net == 0 {
+		npdu.Source = &bacnet.Address{Net: from, Adr: bipMAC(src)}
+	}
+	to, dadr := npdu.Destination.Net, npdu.Destination.Adr
+	npdu.Destination = nil
+	msg, err := encodeNPDU(npdu, apdu)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(dadr) == 0 && to == b.config.Network:
+		b.write(b.config.Broadcast, bvlcMessage(bacip.BacFuncBroadcast, msg))
+	case len(dadr) == 0:
+		b.forward(b.config.GlobalAddr, msg, false, nil)
+	case len(dadr) == bipMACLength:
+		dst := &net.UDPAddr{IP: net.IPv4(dadr[0], dadr[1], dadr[2], dadr[3]), Port: int(binary.BigEndian.Uint16(dadr[4:]))}
+		b.write(dst, bvlcMessage(bacip.BacFuncUnicast, msg))
+	default:
+		return fmt.Errorf("invalid DADR %x for network %d", dadr, to)
+	}
+	return nil
+}
+
+// peers returns the addresses the broadcasts are forwarded to
+func (b *BBMD) peers() []*net.UDPAddr {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	peers := []*net.UDPAddr{}
+	for _, e := range b.bdt {
+		if b.isSelf(&e.Addr) {
+			continue
+		}
+		peers = append(peers, e.ForwardAddress())
+	}
+	return peers
+}
+
+// twoHops is true if the broadcasts are forwarded to the BBMD and not
+// directly to its subnet
+func (b *BBMD) twoHops() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, e := range b.bdt {
+		if b.isSelf(&e.Addr) {
+			ones, bits := e.Mask.Size()
+			return ones == bits
+		}
+	}
+	return true
+}
+
+// isSelf is true if addr is the local or the global address of the
+// BBMD
+func (b *BBMD) isSelf(addr *net.UDPAddr) bool {
+	if b.config.GlobalAddr != nil && sameAddr(addr, b.config.GlobalAddr) {
+		return true
+	}
+	return b.isLocal(addr)
+}
+
+// isLocal is true if addr is the local address of the BBMD, on any of
+// the interfaces if it listens on all of them
+func (b *BBMD) isLocal(addr *net.UDPAddr) bool {
+	local := b.Addr()
+	if addr.Port != local.Port {
+		return false
+	}
+	if !local.IP.IsUnspecified() {
+		return addr.IP.Equal(local.IP)
+	}
+	for _, ip := range b.localIPs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return addr.IP.IsUnspecified()
+}
+
+// isPeer is true if addr is a BBMD of the BDT
+func (b *BBMD) isPeer(addr *net.UDPAddr) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, e := range b.bdt {
+		if sameAddr(&e.Addr, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BBMD) isRegistered(addr *net.UDPAddr) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.purge()
+	_, ok := b.fdt[addr.String()]
+	return ok
+}
+
+func (b *BBMD) foreignDevices(except *net.UDPAddr) []*net.UDPAddr {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.purge()
+	result := []*net.UDPAddr{}
+	for _, fd := range b.fdt {
+		if except != nil && sameAddr(&fd.addr, except) {
+			continue
+		}
+		addr := fd.addr
+		result = append(result, &addr)
+	}
+	return result
+}
+
+func (b *BBMD) result(dst *net.UDPAddr, code bacip.BVLCResultCode) error {
+	return b.send(dst, bacip.BVLC{
+		Type:     bacip.TypeBacnetIP,
+		Function: bacip.BacFuncResult,
+		Payload:  &bacip.BVLCResult{Code: code},
+	})
+}
+
+func (b *BBMD) send(dst *net.UDPAddr, bvlc bacip.BVLC) error {
+	data, err := bvlc.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = b.conn.WriteToUDP(data, dst)
+	return err
+}
+
+func (b *BBMD) write(dst *net.UDPAddr, data []byte) {
+	_, err := b.conn.WriteToUDP(data, dst)
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("send to %v: %v", dst, err))
+	}
+}
+
+// bipMACLength is the length of a B/IP address in the SADR and DADR
+// fields
+const bipMACLength = 6
+
+func bipMAC(addr *net.UDPAddr) []byte {
+	mac := append([]byte{}, addr.IP.To4()...)
+	return binary.BigEndian.AppendUint16(mac, uint16(addr.Port))
+}
+
+// routedNPDU returns the raw npdu with the node at src of the network
+// as source, unless it was already routed
+func routedNPDU(data []byte, network uint16, src *net.UDPAddr) ([]byte, error) {
+	var npdu bacip.NPDU
+	apdu, err := npdu.UnmarshalHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if npdu.Source != nil && npdu.Source.Net != 0 {
+		return data, nil
+	}
+	npdu.Source = &bacnet.Address{Net: network, Adr: bipMAC(src)}
+	return encodeNPDU(npdu, apdu)
+}
+
+// encodeNPDU returns the npdu header followed by the raw apdu
+func encodeNPDU(npdu bacip.NPDU, apdu []byte) ([]byte, error) {
+	npdu.ADPU = nil
+	data, err := npdu.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, apdu...), nil
+}
+
+// bvlcMessage returns the message of the function carrying the raw
+// npdu
+func bvlcMessage(function bacip.Function, npdu []byte) []byte {
+	b := []byte{byte(bacip.TypeBacnetIP), byte(function)}
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(npdu)))
+	return append(b, npdu...)
+}
+
+// forwardedNPDU returns the Forwarded-NPDU message of the raw npdu
+func forwardedNPDU(origin *net.UDPAddr, npdu []byte) []byte {
+	length := 4 + 6 + len(npdu)
+	b := make([]byte, 0, length)
+	b = append(b, byte(bacip.TypeBacnetIP), byte(bacip.BacFuncForwardedNPDU))
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	b = append(b, origin.IP.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(origin.Port))
+	return append(b, npdu...)
+}
+
+// interfaceIPs returns the addresses of the local interfaces
+func interfaceIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,403 @@
+package bbmd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+
+	"github.com/matryer/is"
+)
+
+func listen(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func localAddr(conn *net.UDPConn) *net.UDPAddr {
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func send(t *testing.T, conn *net.UDPConn, dst *net.UDPAddr, bvlc bacip.BVLC) {
+	t.Helper()
+	bvlc.Type = bacip.TypeBacnetIP
+	b, err := bvlc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.WriteToUDP(b, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, conn *net.UDPConn) bacip.BVLC {
+	t.Helper()
+	b := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	i, _, err := conn.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bvlc bacip.BVLC
+	err = bvlc.UnmarshalBinary(b[:i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bvlc
+}
+
+func expectResult(t *testing.T, conn *net.UDPConn, code bacip.BVLCResultCode) {
+	t.Helper()
+	bvlc := receive(t, conn)
+	result, ok := bvlc.Payload.(*bacip.BVLCResult)
+	if !ok || result.Code != code {
+		t.Fatalf("result %v expected, got %v %+v", code, bvlc.Function, bvlc.Payload)
+	}
+}
+
+// whoIs is a broadcast npdu
+var whoIs = bacip.NPDU{
+	Version: bacip.Version1,
+	ADPU: &bacip.APDU{
+		DataType:    bacip.UnconfirmedServiceRequest,
+		ServiceType: bacip.ServiceUnconfirmedWhoIs,
+		Payload:     &bacip.WhoIs{},
+	},
+}
+
+// testSite has two subnets, each one with a BBMD and a node. The
+// broadcasts of a subnet are sent to its node.
+type testSite struct {
+	bbmdA, bbmdB *BBMD
+	nodeA, nodeB *net.UDPConn
+}
+
+func newTestSite(t *testing.T) *testSite {
+	t.Helper()
+	s := &testSite{nodeA: listen(t), nodeB: listen(t)}
+	newBBMD := func(broadcast *net.UDPAddr) *BBMD {
+		b, err := New(Config{
+			Addr:              &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			Broadcast:         broadcast,
+			MaxForeignDevices: 1,
+		}, bacip.NoOpLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		return b
+	}
+	s.bbmdA = newBBMD(localAddr(s.nodeA))
+	s.bbmdB = newBBMD(localAddr(s.nodeB))
+	bdt := []bacip.BDTEntry{
+		{Addr: *s.bbmdA.Addr(), Mask: net.CIDRMask(32, 32)},
+		{Addr: *s.bbmdB.Addr(), Mask: net.CIDRMask(32, 32)},
+	}
+	s.bbmdA.SetBDT(bdt)
+	s.bbmdB.SetBDT(bdt)
+	return s
+}
+
+func TestForwardBroadcast(t *testing.T) {
+	is := is.New(t)
+	s := newTestSite(t)
+	// The broadcast of nodeA is received by its BBMD
+	send(t, s.nodeA, s.bbmdA.Addr(), bacip.BVLC{Function: bacip.BacFuncBroadcast, NPDU: whoIs})
+	bvlc := receive(t, s.nodeB)
+	is.Equal(bvlc.Function, bacip.BacFuncForwardedNPDU)
+	is.True(bvlc.Origin.IP.Equal(localAddr(s.nodeA).IP))
+	is.Equal(bvlc.Origin.Port, localAddr(s.nodeA).Port)
+	is.Equal(bvlc.NPDU.ADPU.ServiceType, bacip.ServiceUnconfirmedWhoIs)
+}
+
+func TestForeignDevice(t *testing.T) {
+	is := is.New(t)
+	s := newTestSite(t)
+	fd := listen(t)
+
+	// Only registered devices can distribute broadcasts
+	send(t, fd, s.bbmdA.Addr(), bacip.BVLC{Function: bacip.BacFuncDistributeBroadcastToNetwork, NPDU: whoIs})
+	expectResult(t, fd, bacip.BVLCResultDistributeBroadcastToNetworkNAK)
+
+	send(t, fd, s.bbmdA.Addr(), bacip.BVLC{
+		Function: bacip.BacFuncRegisterForeignDevice,
+		Payload:  &bacip.RegisterForeignDevice{TTL: 60},
+	})
+	expectResult(t, fd, bacip.BVLCResultSuccessful)
+	fdt := s.bbmdA.FDT()
+	is.Equal(len(fdt), 1)
+	is.Equal(fdt[0].TTL, uint16(60))
+	is.True(fdt[0].Remaining > 60 && fdt[0].Remaining <= 90) // with the grace period
+
+	// The table is full
+	other := listen(t)
+	send(t, other, s.bbmdA.Addr(), bacip.BVLC{
+		Function: bacip.BacFuncRegisterForeignDevice,
+		Payload:  &bacip.RegisterForeignDevice{TTL: 60},
+	})
+	expectResult(t, other, bacip.BVLCResultRegisterForeignDeviceNAK)
+
+	// The broadcasts of the foreign device reach both subnets
+	send(t, fd, s.bbmdA.Addr(), bacip.BVLC{Function: bacip.BacFuncDistributeBroadcastToNetwork, NPDU: whoIs})
+	for _, node := range []*net.UDPConn{s.nodeA, s.nodeB} {
+		bvlc := receive(t, node)
+		is.Equal(bvlc.Function, bacip.BacFuncForwardedNPDU)
+		is.Equal(bvlc.Origin.Port, localAddr(fd).Port)
+	}
+
+	// The broadcasts of the subnets reach the foreign device
+	send(t, s.nodeB, s.bbmdB.Addr(), bacip.BVLC{Function: bacip.BacFuncBroadcast, NPDU: whoIs})
+	bvlc := receive(t, fd)
+	is.Equal(bvlc.Function, bacip.BacFuncForwardedNPDU)
+	is.Equal(bvlc.Origin.Port, localAddr(s.nodeB).Port)
+	bvlc = receive(t, s.nodeA)
+	is.Equal(bvlc.Origin.Port, localAddr(s.nodeB).Port)
+}
+
+func TestTables(t *testing.T) {
+	is := is.New(t)
+	s := newTestSite(t)
+	manager := listen(t)
+
+	send(t, manager, s.bbmdA.Addr(), bacip.BVLC{Function: bacip.BacFuncBroadcastDistributionTable})
+	bvlc := receive(t, manager)
+	is.Equal(bvlc.Function, bacip.BacFuncBroadcastDistributionTableAck)
+	is.Equal(len(bvlc.Payload.(*bacip.BroadcastDistributionTable).Entries), 2)
+
+	bdt := []bacip.BDTEntry{{Addr: *s.bbmdA.Addr(), Mask: net.CIDRMask(24, 32)}}
+	send(t, manager, s.bbmdA.Addr(), bacip.BVLC{
+		Function: bacip.BacFuncWriteBroadcastDistributionTable,
+		Payload:  &bacip.BroadcastDistributionTable{Entries: bdt},
+	})
+	expectResult(t, manager, bacip.BVLCResultSuccessful)
+	is.Equal(len(s.bbmdA.BDT()), 1)
+	is.Equal(s.bbmdA.BDT()[0].Mask, net.CIDRMask(24, 32))
+
+	send(t, manager, s.bbmdA.Addr(), bacip.BVLC{
+		Function: bacip.BacFuncRegisterForeignDevice,
+		Payload:  &bacip.RegisterForeignDevice{TTL: 60},
+	})
+	expectResult(t, manager, bacip.BVLCResultSuccessful)
+	send(t, manager, s.bbmdA.Addr(), bacip.BVLC{Function: bacip.BacFuncReadForeignDeviceTable})
+	bvlc = receive(t, manager)
+	is.Equal(bvlc.Function, bacip.BacFuncReadForeignDeviceTableAck)
+	entries := bvlc.Payload.(*bacip.ForeignDeviceTable).Entries
+	is.Equal(len(entries), 1)
+	is.Equal(entries[0].Addr.Port, localAddr(manager).Port)
+
+	for _, code := range []bacip.BVLCResultCode{bacip.BVLCResultSuccessful, bacip.BVLCResultDeleteFDTEntryNAK} {
+		send(t, manager, s.bbmdA.Addr(), bacip.BVLC{
+			Function: bacip.BacFuncDeleteForeignDeviceTableEntry,
+			Payload:  &bacip.DeleteForeignDeviceTableEntry{Addr: *localAddr(manager)},
+		})
+		expectResult(t, manager, code)
+	}
+	is.Equal(len(s.bbmdA.FDT()), 0)
+}
+
+func TestReadOnlyBDT(t *testing.T) {
+	b, err := New(Config{
+		Addr:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Broadcast:   &net.UDPAddr{IP: net.IPv4(127, 255, 255, 255), Port: bacip.DefaultUDPPort},
+		ReadOnlyBDT: true,
+	}, bacip.NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	manager := listen(t)
+	send(t, manager, b.Addr(), bacip.BVLC{
+		Function: bacip.BacFuncWriteBroadcastDistributionTable,
+		Payload:  &bacip.BroadcastDistributionTable{},
+	})
+	expectResult(t, manager, bacip.BVLCResultWriteBDTNAK)
+}
+
+func TestNAT(t *testing.T) {
+	is := is.New(t)
+	// The NAT router forwards its port to the BBMD, which is known by
+	// its global address by the remote peer
+	router, peer, node := listen(t), listen(t), listen(t)
+	bbmd, err := New(Config{
+		Addr:       &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Broadcast:  localAddr(node),
+		GlobalAddr: localAddr(router),
+		BDT: []bacip.BDTEntry{
+			{Addr: *localAddr(router), Mask: net.CIDRMask(32, 32)},
+			{Addr: *localAddr(peer), Mask: net.CIDRMask(32, 32)},
+		},
+		MaxForeignDevices: 1,
+		Network:           10,
+		GlobalNetwork:     20,
+	}, bacip.NoOpLogger{})
+	is.NoErr(err)
+	defer bbmd.Close()
+	fd := listen(t)
+	send(t, fd, bbmd.Addr(), bacip.BVLC{
+		Function: bacip.BacFuncRegisterForeignDevice,
+		Payload:  &bacip.RegisterForeignDevice{TTL: 60},
+	})
+	expectResult(t, fd, bacip.BVLCResultSuccessful)
+
+	// The private address of the node is replaced by the global one
+	send(t, node, bbmd.Addr(), bacip.BVLC{Function: bacip.BacFuncBroadcast, NPDU: whoIs})
+	for _, conn := range []*net.UDPConn{peer, fd} {
+		bvlc := receive(t, conn)
+		is.Equal(bvlc.Function, bacip.BacFuncForwardedNPDU)
+		is.True(bvlc.Origin.IP.Equal(localAddr(router).IP))
+		is.Equal(bvlc.Origin.Port, localAddr(router).Port)
+	}
+
+	// The broadcasts of the peer are distributed on the subnet
+	origin := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: bacip.DefaultUDPPort}
+	data, err := bacip.BVLC{
+		Type:     bacip.TypeBacnetIP,
+		Function: bacip.BacFuncForwardedNPDU,
+		Origin:   origin,
+		NPDU:     whoIs,
+	}.MarshalBinary()
+	is.NoErr(err)
+	// As received through the router
+	is.NoErr(bbmd.handleMessage(localAddr(peer), data))
+	bvlc := receive(t, fd)
+	is.Equal(bvlc.Function, bacip.BacFuncForwardedNPDU)
+	is.True(bvlc.Origin.IP.Equal(origin.IP))
+	// The BBMD broadcasts it on the subnet as router to the remote
+	// device
+	bvlc = receive(t, node)
+	is.Equal(bvlc.Function, bacip.BacFuncBroadcast)
+	is.Equal(bvlc.NPDU.Source, &bacnet.Address{Net: 20, Adr: bipMAC(origin)})
+
+	// The BBMD never forwards to its global address
+	b := make([]byte, 2048)
+	_ = router.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = router.ReadFromUDP(b)
+	is.True(err != nil)
+}
+
+func TestNATRouting(t *testing.T) {
+	is := is.New(t)
+	router, peer, node, client := listen(t), listen(t), listen(t), listen(t)
+	bbmd, err := New(Config{
+		Addr:       &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Broadcast:  localAddr(node),
+		GlobalAddr: localAddr(router),
+		BDT: []bacip.BDTEntry{
+			{Addr: *localAddr(router), Mask: net.CIDRMask(32, 32)},
+			{Addr: *localAddr(peer), Mask: net.CIDRMask(32, 32)},
+		},
+		Network:       10,
+		GlobalNetwork: 20,
+	}, bacip.NoOpLogger{})
+	is.NoErr(err)
+	defer bbmd.Close()
+	nodeMAC := bipMAC(localAddr(node))
+	clientMAC := bipMAC(localAddr(client))
+	iAm := bacip.NPDU{
+		Version: bacip.Version1,
+		ADPU: &bacip.APDU{
+			DataType:    bacip.UnconfirmedServiceRequest,
+			ServiceType: bacip.ServiceUnconfirmedIAm,
+			Payload: &bacip.Iam{
+				ObjectID:      bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 1234},
+				MaxApduLength: 1476,
+				VendorID:      260,
+			},
+		},
+	}
+
+	// The local broadcast is forwarded with the node as source on the
+	// local network
+	send(t, node, bbmd.Addr(), bacip.BVLC{Function: bacip.BacFuncBroadcast, NPDU: iAm})
+	bvlc := receive(t, peer)
+	is.True(bvlc.Origin.IP.Equal(localAddr(router).IP))
+	is.Equal(bvlc.NPDU.Source, &bacnet.Address{Net: 10, Adr: nodeMAC})
+
+	// The request of the remote client, sent to the global address,
+	// is relayed to the node
+	request := whoIs
+	request.Destination = &bacnet.Address{Net: 10, Adr: nodeMAC}
+	request.HopCount = 255
+	send(t, client, bbmd.Addr(), bacip.BVLC{Function: bacip.BacFuncUnicast, NPDU: request})
+	bvlc = receive(t, node)
+	is.Equal(bvlc.Function, bacip.BacFuncUnicast)
+	is.Equal(bvlc.NPDU.Destination, nil)
+	is.Equal(bvlc.NPDU.Source, &bacnet.Address{Net: 20, Adr: clientMAC})
+
+	// The answer of the node is relayed back to the client
+	answer := iAm
+	answer.Destination = bvlc.NPDU.Source
+	answer.HopCount = 255
+	send(t, node, bbmd.Addr(), bacip.BVLC{Function: bacip.BacFuncUnicast, NPDU: answer})
+	bvlc = receive(t, client)
+	is.Equal(bvlc.Function, bacip.BacFuncUnicast)
+	is.Equal(bvlc.NPDU.Source, &bacnet.Address{Net: 10, Adr: nodeMAC})
+	is.Equal(bvlc.NPDU.ADPU.ServiceType, bacip.ServiceUnconfirmedIAm)
+
+	// The remote broadcasts reach the node from the BBMD as router
+	data, err := bacip.BVLC{
+		Type:     bacip.TypeBacnetIP,
+		Function: bacip.BacFuncForwardedNPDU,
+		Origin:   localAddr(client),
+		NPDU:     whoIs,
+	}.MarshalBinary()
+	is.NoErr(err)
+	is.NoErr(bbmd.handleMessage(localAddr(peer), data))
+	bvlc = receive(t, node)
+	is.Equal(bvlc.Function, bacip.BacFuncBroadcast)
+	is.Equal(bvlc.NPDU.Source, &bacnet.Address{Net: 20, Adr: clientMAC})
+
+	// The global address needs both network numbers, the remote
+	// devices couldn't answer otherwise
+	_, err = New(Config{Broadcast: localAddr(node), GlobalAddr: localAddr(router)}, bacip.NoOpLogger{})
+	is.True(err != nil)
+	_, err = New(Config{Broadcast: localAddr(node), Network: 10, GlobalNetwork: 20}, bacip.NoOpLogger{})
+	is.True(err != nil)
+}
+
+func TestOwnBroadcast(t *testing.T) {
+	is := is.New(t)
+	// The BBMD listens on all the addresses and its broadcasts come
+	// back to it from the loopback address
+	bbmd, err := New(Config{
+		Addr:              &net.UDPAddr{IP: net.IPv4zero},
+		Broadcast:         &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		MaxForeignDevices: 1,
+	}, bacip.NoOpLogger{})
+	is.NoErr(err)
+	defer bbmd.Close()
+	self := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: bbmd.Addr().Port}
+	bbmd.config.Broadcast = self
+	peer, fd := listen(t), listen(t)
+	bbmd.SetBDT([]bacip.BDTEntry{
+		{Addr: *self, Mask: net.CIDRMask(32, 32)},
+		{Addr: *localAddr(peer), Mask: net.CIDRMask(32, 32)},
+	})
+	send(t, fd, self, bacip.BVLC{
+		Function: bacip.BacFuncRegisterForeignDevice,
+		Payload:  &bacip.RegisterForeignDevice{TTL: 60},
+	})
+	expectResult(t, fd, bacip.BVLCResultSuccessful)
+
+	// The broadcast forwarded by the peer reaches the foreign device
+	// once, the copy received back by the BBMD isn't forwarded again
+	send(t, peer, self, bacip.BVLC{
+		Function: bacip.BacFuncForwardedNPDU,
+		Origin:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: bacip.DefaultUDPPort},
+		NPDU:     whoIs,
+	})
+	bvlc := receive(t, fd)
+	is.Equal(bvlc.Function, bacip.BacFuncForwardedNPDU)
+	b := make([]byte, 2048)
+	_ = fd.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = fd.ReadFromUDP(b)
+	is.True(err != nil)
+}
@@ -0,0 +1,88 @@
+// Package ethernet implements the BACnet/Ethernet data link (Clause
+// 7): the npdus are sent in ISO 8802-2 LLC frames over ISO 8802-3.
+package ethernet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// BroadcastMAC is the destination of the broadcast frames
+var BroadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// The LLC header of the BACnet frames: the BACnet DSAP and SSAP, and
+// the UI control octet
+const (
+	llcDSAP    = 0x82
+	llcSSAP    = 0x82
+	llcControl = 0x03
+)
+
+const (
+	macLength = 6
+	// headerLength is the length of the 8802-3 header and the LLC
+	// header
+	headerLength = 2*macLength + 2 + 3
+	// minFrameLength is the minimum length of a frame without its
+	// FCS, shorter frames are padded
+	minFrameLength = 60
+	// maxLength is the maximum value of the length field, greater
+	// values are EtherTypes
+	maxLength = 1500
+)
+
+// MaxNPDULength is the maximum length of a npdu sent in a frame
+const MaxNPDULength = maxLength - 3
+
+// Frame is a BACnet/Ethernet frame
+type Frame struct {
+	Destination net.HardwareAddr
+	Source      net.HardwareAddr
+	NPDU        []byte
+}
+
+// ErrNotBACnet is returned when decoding a frame which isn't a BACnet
+// LLC frame
+var ErrNotBACnet = errors.New("not a BACnet/Ethernet frame")
+
+func (f Frame) MarshalBinary() ([]byte, error) {
+	if len(f.Destination) != macLength || len(f.Source) != macLength {
+		return nil, fmt.Errorf("invalid MAC addresses %v -> %v", f.Source, f.Destination)
+	}
+	if len(f.NPDU) > MaxNPDULength {
+		return nil, fmt.Errorf("npdu too long: %d bytes", len(f.NPDU))
+	}
+	b := make([]byte, 0, headerLength+len(f.NPDU))
+	b = append(b, f.Destination...)
+	b = append(b, f.Source...)
+	b = binary.BigEndian.AppendUint16(b, uint16(3+len(f.NPDU)))
+	b = append(b, llcDSAP, llcSSAP, llcControl)
+	b = append(b, f.NPDU...)
+	for len(b) < minFrameLength {
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	if len(data) < headerLength {
+		return fmt.Errorf("frame too short: %d bytes", len(data))
+	}
+	length := int(binary.BigEndian.Uint16(data[12:]))
+	if length > maxLength || length < 3 {
+		return ErrNotBACnet
+	}
+	if data[14] != llcDSAP || data[15] != llcSSAP || data[16] != llcControl {
+		return ErrNotBACnet
+	}
+	if 14+length > len(data) {
+		return fmt.Errorf("frame truncated: length %d, %d bytes", length, len(data)-14)
+	}
+	f.Destination = append(net.HardwareAddr{}, data[:6]...)
+	f.Source = append(net.HardwareAddr{}, data[6:12]...)
+	// The padding is removed
+	f.NPDU = append([]byte{}, data[headerLength:14+length]...)
+	return nil
+}
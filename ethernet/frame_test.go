@@ -0,0 +1,60 @@
+package ethernet
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestFrameCoherency(t *testing.T) {
+	ttc := []struct {
+		name  string
+		data  string //hex string
+		frame Frame
+	}{
+		{
+			name: "padded",
+			data: "ffffffffffff020000000001" + "000c828203" + "01201000ffff001008" + strings.Repeat("00", 34),
+			frame: Frame{
+				Destination: BroadcastMAC,
+				Source:      net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+				NPDU:        []byte{0x01, 0x20, 0x10, 0x00, 0xff, 0xff, 0x00, 0x10, 0x08},
+			},
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			data, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var f Frame
+			is.NoErr(f.UnmarshalBinary(data))
+			is.Equal(f, tc.frame)
+			b, err := tc.frame.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(hex.EncodeToString(b), tc.data)
+		})
+	}
+}
+
+func TestFrameNotBACnet(t *testing.T) {
+	ttc := []struct {
+		name string
+		data string //hex string
+	}{
+		{name: "ethertype", data: "ffffffffffff020000000001" + "0800" + "450000"},
+		{name: "other sap", data: "ffffffffffff020000000001" + "0004" + "424203" + "00"},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			data, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var f Frame
+			is.Equal(f.UnmarshalBinary(data), ErrNotBACnet)
+		})
+	}
+}
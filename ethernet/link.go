@@ -0,0 +1,159 @@
+package ethernet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/REQUEA/bacnet/bacip"
+)
+
+// Addr is the address of an Ethernet station, the destination given
+// to the WriteTo of the packet conn
+type Addr struct {
+	HardwareAddr net.HardwareAddr
+}
+
+func (a *Addr) Network() string {
+	return "ethernet"
+}
+
+func (a *Addr) String() string {
+	return a.HardwareAddr.String()
+}
+
+// Link is a BACnet/Ethernet data link on a packet conn, such as an
+// AF_PACKET socket. The packet conn reads and writes whole frames,
+// including their 8802-3 header. Its local address is the MAC address
+// of the link and it accepts *Addr destinations.
+type Link struct {
+	conn      net.PacketConn
+	mac       net.HardwareAddr
+	logger    bacip.Logger
+	incoming  chan received
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type received struct {
+	npdu []byte
+	mac  []byte
+}
+
+// NewLink starts a BACnet/Ethernet data link on the packet conn
+func NewLink(conn net.PacketConn, logger bacip.Logger) (*Link, error) {
+	mac, err := net.ParseMAC(conn.LocalAddr().String())
+	if err != nil {
+		return nil, fmt.Errorf("local address: %w", err)
+	}
+	if len(mac) != macLength {
+		return nil, fmt.Errorf("invalid MAC address %v", mac)
+	}
+	l := &Link{
+		conn:     conn,
+		mac:      mac,
+		logger:   logger,
+		incoming: make(chan received),
+		closed:   make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.listen()
+	return l, nil
+}
+
+// MAC returns the MAC address of the link
+func (l *Link) MAC() net.HardwareAddr {
+	return l.mac
+}
+
+// MaxAPDU returns the maximum APDU length of BACnet/Ethernet
+func (l *Link) MaxAPDU() uint {
+	return 1476
+}
+
+// Close closes the link and its packet conn
+func (l *Link) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+		l.wg.Wait()
+	})
+	return err
+}
+
+// Send sends the npdu to the station with the MAC address mac
+func (l *Link) Send(mac []byte, npdu []byte) error {
+	if len(mac) != macLength {
+		return fmt.Errorf("invalid BACnet/Ethernet MAC address %x", mac)
+	}
+	return l.write(net.HardwareAddr(mac), npdu)
+}
+
+// Broadcast sends the npdu to all the stations of the network
+func (l *Link) Broadcast(npdu []byte) error {
+	return l.write(BroadcastMAC, npdu)
+}
+
+func (l *Link) write(dst net.HardwareAddr, npdu []byte) error {
+	data, err := Frame{Destination: dst, Source: l.mac, NPDU: npdu}.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = l.conn.WriteTo(data, &Addr{HardwareAddr: dst})
+	return err
+}
+
+// Receive returns the next npdu and the MAC address of its sender
+func (l *Link) Receive() ([]byte, []byte, error) {
+	select {
+	case r := <-l.incoming:
+		return r.npdu, r.mac, nil
+	case <-l.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (l *Link) listen() {
+	defer l.wg.Done()
+	b := make([]byte, 2048)
+	for {
+		i, _, err := l.conn.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.logger.Error(err.Error())
+			continue
+		}
+		var f Frame
+		err = f.UnmarshalBinary(b[:i])
+		if errors.Is(err, ErrNotBACnet) {
+			continue
+		}
+		if err != nil {
+			l.logger.Error("decode ethernet frame: ", err)
+			continue
+		}
+		if bytes.Equal(f.Source, l.mac) {
+			// Our own frame
+			continue
+		}
+		if !bytes.Equal(f.Destination, l.mac) && !bytes.Equal(f.Destination, BroadcastMAC) {
+			continue
+		}
+		select {
+		case l.incoming <- received{npdu: f.NPDU, mac: f.Source}:
+		case <-l.closed:
+			return
+		}
+	}
+}
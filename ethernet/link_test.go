@@ -0,0 +1,169 @@
+package ethernet
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+
+	"github.com/matryer/is"
+)
+
+// segment is an in-memory Ethernet segment: the frames written by a
+// station are received by all the other stations
+type segment struct {
+	mutex sync.Mutex
+	conns []*frameConn
+}
+
+// frameConn is the packet conn of a station of the segment
+type frameConn struct {
+	segment   *segment
+	addr      *Addr
+	frames    chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *segment) conn(mac net.HardwareAddr) *frameConn {
+	c := &frameConn{
+		segment: s,
+		addr:    &Addr{HardwareAddr: mac},
+		frames:  make(chan []byte, 64),
+		closed:  make(chan struct{}),
+	}
+	s.mutex.Lock()
+	s.conns = append(s.conns, c)
+	s.mutex.Unlock()
+	return c
+}
+
+func (c *frameConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case frame := <-c.frames:
+		var f Frame
+		_ = f.UnmarshalBinary(frame)
+		return copy(b, frame), &Addr{HardwareAddr: f.Source}, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *frameConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.segment.mutex.Lock()
+	defer c.segment.mutex.Unlock()
+	for _, other := range c.segment.conns {
+		if other == c {
+			continue
+		}
+		select {
+		case other.frames <- append([]byte{}, b...):
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (c *frameConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *frameConn) LocalAddr() net.Addr                { return c.addr }
+func (c *frameConn) SetDeadline(t time.Time) error      { return nil }
+func (c *frameConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *frameConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTestLink(t *testing.T, s *segment, mac net.HardwareAddr) *Link {
+	t.Helper()
+	l, err := NewLink(s.conn(mac), bacip.NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func receiveNPDU(t *testing.T, l *Link) ([]byte, []byte) {
+	t.Helper()
+	type result struct{ npdu, mac []byte }
+	ch := make(chan result, 1)
+	go func() {
+		npdu, mac, err := l.Receive()
+		if err == nil {
+			ch <- result{npdu, mac}
+		}
+	}()
+	select {
+	case r := <-ch:
+		return r.npdu, r.mac
+	case <-time.After(time.Second):
+		t.Fatal("no npdu received")
+		return nil, nil
+	}
+}
+
+func TestLink(t *testing.T) {
+	is := is.New(t)
+	s := &segment{}
+	a := newTestLink(t, s, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a})
+	b := newTestLink(t, s, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b})
+	c := newTestLink(t, s, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0c})
+
+	// The unicast frame for c is dropped by b
+	is.NoErr(a.Send(c.MAC(), []byte{0x01, 0x00, 0x01}))
+	is.NoErr(a.Send(b.MAC(), []byte{0x01, 0x00, 0x02}))
+	npdu, mac := receiveNPDU(t, b)
+	is.Equal(npdu, []byte{0x01, 0x00, 0x02})
+	is.Equal(mac, []byte(a.MAC()))
+	npdu, _ = receiveNPDU(t, c)
+	is.Equal(npdu, []byte{0x01, 0x00, 0x01})
+
+	is.NoErr(b.Broadcast([]byte{0x01, 0x00, 0x03}))
+	for _, l := range []*Link{a, c} {
+		npdu, mac := receiveNPDU(t, l)
+		is.Equal(npdu, []byte{0x01, 0x00, 0x03})
+		is.Equal(mac, []byte(b.MAC()))
+	}
+}
+
+func TestClientOverEthernet(t *testing.T) {
+	is := is.New(t)
+	s := &segment{}
+	device := newTestLink(t, s, net.HardwareAddr{0x02, 0, 0, 0, 0x04, 0xd2})
+	go func() {
+		ack, _ := hex.DecodeString("0c00401fb919753e91623f")
+		for {
+			data, mac, err := device.Receive()
+			if err != nil {
+				return
+			}
+			var req bacip.NPDU
+			if req.UnmarshallBinary(data) != nil || req.ADPU == nil || req.ADPU.ServiceType != bacip.ServiceConfirmedReadProperty {
+				continue
+			}
+			b, _ := bacip.NPDU{Version: bacip.Version1, ADPU: &bacip.APDU{
+				DataType:    bacip.ComplexAck,
+				ServiceType: bacip.ServiceConfirmedReadProperty,
+				InvokeID:    req.ADPU.InvokeID,
+				Payload:     &bacip.DataPayload{Bytes: ack},
+			}}.MarshalBinary()
+			_ = device.Send(mac, b)
+		}
+	}()
+	c := bacip.NewClientWithDataLink(newTestLink(t, s, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}), bacip.NoOpLogger{})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, bacnet.Device{Addr: bacnet.Address{Mac: device.MAC()}}, bacip.ReadProperty{
+		ObjectID: bacnet.ObjectID{Type: bacnet.AnalogOutput, Instance: 8121},
+		Property: bacnet.PropertyIdentifier{Type: bacnet.Units},
+	})
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+}
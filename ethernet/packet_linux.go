@@ -0,0 +1,121 @@
+//go:build linux
+
+package ethernet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ethP8022 is the protocol of the AF_PACKET sockets receiving the
+// 8802-2 LLC frames
+const ethP8022 = 0x0004
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// packetConn is an AF_PACKET socket bound to a network interface
+type packetConn struct {
+	file    *os.File
+	raw     syscall.RawConn
+	ifindex int
+	addr    *Addr
+}
+
+// ListenPacket opens an AF_PACKET socket receiving the LLC frames of
+// the network interface, to be used by a Link. It needs the
+// CAP_NET_RAW capability.
+func ListenPacket(ifname string) (net.PacketConn, error) {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(htons(ethP8022)))
+	if err != nil {
+		return nil, fmt.Errorf("packet socket: %w", err)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethP8022), Ifindex: ifi.Index})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("bind to %s: %w", ifname, err)
+	}
+	// The non-blocking socket is handled by the runtime poller
+	file := os.NewFile(uintptr(fd), "packet:"+ifname)
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &packetConn{
+		file:    file,
+		raw:     raw,
+		ifindex: ifi.Index,
+		addr:    &Addr{HardwareAddr: ifi.HardwareAddr},
+	}, nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var n int
+	var from syscall.Sockaddr
+	var opErr error
+	err := c.raw.Read(func(fd uintptr) bool {
+		n, from, opErr = syscall.Recvfrom(int(fd), b, 0)
+		return opErr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = opErr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	addr := &Addr{}
+	if sa, ok := from.(*syscall.SockaddrLinklayer); ok {
+		addr.HardwareAddr = append(net.HardwareAddr{}, sa.Addr[:sa.Halen]...)
+	}
+	return n, addr, nil
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*Addr)
+	if !ok || len(a.HardwareAddr) > 8 {
+		return 0, fmt.Errorf("invalid ethernet address %v", addr)
+	}
+	sa := &syscall.SockaddrLinklayer{Ifindex: c.ifindex, Halen: uint8(len(a.HardwareAddr))}
+	copy(sa.Addr[:], a.HardwareAddr)
+	var opErr error
+	err := c.raw.Write(func(fd uintptr) bool {
+		opErr = syscall.Sendto(int(fd), b, 0, sa)
+		return opErr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = opErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	return c.file.Close()
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.file.SetDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return c.file.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return c.file.SetWriteDeadline(t)
+}
@@ -0,0 +1,31 @@
+package ethernet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestPacketConn(t *testing.T) {
+	is := is.New(t)
+	conn, err := ListenPacket("lo")
+	if err != nil {
+		t.Skip("no packet socket: ", err)
+	}
+	defer conn.Close()
+	dst := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+	data, err := Frame{Destination: dst, Source: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}, NPDU: []byte{0x01, 0x00}}.MarshalBinary()
+	is.NoErr(err)
+	_, err = conn.WriteTo(data, &Addr{HardwareAddr: dst})
+	is.NoErr(err)
+	// The frame sent on the loopback is received
+	is.NoErr(conn.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	is.NoErr(err)
+	var f Frame
+	is.NoErr(f.UnmarshalBinary(b[:n]))
+	is.Equal(f.NPDU, []byte{0x01, 0x00})
+}
@@ -107,6 +107,42 @@ func (d *Decoder) ContextObjectID(expectedTagID byte, objectID *bacnet.ObjectID)
 	*objectID = bacnet.ObjectIDFromUint32(val)
 }
 
+// ContextCharacterString read a (context)tag / value pair where the
+// value type is an UTF-8 character string
+// If ErrorIncorrectTag is set, the internal buffer cursor is ready to read again the same tag.
+func (d *Decoder) ContextCharacterString(expectedTagID byte, s *string) {
+	if d.err != nil {
+		return
+	}
+	length, t, err := decodeTag(d.buf)
+	if err != nil {
+		d.err = err
+		return
+	}
+	if t.ID != expectedTagID {
+		d.err = ErrorIncorrectTagID{Expected: expectedTagID, Got: t.ID}
+		err := d.unread(length)
+		if err != nil {
+			d.err = err
+		}
+		return
+	}
+	if !t.Context {
+		d.err = errors.New("tag isn't contextual")
+		return
+	}
+	if t.Value == 0 || int(t.Value) > d.buf.Len() {
+		d.err = fmt.Errorf("decode string: invalid length %d", t.Value)
+		return
+	}
+	sEncoding, _ := d.buf.ReadByte()
+	if sEncoding != utf8Encoding {
+		d.err = fmt.Errorf("unsuported strign encoding: 0x%x", sEncoding)
+		return
+	}
+	*s = string(d.buf.Next(int(t.Value) - 1))
+}
+
 type AppDataTypeMismatch struct {
 	wanted string
 	got    reflect.Type
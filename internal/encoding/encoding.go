@@ -71,6 +71,22 @@ func (e *Encoder) ContextObjectID(tabNumber byte, objectID bacnet.ObjectID) {
 	_ = binary.Write(e.buf, binary.BigEndian, v)
 }
 
+// ContextCharacterString write a (context)tag / value pair where the
+// value type is an UTF-8 character string
+func (e *Encoder) ContextCharacterString(tabNumber byte, value string) {
+	if e.err != nil {
+		return
+	}
+	t := tag{
+		ID:      tabNumber,
+		Context: true,
+		Value:   uint32(len(value) + 1),
+	}
+	encodeTag(e.buf, t)
+	_ = e.buf.WriteByte(utf8Encoding)
+	_, _ = e.buf.WriteString(value)
+}
+
 // AppData writes a tag and value of any standard bacnet application
 // data type. Returns an error if v if of a invalid type
 func (e *Encoder) AppData(v any) {
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// newEchoServer returns the ws URL of a server sending back the
+// messages it receives
+func newEchoServer(t *testing.T, subprotocols ...string) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, subprotocols...)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if conn.WriteMessage(msg) != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func TestEcho(t *testing.T) {
+	is := is.New(t)
+	url := newEchoServer(t, "hub.bsc.bacnet.org")
+	conn, err := Dial(context.Background(), url, nil, "hub.bsc.bacnet.org")
+	is.NoErr(err)
+	defer conn.Close()
+	is.Equal(conn.Subprotocol(), "hub.bsc.bacnet.org")
+	for _, size := range []int{0, 10, 300, 65000} {
+		msg := bytes.Repeat([]byte{0xba}, size)
+		is.NoErr(conn.WriteMessage(msg))
+		answer, err := conn.ReadMessage()
+		is.NoErr(err)
+		is.Equal(answer, msg)
+	}
+	// The server answers the pings while the client waits for a message
+	is.NoErr(conn.writeFrame(opPing, []byte("ping")))
+	is.NoErr(conn.WriteMessage([]byte{0x01}))
+	answer, err := conn.ReadMessage()
+	is.NoErr(err)
+	is.Equal(answer, []byte{0x01})
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	is := is.New(t)
+	url := newEchoServer(t)
+	conn, err := Dial(context.Background(), url, nil)
+	is.NoErr(err)
+	defer conn.Close()
+	// Frames written by hand: binary without FIN, then the final
+	// continuation
+	is.NoErr(conn.writeFragment(opBinary, false, []byte{0x01, 0x02}))
+	is.NoErr(conn.writeFragment(opContinuation, true, []byte{0x03}))
+	answer, err := conn.ReadMessage()
+	is.NoErr(err)
+	is.Equal(answer, []byte{0x01, 0x02, 0x03})
+}
+
+func TestClose(t *testing.T) {
+	is := is.New(t)
+	url := newEchoServer(t)
+	conn, err := Dial(context.Background(), url, nil)
+	is.NoErr(err)
+	is.NoErr(conn.writeFrame(opClose, nil))
+	_, err = conn.ReadMessage()
+	is.True(errors.Is(err, ErrClosed))
+}
+
+func TestSubprotocolMismatch(t *testing.T) {
+	is := is.New(t)
+	url := newEchoServer(t, "hub.bsc.bacnet.org")
+	_, err := Dial(context.Background(), url, nil, "dc.bsc.bacnet.org")
+	is.True(err != nil) // the server refuses the handshake
+}
+
+func (c *Conn) writeFragment(opcode byte, fin bool, payload []byte) error {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	frame = append(frame, payload...)
+	_, err := c.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,219 @@
+// Package mstp implements the BACnet MS/TP data link (Clause 9): the
+// master-slave/token-passing protocol of the RS-485 trunks.
+package mstp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FrameType is the type of a MS/TP frame
+type FrameType byte
+
+const (
+	FrameToken                       FrameType = 0x00
+	FramePollForMaster               FrameType = 0x01
+	FrameReplyToPollForMaster        FrameType = 0x02
+	FrameTestRequest                 FrameType = 0x03
+	FrameTestResponse                FrameType = 0x04
+	FrameBACnetDataExpectingReply    FrameType = 0x05
+	FrameBACnetDataNotExpectingReply FrameType = 0x06
+	FrameReplyPostponed              FrameType = 0x07
+)
+
+var frameTypeNames = map[FrameType]string{
+	FrameToken:                       "Token",
+	FramePollForMaster:               "Poll-For-Master",
+	FrameReplyToPollForMaster:        "Reply-To-Poll-For-Master",
+	FrameTestRequest:                 "Test-Request",
+	FrameTestResponse:                "Test-Response",
+	FrameBACnetDataExpectingReply:    "BACnet-Data-Expecting-Reply",
+	FrameBACnetDataNotExpectingReply: "BACnet-Data-Not-Expecting-Reply",
+	FrameReplyPostponed:              "Reply-Postponed",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("FrameType(0x%02x)", byte(t))
+}
+
+// BroadcastMAC is the destination of the broadcast frames
+const BroadcastMAC byte = 0xff
+
+// MaxDataLength is the maximum length of the data of a frame
+const MaxDataLength = 501
+
+// The two octets starting each frame
+const (
+	preamble1 = 0x55
+	preamble2 = 0xff
+)
+
+// Frame is a MS/TP frame
+type Frame struct {
+	Type        FrameType
+	Destination byte
+	Source      byte
+	// Data is the npdu of the BACnet data frames, the test data of
+	// the test frames
+	Data []byte
+}
+
+func (f Frame) MarshalBinary() ([]byte, error) {
+	if len(f.Data) > MaxDataLength {
+		return nil, fmt.Errorf("frame data too long: %d bytes", len(f.Data))
+	}
+	b := []byte{preamble1, preamble2, byte(f.Type), f.Destination, f.Source}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.Data)))
+	crc := byte(0xff)
+	for _, v := range b[2:] {
+		crc = headerCRC(v, crc)
+	}
+	b = append(b, ^crc)
+	if len(f.Data) == 0 {
+		return b, nil
+	}
+	dataCRC := uint16(0xffff)
+	for _, v := range f.Data {
+		dataCRC = dataCRC16(v, dataCRC)
+	}
+	b = append(b, f.Data...)
+	// The data CRC is sent least significant octet first
+	return binary.LittleEndian.AppendUint16(b, ^dataCRC), nil
+}
+
+// ErrInvalidFrame is returned when decoding a frame with a wrong CRC
+var ErrInvalidFrame = errors.New("invalid ms/tp frame")
+
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	var d decoder
+	for i, b := range data {
+		frame, event := d.decode(b)
+		switch event {
+		case frameInvalid:
+			return ErrInvalidFrame
+		case frameValid:
+			if i != len(data)-1 {
+				return fmt.Errorf("%d bytes after the frame", len(data)-1-i)
+			}
+			*f = frame
+			return nil
+		}
+	}
+	return ErrInvalidFrame
+}
+
+// headerCRC accumulates the octet in the header CRC (Annex G.1)
+func headerCRC(octet byte, crc byte) byte {
+	v := uint16(crc ^ octet)
+	v = v ^ (v << 1) ^ (v << 2) ^ (v << 3) ^ (v << 4) ^ (v << 5) ^ (v << 6) ^ (v << 7)
+	return byte(v&0xfe) ^ byte(v>>8&1)
+}
+
+// dataCRC16 accumulates the octet in the data CRC (Annex G.2)
+func dataCRC16(octet byte, crc uint16) uint16 {
+	low := (crc & 0xff) ^ uint16(octet)
+	return (crc >> 8) ^ (low << 8) ^ (low << 3) ^ (low << 12) ^ (low >> 4) ^ (low & 0x0f) ^ ((low & 0x0f) << 7)
+}
+
+// The remainders of the CRCs of a valid frame, including the CRC octets
+const (
+	headerCRCRemainder = 0x55
+	dataCRCRemainder   = 0xf0b8
+)
+
+// decoderEvent is the result of the decoding of an octet
+type decoderEvent int
+
+const (
+	frameIncomplete decoderEvent = iota
+	frameValid
+	frameInvalid
+)
+
+// decoder is the receive frame state machine. It decodes the frames
+// from the octets received.
+type decoder struct {
+	state  int
+	header [6]byte
+	index  int
+	frame  Frame
+	length int
+	crc    uint16
+}
+
+const (
+	statePreamble1 = iota
+	statePreamble2
+	stateHeader
+	stateData
+)
+
+// reset waits for the preamble of the next frame, after a gap between
+// the octets of a frame
+func (d *decoder) reset() {
+	d.state = statePreamble1
+}
+
+func (d *decoder) decode(b byte) (Frame, decoderEvent) {
+	switch d.state {
+	case statePreamble1:
+		if b == preamble1 {
+			d.state = statePreamble2
+		}
+	case statePreamble2:
+		switch b {
+		case preamble2:
+			d.state = stateHeader
+			d.index = 0
+		case preamble1:
+		default:
+			d.state = statePreamble1
+		}
+	case stateHeader:
+		d.header[d.index] = b
+		d.index++
+		if d.index < len(d.header) {
+			return Frame{}, frameIncomplete
+		}
+		d.state = statePreamble1
+		crc := byte(0xff)
+		for _, v := range d.header {
+			crc = headerCRC(v, crc)
+		}
+		if crc != headerCRCRemainder {
+			return Frame{}, frameInvalid
+		}
+		d.frame = Frame{
+			Type:        FrameType(d.header[0]),
+			Destination: d.header[1],
+			Source:      d.header[2],
+		}
+		d.length = int(binary.BigEndian.Uint16(d.header[3:]))
+		if d.length == 0 {
+			return d.frame, frameValid
+		}
+		if d.length > MaxDataLength {
+			return Frame{}, frameInvalid
+		}
+		d.frame.Data = make([]byte, 0, d.length+2)
+		d.crc = 0xffff
+		d.state = stateData
+	case stateData:
+		d.frame.Data = append(d.frame.Data, b)
+		d.crc = dataCRC16(b, d.crc)
+		if len(d.frame.Data) < d.length+2 {
+			return Frame{}, frameIncomplete
+		}
+		d.state = statePreamble1
+		if d.crc != dataCRCRemainder {
+			return Frame{}, frameInvalid
+		}
+		d.frame.Data = d.frame.Data[:d.length]
+		return d.frame, frameValid
+	}
+	return Frame{}, frameIncomplete
+}
@@ -0,0 +1,95 @@
+package mstp
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestFrameCoherency(t *testing.T) {
+	ttc := []struct {
+		name  string
+		data  string //hex string
+		frame Frame
+	}{
+		{
+			name:  "Token",
+			data:  "55ff00100500008c",
+			frame: Frame{Type: FrameToken, Destination: 0x10, Source: 0x05},
+		},
+		{
+			name:  "Poll-For-Master",
+			data:  "55ff0106050000b1",
+			frame: Frame{Type: FramePollForMaster, Destination: 0x06, Source: 0x05},
+		},
+		{
+			name: "BACnet-Data-Not-Expecting-Reply",
+			data: "55ff06100500039c01223010bd",
+			frame: Frame{
+				Type:        FrameBACnetDataNotExpectingReply,
+				Destination: 0x10,
+				Source:      0x05,
+				Data:        []byte{0x01, 0x22, 0x30},
+			},
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			data, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var f Frame
+			is.NoErr(f.UnmarshalBinary(data))
+			is.Equal(f, tc.frame)
+			b, err := tc.frame.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(hex.EncodeToString(b), tc.data)
+		})
+	}
+}
+
+func TestFrameInvalid(t *testing.T) {
+	ttc := []struct {
+		name string
+		data string //hex string
+	}{
+		{name: "header crc", data: "55ff00100500008d"},
+		{name: "data crc", data: "55ff06100500039c01223010be"},
+		{name: "truncated", data: "55ff06100500039c012230"},
+		{name: "too long", data: "55ff061005fffffb"},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			data, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var f Frame
+			is.Equal(f.UnmarshalBinary(data), ErrInvalidFrame)
+		})
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	is := is.New(t)
+	// Noise, a frame with a bad header, a repeated preamble octet and
+	// two valid frames
+	data, err := hex.DecodeString("00ff55" + "55ff00100500008d" + "5555ff00100500008c" + "55ff06100500039c01223010bd")
+	is.NoErr(err)
+	var d decoder
+	var frames []Frame
+	invalid := 0
+	for _, b := range data {
+		f, event := d.decode(b)
+		switch event {
+		case frameValid:
+			frames = append(frames, f)
+		case frameInvalid:
+			invalid++
+		}
+	}
+	is.Equal(invalid, 1)
+	is.Equal(len(frames), 2)
+	is.Equal(frames[0].Type, FrameToken)
+	is.Equal(frames[1].Data, []byte{0x01, 0x22, 0x30})
+}
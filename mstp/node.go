@@ -0,0 +1,644 @@
+package mstp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/REQUEA/bacnet/bacip"
+)
+
+// Config is the configuration of a MS/TP node. The timing defaults are
+// the values of the standard.
+type Config struct {
+	// MAC is the address of the node on the trunk: 0 to 127 for a
+	// master node, 0 to 254 for a slave node
+	MAC byte
+	// Slave makes the node a slave node: it never holds the token and
+	// only answers the requests of the master nodes
+	Slave bool
+	// MaxMaster is the highest address of the master nodes polled.
+	// Default is 127.
+	MaxMaster byte
+	// MaxInfoFrames is the number of frames the node sends while it
+	// holds the token. Default is 1.
+	MaxInfoFrames int
+	// NoTokenTimeout is the silence after which the token is
+	// considered lost (Tno_token). Default is 500ms.
+	NoTokenTimeout time.Duration
+	// ReplyTimeout is the time waited for the reply to a request
+	// (Treply_timeout). Default is 255ms.
+	ReplyTimeout time.Duration
+	// ReplyDelay is the time waited for the upper layers to answer a
+	// request before postponing the reply (Treply_delay). Default is
+	// 250ms.
+	ReplyDelay time.Duration
+	// UsageTimeout is the time waited for the token passed or the poll
+	// for master to be used (Tusage_timeout). Default is 20ms.
+	UsageTimeout time.Duration
+	// SlotTime is the time reserved for each address to generate a
+	// lost token (Tslot). Default is 10ms.
+	SlotTime time.Duration
+	// FrameAbortTimeout is the silence between two octets which
+	// aborts the frame received (Tframe_abort). Default is 100ms.
+	FrameAbortTimeout time.Duration
+}
+
+// ErrSlaveNode is returned when a slave node sends a npdu which isn't
+// the reply to a request
+var ErrSlaveNode = errors.New("a slave node only answers requests")
+
+// The number of tokens between two polls for master (Npoll) and the
+// number of retries of a token pass (Nretry_token)
+const (
+	npoll       = 50
+	nretryToken = 1
+)
+
+// Node is a MS/TP node on an io.ReadWriter, such as a serial port. It
+// is a data link for the bacip client, the MAC addresses of the
+// devices being their one octet address.
+type Node struct {
+	port      io.ReadWriter
+	config    Config
+	logger    bacip.Logger
+	frames    chan rx
+	lastOctet atomic.Int64
+	mutex     sync.Mutex
+	queue     []Frame
+	queued    chan struct{}
+	// answering is the source of the request waiting for a reply, -1
+	// if none
+	answering   int
+	nextStation atomic.Uint32
+	incoming    chan received
+	closed      chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+}
+
+// rx is a frame received, the zero value of Frame if it is invalid
+type rx struct {
+	frame Frame
+	valid bool
+}
+
+type received struct {
+	npdu []byte
+	mac  []byte
+}
+
+// NewNode starts a MS/TP node on the port. A master node takes part
+// in the token passing, a slave node only answers the requests.
+func NewNode(port io.ReadWriter, config Config, logger bacip.Logger) (*Node, error) {
+	if config.MAC == BroadcastMAC || !config.Slave && config.MAC > 127 {
+		return nil, fmt.Errorf("invalid MS/TP address %d", config.MAC)
+	}
+	if config.MaxMaster == 0 {
+		config.MaxMaster = 127
+	}
+	if config.MaxMaster > 127 || !config.Slave && config.MAC > config.MaxMaster {
+		return nil, fmt.Errorf("invalid max master %d", config.MaxMaster)
+	}
+	if config.MaxInfoFrames == 0 {
+		config.MaxInfoFrames = 1
+	}
+	if config.NoTokenTimeout == 0 {
+		config.NoTokenTimeout = 500 * time.Millisecond
+	}
+	if config.ReplyTimeout == 0 {
+		config.ReplyTimeout = 255 * time.Millisecond
+	}
+	if config.ReplyDelay == 0 {
+		config.ReplyDelay = 250 * time.Millisecond
+	}
+	if config.UsageTimeout == 0 {
+		config.UsageTimeout = 20 * time.Millisecond
+	}
+	if config.SlotTime == 0 {
+		config.SlotTime = 10 * time.Millisecond
+	}
+	if config.FrameAbortTimeout == 0 {
+		config.FrameAbortTimeout = 100 * time.Millisecond
+	}
+	n := &Node{
+		port:      port,
+		config:    config,
+		logger:    logger,
+		frames:    make(chan rx, 16),
+		queued:    make(chan struct{}, 1),
+		answering: -1,
+		incoming:  make(chan received, 32),
+		closed:    make(chan struct{}),
+	}
+	n.nextStation.Store(uint32(config.MAC))
+	n.lastOctet.Store(time.Now().UnixNano())
+	// The receiver isn't waited for by Close: it returns when the
+	// port is closed
+	go n.receive()
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if config.Slave {
+			n.runSlave()
+		} else {
+			n.runMaster()
+		}
+	}()
+	return n, nil
+}
+
+// MAC returns the address of the node
+func (n *Node) MAC() byte {
+	return n.config.MAC
+}
+
+// MaxAPDU returns the maximum APDU length of MS/TP
+func (n *Node) MaxAPDU() uint {
+	return 480
+}
+
+// Close stops the node, and closes the port if it is an io.Closer
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		if closer, ok := n.port.(io.Closer); ok {
+			err = closer.Close()
+		}
+		n.wg.Wait()
+	})
+	return err
+}
+
+// Send queues the npdu for the node with the address mac. It is sent
+// when the node holds the token, or as reply to the request of this
+// node.
+func (n *Node) Send(mac []byte, npdu []byte) error {
+	if len(mac) != 1 || mac[0] == BroadcastMAC {
+		return fmt.Errorf("invalid MS/TP MAC address %x", mac)
+	}
+	frameType := FrameBACnetDataNotExpectingReply
+	if len(npdu) > 1 && npdu[1]&0x04 != 0 {
+		frameType = FrameBACnetDataExpectingReply
+	}
+	return n.enqueue(Frame{Type: frameType, Destination: mac[0], Data: npdu})
+}
+
+// Broadcast queues the npdu for all the nodes of the trunk
+func (n *Node) Broadcast(npdu []byte) error {
+	return n.enqueue(Frame{Type: FrameBACnetDataNotExpectingReply, Destination: BroadcastMAC, Data: npdu})
+}
+
+func (n *Node) enqueue(f Frame) error {
+	if len(f.Data) > MaxDataLength {
+		return fmt.Errorf("npdu too long: %d bytes", len(f.Data))
+	}
+	f.Source = n.config.MAC
+	n.mutex.Lock()
+	if n.config.Slave && n.answering != int(f.Destination) {
+		n.mutex.Unlock()
+		return ErrSlaveNode
+	}
+	n.queue = append(n.queue, f)
+	n.mutex.Unlock()
+	select {
+	case n.queued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dequeue returns the next frame to send
+func (n *Node) dequeue() (Frame, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if len(n.queue) == 0 {
+		return Frame{}, false
+	}
+	f := n.queue[0]
+	n.queue = n.queue[1:]
+	return f, true
+}
+
+func (n *Node) hasQueued() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.queue) > 0
+}
+
+// Receive returns the next npdu and the address of its sender
+func (n *Node) Receive() ([]byte, []byte, error) {
+	select {
+	case r := <-n.incoming:
+		return r.npdu, r.mac, nil
+	case <-n.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+// receive decodes the frames received on the port
+func (n *Node) receive() {
+	r := bufio.NewReader(n.port)
+	var d decoder
+	last := time.Now()
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			select {
+			case <-n.closed:
+			default:
+				n.logger.Error("ms/tp port: ", err)
+			}
+			return
+		}
+		now := time.Now()
+		if now.Sub(last) > n.config.FrameAbortTimeout {
+			d.reset()
+		}
+		last = now
+		n.lastOctet.Store(now.UnixNano())
+		frame, event := d.decode(b)
+		if event == frameIncomplete {
+			continue
+		}
+		select {
+		case n.frames <- rx{frame: frame, valid: event == frameValid}:
+		case <-n.closed:
+			return
+		}
+	}
+}
+
+func (n *Node) send(f Frame) {
+	b, err := f.MarshalBinary()
+	if err == nil {
+		_, err = n.port.Write(b)
+	}
+	n.lastOctet.Store(time.Now().UnixNano())
+	if err != nil {
+		n.logger.Error(fmt.Sprintf("send %v to %d: %v", f.Type, f.Destination, err))
+	}
+}
+
+// silence returns the time since the last octet received or sent
+func (n *Node) silence() time.Duration {
+	return time.Since(time.Unix(0, n.lastOctet.Load()))
+}
+
+// wait returns the next frame received, or false when the silence
+// reaches the timeout or the node is closed
+func (n *Node) wait(timeout time.Duration) (rx, bool) {
+	for {
+		remaining := timeout - n.silence()
+		if remaining <= 0 {
+			return rx{}, false
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case r := <-n.frames:
+			timer.Stop()
+			return r, true
+		case <-timer.C:
+			// Octets may have been received since, the silence is
+			// checked again
+		case <-n.closed:
+			timer.Stop()
+			return rx{}, false
+		}
+	}
+}
+
+func (n *Node) isClosed() bool {
+	select {
+	case <-n.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver passes the npdu received to the upper layers
+func (n *Node) deliver(f Frame) {
+	select {
+	case n.incoming <- received{npdu: f.Data, mac: []byte{f.Source}}:
+	default:
+		n.logger.Error(fmt.Sprintf("npdu from %d dropped: receive queue full", f.Source))
+	}
+}
+
+// handleData handles the data and test frames received while idle. It
+// returns true when the upper layers have to answer the request.
+func (n *Node) handleData(f Frame) bool {
+	ts := n.config.MAC
+	switch f.Type {
+	case FrameBACnetDataNotExpectingReply:
+		n.deliver(f)
+	case FrameBACnetDataExpectingReply:
+		if f.Destination != ts {
+			n.deliver(f)
+			return false
+		}
+		n.mutex.Lock()
+		n.answering = int(f.Source)
+		n.mutex.Unlock()
+		n.deliver(f)
+		return true
+	case FrameTestRequest:
+		if f.Destination == ts {
+			n.send(Frame{Type: FrameTestResponse, Destination: f.Source, Source: ts, Data: f.Data})
+		}
+	}
+	return false
+}
+
+// answer sends the reply of the upper layers to the request. A master
+// node postpones the reply when it isn't ready in time, it is then
+// sent when the node holds the token.
+func (n *Node) answer(request Frame) {
+	defer func() {
+		n.mutex.Lock()
+		n.answering = -1
+		n.mutex.Unlock()
+	}()
+	timer := time.NewTimer(n.config.ReplyDelay)
+	defer timer.Stop()
+	for {
+		if reply, ok := n.takeReply(request.Source); ok {
+			n.send(reply)
+			return
+		}
+		select {
+		case <-n.queued:
+		case <-timer.C:
+			if !n.config.Slave {
+				n.send(Frame{Type: FrameReplyPostponed, Destination: request.Source, Source: n.config.MAC})
+			}
+			return
+		case <-n.closed:
+			return
+		}
+	}
+}
+
+// takeReply removes from the queue the first frame for the node
+func (n *Node) takeReply(dst byte) (Frame, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for i, f := range n.queue {
+		if f.Destination == dst {
+			n.queue = append(n.queue[:i], n.queue[i+1:]...)
+			return f, true
+		}
+	}
+	return Frame{}, false
+}
+
+// runSlave is the slave node state machine (Clause 9.5.7)
+func (n *Node) runSlave() {
+	for {
+		var r rx
+		select {
+		case r = <-n.frames:
+		case <-n.closed:
+			return
+		}
+		f := r.frame
+		if !r.valid || f.Destination != n.config.MAC && f.Destination != BroadcastMAC {
+			continue
+		}
+		if n.handleData(f) {
+			n.answer(f)
+		}
+	}
+}
+
+// The states of the master node state machine
+type masterState int
+
+const (
+	idle masterState = iota
+	useToken
+	waitForReply
+	doneWithToken
+	passToken
+	noToken
+	pollForMaster
+	answerDataRequest
+)
+
+// runMaster is the master node state machine (Clause 9.5.6)
+func (n *Node) runMaster() {
+	ts := n.config.MAC
+	next := func(a byte) byte {
+		return byte((int(a) + 1) % (int(n.config.MaxMaster) + 1))
+	}
+	ns, ps := ts, ts
+	tokenCount, frameCount, retryCount := npoll, 0, 0
+	soleMaster := false
+	// pending is a frame received in another state, handled when idle
+	var pending *rx
+	var request Frame
+	state := idle
+	sendToken := func() {
+		n.send(Frame{Type: FrameToken, Destination: ns, Source: ts})
+	}
+	sendPollForMaster := func() {
+		n.send(Frame{Type: FramePollForMaster, Destination: ps, Source: ts})
+	}
+	for !n.isClosed() {
+		n.nextStation.Store(uint32(ns))
+		switch state {
+		case idle:
+			var r rx
+			if pending != nil {
+				r, pending = *pending, nil
+			} else {
+				var ok bool
+				r, ok = n.wait(n.config.NoTokenTimeout)
+				if !ok {
+					state = noToken
+					continue
+				}
+			}
+			f := r.frame
+			if !r.valid || f.Destination != ts && f.Destination != BroadcastMAC {
+				continue
+			}
+			switch f.Type {
+			case FrameToken:
+				if f.Destination == ts {
+					frameCount = 0
+					soleMaster = false
+					state = useToken
+				}
+			case FramePollForMaster:
+				if f.Destination == ts {
+					n.send(Frame{Type: FrameReplyToPollForMaster, Destination: f.Source, Source: ts})
+				}
+			default:
+				if n.handleData(f) {
+					request = f
+					state = answerDataRequest
+				}
+			}
+
+		case answerDataRequest:
+			n.answer(request)
+			state = idle
+
+		case useToken:
+			f, ok := n.dequeue()
+			if !ok {
+				state = doneWithToken
+				continue
+			}
+			n.send(f)
+			frameCount++
+			if f.Type == FrameBACnetDataExpectingReply || f.Type == FrameTestRequest {
+				state = waitForReply
+			} else {
+				state = doneWithToken
+			}
+
+		case waitForReply:
+			r, ok := n.wait(n.config.ReplyTimeout)
+			state = doneWithToken
+			if !ok || !r.valid {
+				continue
+			}
+			f := r.frame
+			switch {
+			case f.Destination == ts && f.Type == FrameBACnetDataNotExpectingReply:
+				n.deliver(f)
+			case f.Destination == ts && (f.Type == FrameTestResponse || f.Type == FrameReplyPostponed):
+			default:
+				pending = &r
+				state = idle
+			}
+
+		case doneWithToken:
+			switch {
+			case frameCount < n.config.MaxInfoFrames && n.hasQueued():
+				state = useToken
+			case tokenCount < npoll-1 && soleMaster:
+				// No other master to pass the token to
+				frameCount = 0
+				tokenCount++
+				state = useToken
+			case tokenCount < npoll-1:
+				tokenCount++
+				retryCount = 0
+				sendToken()
+				state = passToken
+			case next(ps) != ns:
+				// Maintenance poll of the addresses up to the next
+				// station
+				ps = next(ps)
+				retryCount = 0
+				sendPollForMaster()
+				state = pollForMaster
+			case !soleMaster:
+				ps = ts
+				tokenCount = 1
+				retryCount = 0
+				sendToken()
+				state = passToken
+			default:
+				ps = next(ns)
+				ns = ts
+				tokenCount = 1
+				retryCount = 0
+				sendPollForMaster()
+				state = pollForMaster
+			}
+
+		case passToken:
+			r, ok := n.wait(n.config.UsageTimeout)
+			if ok {
+				// The token is used
+				pending = &r
+				state = idle
+				continue
+			}
+			if n.isClosed() {
+				return
+			}
+			if retryCount < nretryToken {
+				retryCount++
+				sendToken()
+				continue
+			}
+			// The next station is gone, a new successor is searched
+			ps = next(ns)
+			ns = ts
+			tokenCount = 0
+			retryCount = 0
+			sendPollForMaster()
+			state = pollForMaster
+
+		case noToken:
+			r, ok := n.wait(n.config.NoTokenTimeout + n.config.SlotTime*time.Duration(ts))
+			if ok {
+				pending = &r
+				state = idle
+				continue
+			}
+			if n.isClosed() {
+				return
+			}
+			// The token is lost, this node generates a new one
+			ps = next(ts)
+			ns = ts
+			tokenCount = 0
+			retryCount = 0
+			sendPollForMaster()
+			state = pollForMaster
+
+		case pollForMaster:
+			r, ok := n.wait(n.config.UsageTimeout)
+			if ok && r.valid {
+				f := r.frame
+				if f.Destination == ts && f.Type == FrameReplyToPollForMaster {
+					soleMaster = false
+					ns = f.Source
+					ps = ts
+					tokenCount = 0
+					retryCount = 0
+					sendToken()
+					state = passToken
+				} else {
+					pending = &r
+					state = idle
+				}
+				continue
+			}
+			if n.isClosed() {
+				return
+			}
+			switch {
+			case soleMaster:
+				frameCount = 0
+				state = useToken
+			case ns != ts:
+				retryCount = 0
+				sendToken()
+				state = passToken
+			case next(ps) != ts:
+				ps = next(ps)
+				retryCount = 0
+				sendPollForMaster()
+			default:
+				// No other master answered
+				soleMaster = true
+				frameCount = 0
+				state = useToken
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package mstp
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+
+	"github.com/matryer/is"
+)
+
+// bus is an in-memory RS-485 trunk: the octets written by a node are
+// received by all the other nodes
+type bus struct {
+	mutex sync.Mutex
+	ports []*port
+}
+
+type port struct {
+	bus       *bus
+	data      chan []byte
+	buf       []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (b *bus) port() *port {
+	p := &port{bus: b, data: make(chan []byte, 256), closed: make(chan struct{})}
+	b.mutex.Lock()
+	b.ports = append(b.ports, p)
+	b.mutex.Unlock()
+	return p
+}
+
+func (p *port) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 {
+		select {
+		case p.buf = <-p.data:
+		case <-p.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *port) Write(b []byte) (int, error) {
+	p.bus.mutex.Lock()
+	defer p.bus.mutex.Unlock()
+	for _, other := range p.bus.ports {
+		if other == p {
+			continue
+		}
+		select {
+		case other.data <- append([]byte{}, b...):
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (p *port) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func newTestNode(t *testing.T, b *bus, config Config) *Node {
+	t.Helper()
+	config.MaxMaster = 7
+	config.NoTokenTimeout = 100 * time.Millisecond
+	config.UsageTimeout = 30 * time.Millisecond
+	config.ReplyTimeout = 150 * time.Millisecond
+	config.ReplyDelay = 100 * time.Millisecond
+	config.SlotTime = 5 * time.Millisecond
+	n, err := NewNode(b.port(), config, bacip.NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// serveDevice answers the WhoIs and ReadProperty requests received by
+// the node
+func serveDevice(n *Node, instance uint32) {
+	ack, _ := hex.DecodeString("0c00401fb919753e91623f")
+	for {
+		data, mac, err := n.Receive()
+		if err != nil {
+			return
+		}
+		var req bacip.NPDU
+		if req.UnmarshallBinary(data) != nil || req.ADPU == nil {
+			continue
+		}
+		var answer bacip.NPDU
+		switch req.ADPU.ServiceType {
+		case bacip.ServiceUnconfirmedWhoIs:
+			answer = bacip.NPDU{Version: bacip.Version1, ADPU: &bacip.APDU{
+				DataType:    bacip.UnconfirmedServiceRequest,
+				ServiceType: bacip.ServiceUnconfirmedIAm,
+				Payload: &bacip.Iam{
+					ObjectID:      bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: bacnet.ObjectInstance(instance)},
+					MaxApduLength: 480,
+					VendorID:      260,
+				},
+			}}
+		case bacip.ServiceConfirmedReadProperty:
+			answer = bacip.NPDU{Version: bacip.Version1, ADPU: &bacip.APDU{
+				DataType:    bacip.ComplexAck,
+				ServiceType: bacip.ServiceConfirmedReadProperty,
+				InvokeID:    req.ADPU.InvokeID,
+				Payload:     &bacip.DataPayload{Bytes: ack},
+			}}
+		default:
+			continue
+		}
+		b, _ := answer.MarshalBinary()
+		_ = n.Send(mac, b)
+	}
+}
+
+func readUnits(t *testing.T, c *bacip.Client, device bacnet.Device) {
+	t.Helper()
+	is := is.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, device, bacip.ReadProperty{
+		ObjectID: bacnet.ObjectID{Type: bacnet.AnalogOutput, Instance: 8121},
+		Property: bacnet.PropertyIdentifier{Type: bacnet.Units},
+	})
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+}
+
+func TestTokenRing(t *testing.T) {
+	is := is.New(t)
+	b := &bus{}
+	nodes := []*Node{
+		newTestNode(t, b, Config{MAC: 1}),
+		newTestNode(t, b, Config{MAC: 2}),
+		newTestNode(t, b, Config{MAC: 5}),
+	}
+	expected := map[byte]byte{1: 2, 2: 5, 5: 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		found := 0
+		for _, n := range nodes {
+			if byte(n.nextStation.Load()) == expected[n.MAC()] {
+				found++
+			}
+		}
+		if found == len(nodes) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		is.Equal(byte(n.nextStation.Load()), expected[n.MAC()])
+	}
+}
+
+func TestClientOverMSTP(t *testing.T) {
+	is := is.New(t)
+	b := &bus{}
+	client := newTestNode(t, b, Config{MAC: 1})
+	go serveDevice(newTestNode(t, b, Config{MAC: 3}), 1234)
+	go serveDevice(newTestNode(t, b, Config{MAC: 6}), 5678)
+
+	c := bacip.NewClientWithDataLink(client, bacip.NoOpLogger{})
+	defer c.Close()
+	devices, err := c.WhoIs(bacip.WhoIs{}, time.Second)
+	is.NoErr(err)
+	is.Equal(len(devices), 2)
+	macs := map[byte]bool{}
+	for _, d := range devices {
+		macs[d.Addr.Mac[0]] = true
+		readUnits(t, c, d)
+	}
+	is.Equal(macs, map[byte]bool{3: true, 6: true})
+}
+
+func TestSlave(t *testing.T) {
+	is := is.New(t)
+	b := &bus{}
+	master := newTestNode(t, b, Config{MAC: 0})
+	slave := newTestNode(t, b, Config{MAC: 200, Slave: true})
+	go serveDevice(slave, 1234)
+	is.Equal(slave.Broadcast([]byte{0x01, 0x00}), ErrSlaveNode)
+	is.Equal(slave.Send([]byte{0}, []byte{0x01, 0x00}), ErrSlaveNode)
+
+	c := bacip.NewClientWithDataLink(master, bacip.NoOpLogger{})
+	defer c.Close()
+	readUnits(t, c, bacnet.Device{Addr: bacnet.Address{Mac: []byte{200}}})
+}
+
+func TestNodeConfig(t *testing.T) {
+	is := is.New(t)
+	b := &bus{}
+	_, err := NewNode(b.port(), Config{MAC: 128}, bacip.NoOpLogger{})
+	is.True(err != nil)
+	_, err = NewNode(b.port(), Config{MAC: BroadcastMAC, Slave: true}, bacip.NoOpLogger{})
+	is.True(err != nil)
+	_, err = NewNode(b.port(), Config{MAC: 10, MaxMaster: 5}, bacip.NoOpLogger{})
+	is.True(err != nil)
+}
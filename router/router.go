@@ -0,0 +1,583 @@
+// Package router implements a BACnet/IP to BACnet/IP router. It
+// connects two or more BACnet/IP ports, each one being a distinct
+// BACnet network, and forwards the NPDUs between them.
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+)
+
+// BusyTimeout is the time after which a network announced busy by a
+// downstream router is considered available again, if no
+// Router-Available-To-Network message has been received.
+const BusyTimeout = 30 * time.Second
+
+// PortConfig describes a BACnet/IP port of the router
+type PortConfig struct {
+	// Network is the network number of the port. It must be unique
+	// among the ports of the router
+	Network uint16
+	// Addr is the local address of the port. The port listens on all
+	// the addresses with its UDP port, since the broadcasts of the
+	// network aren't received on a unicast address, so each port
+	// needs its own UDP port.
+	Addr *net.UDPAddr
+	// Broadcast is the address used to broadcast on the network of
+	// the port
+	Broadcast *net.UDPAddr
+}
+
+// Router forwards the NPDUs between its ports. It answers the
+// Who-Is-Router-To-Network queries and learns the networks reachable
+// through other routers from their I-Am-Router-To-Network messages.
+type Router struct {
+	ports  []*port
+	logger bacip.Logger
+	// localIPs are the addresses of the interfaces, the ports receive
+	// their own broadcasts from one of them
+	localIPs []net.IP
+
+	mutex sync.Mutex
+	table map[uint16]*route
+	busy  bool
+
+	runFlag atomic.Bool
+	wg      sync.WaitGroup
+}
+
+type port struct {
+	id        byte
+	network   uint16
+	conn      *net.UDPConn
+	addr      *net.UDPAddr
+	broadcast *net.UDPAddr
+}
+
+// route is an entry of the routing table
+type route struct {
+	port *port
+	// nextHop is the MAC address of the router to the network, or
+	// nil if the network is directly connected
+	nextHop []byte
+	// busyUntil is set when the next router is busy
+	busyUntil time.Time
+}
+
+// Route describes how a network is reached by the router
+type Route struct {
+	// Port is the network number of the port the network is
+	// reached through
+	Port uint16
+	// NextHop is the address of the router to the network, nil if
+	// the network is directly connected
+	NextHop *net.UDPAddr
+	Busy    bool
+}
+
+// New opens the ports and starts routing. The networks reachable
+// through each port are announced on the other ports.
+func New(configs []PortConfig, logger bacip.Logger) (*Router, error) {
+	if len(configs) < 2 {
+		return nil, errors.New("a router needs at least two ports")
+	}
+	localIPs, err := interfaceIPs()
+	if err != nil {
+		return nil, fmt.Errorf("interface addresses: %w", err)
+	}
+	r := &Router{
+		logger:   logger,
+		localIPs: localIPs,
+		table:    map[uint16]*route{},
+	}
+	for i, cfg := range configs {
+		if cfg.Network == 0 || cfg.Network == bacip.GlobalBroadcastNetwork {
+			r.closePorts()
+			return nil, fmt.Errorf("invalid network number %d", cfg.Network)
+		}
+		if _, ok := r.table[cfg.Network]; ok {
+			r.closePorts()
+			return nil, fmt.Errorf("network %d is used by several ports", cfg.Network)
+		}
+		addr := &net.UDPAddr{IP: net.IPv4zero}
+		if cfg.Addr != nil {
+			addr = &net.UDPAddr{IP: cfg.Addr.IP, Port: cfg.Addr.Port}
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: addr.Port})
+		if err != nil {
+			r.closePorts()
+			return nil, fmt.Errorf("port %d: %w", cfg.Network, err)
+		}
+		addr.Port = conn.LocalAddr().(*net.UDPAddr).Port
+		p := &port{
+			id:        byte(i + 1),
+			network:   cfg.Network,
+			conn:      conn,
+			addr:      addr,
+			broadcast: cfg.Broadcast,
+		}
+		r.ports = append(r.ports, p)
+		r.table[cfg.Network] = &route{port: p}
+	}
+	r.runFlag.Store(true)
+	for _, p := range r.ports {
+		r.wg.Add(1)
+		go r.listen(p)
+	}
+	for _, p := range r.ports {
+		r.announce(p, r.networksExcept(p))
+	}
+	return r, nil
+}
+
+// Close stops the router and closes its ports
+func (r *Router) Close() error {
+	r.runFlag.Store(false)
+	err := r.closePorts()
+	r.wg.Wait()
+	return err
+}
+
+func (r *Router) closePorts() error {
+	var result error
+	for _, p := range r.ports {
+		err := p.conn.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Addr returns the local address of the port connected to network
+func (r *Router) Addr(network uint16) *net.UDPAddr {
+	for _, p := range r.ports {
+		if p.network == network {
+			return &net.UDPAddr{IP: p.addr.IP, Port: p.addr.Port}
+		}
+	}
+	return nil
+}
+
+// Routes returns the routing table, by network number
+func (r *Router) Routes() map[uint16]Route {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := make(map[uint16]Route, len(r.table))
+	for n, rt := range r.table {
+		result[n] = Route{
+			Port:    rt.port.network,
+			NextHop: udpFromMac(rt.nextHop),
+			Busy:    time.Now().Before(rt.busyUntil),
+		}
+	}
+	return result
+}
+
+// SetBusy starts or stops the flow control. While the router is busy,
+// the messages it should forward are rejected. The change is
+// announced with Router-Busy-To-Network or Router-Available-To-Network
+// on all the ports.
+func (r *Router) SetBusy(busy bool) {
+	r.mutex.Lock()
+	r.busy = busy
+	r.mutex.Unlock()
+	for _, p := range r.ports {
+		networks := r.networksExcept(p)
+		if len(networks) == 0 {
+			continue
+		}
+		var msg bacip.NPDU
+		if busy {
+			msg = networkMessage(bacip.NetworkMessageRouterBusyToNetwork, &bacip.RouterBusyToNetwork{Networks: networks})
+		} else {
+			msg = networkMessage(bacip.NetworkMessageRouterAvailableToNetwork, &bacip.RouterAvailableToNetwork{Networks: networks})
+		}
+		r.sendBroadcast(p, msg, nil)
+	}
+}
+
+func (r *Router) listen(p *port) {
+	defer r.wg.Done()
+	b := make([]byte, 2048)
+	for r.runFlag.Load() {
+		i, addr, err := p.conn.ReadFromUDP(b)
+		if err != nil {
+			if !r.runFlag.Load() {
+				return
+			}
+			r.logger.Error(err.Error())
+			continue
+		}
+		err = r.handleMessage(p, addr, b[:i])
+		if err != nil {
+			r.logger.Error("handle msg: ", err)
+		}
+	}
+}
+
+func (r *Router) handleMessage(in *port, src *net.UDPAddr, b []byte) error {
+	if len(b) < 4 || bacip.BVLCType(b[0]) != bacip.TypeBacnetIP {
+		return bacip.ErrNotBAcnetIP
+	}
+	if int(binary.BigEndian.Uint16(b[2:])) != len(b) {
+		return fmt.Errorf("incoherent Length field in BVLC")
+	}
+	if r.isOwn(src) {
+		// Our own broadcasts, the routes through the router itself
+		// would be loops
+		return nil
+	}
+	data := b[4:]
+	switch bacip.Function(b[1]) {
+	case bacip.BacFuncUnicast, bacip.BacFuncBroadcast:
+	case bacip.BacFuncForwardedNPDU:
+		// A broadcast forwarded by a BBMD, the sender is the
+		// originating device
+		if len(data) < 6 {
+			return fmt.Errorf("short forwarded npdu")
+		}
+		src = udpFromMac(data[:6])
+		data = data[6:]
+		if r.isOwn(src) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	var npdu bacip.NPDU
+	apdu, err := npdu.UnmarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if npdu.Destination == nil {
+		// Local traffic, only the network layer messages concern
+		// the router
+		if npdu.IsNetworkLayerMessage {
+			r.handleNetworkMessage(in, src, npdu)
+		}
+		return nil
+	}
+	if npdu.Destination.Net == in.network {
+		return nil
+	}
+	if npdu.IsNetworkLayerMessage && npdu.Destination.Net == bacip.GlobalBroadcastNetwork {
+		r.handleNetworkMessage(in, src, npdu)
+	}
+	r.forward(in, src, npdu, apdu)
+	return nil
+}
+
+// forward sends the npdu toward its destination network
+func (r *Router) forward(in *port, src *net.UDPAddr, npdu bacip.NPDU, apdu []byte) {
+	if npdu.HopCount <= 1 {
+		r.logger.Info(fmt.Sprintf("hop count exhausted, message to network %d dropped", npdu.Destination.Net))
+		return
+	}
+	npdu.HopCount--
+	if npdu.Source == nil {
+		npdu.Source = &bacnet.Address{Net: in.network, Adr: macFromUDP(src)}
+	}
+	dnet := npdu.Destination.Net
+	if dnet == bacip.GlobalBroadcastNetwork {
+		for _, p := range r.ports {
+			if p != in {
+				r.sendBroadcast(p, npdu, apdu)
+			}
+		}
+		return
+	}
+	r.mutex.Lock()
+	rt, ok := r.table[dnet]
+	var out *port
+	var nextHop []byte
+	busy := r.busy
+	if ok {
+		out, nextHop = rt.port, rt.nextHop
+		busy = busy || time.Now().Before(rt.busyUntil)
+	}
+	r.mutex.Unlock()
+	switch {
+	case !ok:
+		r.reject(in, src, npdu, bacip.RejectMessageUnknownNetwork, dnet)
+	case busy:
+		r.reject(in, src, npdu, bacip.RejectMessageRouterBusy, dnet)
+	case out == in:
+		r.logger.Info(fmt.Sprintf("message to network %d received from its port, dropped", dnet))
+	case nextHop != nil:
+		r.sendUnicast(out, udpFromMac(nextHop), npdu, apdu)
+	default:
+		// The destination network is directly connected, the
+		// destination is now a local address
+		dadr := npdu.Destination.Adr
+		npdu.Destination = nil
+		if len(dadr) == 0 {
+			r.sendBroadcast(out, npdu, apdu)
+			return
+		}
+		dst := udpFromMac(dadr)
+		if dst == nil {
+			r.reject(in, src, npdu, bacip.RejectMessageAddressingError, dnet)
+			return
+		}
+		r.sendUnicast(out, dst, npdu, apdu)
+	}
+}
+
+// reject sends a Reject-Message-To-Network to the source of npdu
+func (r *Router) reject(in *port, src *net.UDPAddr, npdu bacip.NPDU, reason bacip.RejectMessageReason, network uint16) {
+	if npdu.IsNetworkLayerMessage && npdu.NetworkMessageType == bacip.NetworkMessageRejectMessageToNetwork {
+		return
+	}
+	msg := networkMessage(bacip.NetworkMessageRejectMessageToNetwork, &bacip.RejectMessageToNetwork{
+		Reason:  reason,
+		Network: network,
+	})
+	if npdu.Source.Net != in.network {
+		// The source is behind another router
+		msg.Destination = &bacnet.Address{Net: npdu.Source.Net, Adr: npdu.Source.Adr}
+		msg.HopCount = 255
+	}
+	r.sendUnicast(in, src, msg, nil)
+}
+
+func (r *Router) handleNetworkMessage(in *port, src *net.UDPAddr, npdu bacip.NPDU) {
+	switch m := npdu.NetworkMessage.(type) {
+	case *bacip.WhoIsRouterToNetwork:
+		r.whoIsRouter(in, src, npdu, m)
+	case *bacip.IAmRouterToNetwork:
+		r.learn(in, src, m.Networks)
+	case *bacip.RouterBusyToNetwork:
+		r.setBusy(in, src, m.Networks, time.Now().Add(BusyTimeout))
+	case *bacip.RouterAvailableToNetwork:
+		r.setBusy(in, src, m.Networks, time.Time{})
+	case *bacip.InitializeRoutingTable:
+		if len(m.Ports) > 0 {
+			r.logger.Info("routing table update ignored")
+		}
+		r.sendUnicast(in, src, networkMessage(bacip.NetworkMessageInitializeRoutingTableAck,
+			&bacip.InitializeRoutingTableAck{Ports: r.routingTable(len(m.Ports) == 0)}), nil)
+	case *bacip.WhatIsNetworkNumber:
+		if npdu.Source == nil {
+			r.sendBroadcast(in, networkMessage(bacip.NetworkMessageNetworkNumberIs,
+				&bacip.NetworkNumberIs{Network: in.network, Configured: true}), nil)
+		}
+	}
+}
+
+// whoIsRouter answers with the networks reachable through the other
+// ports. A query for an unknown network is forwarded to the other
+// ports, the routers answering are learnt and announced in turn.
+func (r *Router) whoIsRouter(in *port, src *net.UDPAddr, npdu bacip.NPDU, m *bacip.WhoIsRouterToNetwork) {
+	if m.Network == nil {
+		networks := r.networksExcept(in)
+		if len(networks) > 0 {
+			r.announce(in, networks)
+		}
+		return
+	}
+	r.mutex.Lock()
+	rt, ok := r.table[*m.Network]
+	r.mutex.Unlock()
+	if ok {
+		if rt.port != in {
+			r.announce(in, []uint16{*m.Network})
+		}
+		return
+	}
+	if npdu.Destination != nil {
+		// A global broadcast is forwarded as any other message
+		return
+	}
+	npdu.Source = &bacnet.Address{Net: in.network, Adr: macFromUDP(src)}
+	for _, p := range r.ports {
+		if p != in {
+			r.sendBroadcast(p, npdu, nil)
+		}
+	}
+}
+
+// learn adds the networks reachable through the router at src and
+// announces them on the other ports
+func (r *Router) learn(in *port, src *net.UDPAddr, networks []uint16) {
+	learnt := []uint16{}
+	r.mutex.Lock()
+	for _, n := range networks {
+		rt, ok := r.table[n]
+		if ok && rt.nextHop == nil {
+			// Directly connected networks are never rerouted
+			continue
+		}
+		r.table[n] = &route{port: in, nextHop: macFromUDP(src)}
+		learnt = append(learnt, n)
+	}
+	r.mutex.Unlock()
+	if len(learnt) == 0 {
+		return
+	}
+	for _, p := range r.ports {
+		if p != in {
+			r.announce(p, learnt)
+		}
+	}
+}
+
+// setBusy updates the busy state of the networks reachable through
+// the router at src. An empty list means all of them.
+func (r *Router) setBusy(in *port, src *net.UDPAddr, networks []uint16, until time.Time) {
+	mac := macFromUDP(src)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for n, rt := range r.table {
+		if rt.port != in || string(rt.nextHop) != string(mac) {
+			continue
+		}
+		if len(networks) == 0 || contains(networks, n) {
+			rt.busyUntil = until
+		}
+	}
+}
+
+// networksExcept returns the networks not reachable through p
+func (r *Router) networksExcept(p *port) []uint16 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	networks := []uint16{}
+	for n, rt := range r.table {
+		if rt.port != p {
+			networks = append(networks, n)
+		}
+	}
+	return networks
+}
+
+// routingTable returns the directly connected networks, and the
+// remote ones when all is set
+func (r *Router) routingTable(all bool) []bacip.RoutingTablePort {
+	if !all {
+		return []bacip.RoutingTablePort{}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ports := []bacip.RoutingTablePort{}
+	for n, rt := range r.table {
+		ports = append(ports, bacip.RoutingTablePort{Network: n, PortID: rt.port.id})
+	}
+	return ports
+}
+
+func (r *Router) announce(p *port, networks []uint16) {
+	if len(networks) == 0 {
+		return
+	}
+	r.sendBroadcast(p, networkMessage(bacip.NetworkMessageIAmRouterToNetwork,
+		&bacip.IAmRouterToNetwork{Networks: networks}), nil)
+}
+
+func (r *Router) sendBroadcast(p *port, npdu bacip.NPDU, apdu []byte) {
+	if p.broadcast == nil {
+		return
+	}
+	r.send(p, bacip.BacFuncBroadcast, p.broadcast, npdu, apdu)
+}
+
+func (r *Router) sendUnicast(p *port, dst *net.UDPAddr, npdu bacip.NPDU, apdu []byte) {
+	r.send(p, bacip.BacFuncUnicast, dst, npdu, apdu)
+}
+
+// send writes the npdu followed by the raw apdu
+func (r *Router) send(p *port, function bacip.Function, dst *net.UDPAddr, npdu bacip.NPDU, apdu []byte) {
+	npdu.ADPU = nil
+	data, err := npdu.MarshalBinary()
+	if err != nil {
+		r.logger.Error("marshal npdu: ", err)
+		return
+	}
+	length := 4 + len(data) + len(apdu) // includes the BVLC header
+	b := make([]byte, 4, length)
+	b[0] = byte(bacip.TypeBacnetIP)
+	b[1] = byte(function)
+	binary.BigEndian.PutUint16(b[2:], uint16(length))
+	b = append(append(b, data...), apdu...)
+	_, err = p.conn.WriteToUDP(b, dst)
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("send to %v: %v", dst, err))
+	}
+}
+
+// isOwn is true if addr is the address of one of the ports, on any of
+// the interfaces
+func (r *Router) isOwn(addr *net.UDPAddr) bool {
+	for _, p := range r.ports {
+		if addr.Port != p.addr.Port {
+			continue
+		}
+		for _, ip := range r.localIPs {
+			if addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interfaceIPs returns the addresses of the local interfaces
+func interfaceIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+func networkMessage(t bacip.NetworkMessageType, payload bacip.Payload) bacip.NPDU {
+	return bacip.NPDU{
+		Version:               bacip.Version1,
+		IsNetworkLayerMessage: true,
+		Priority:              bacip.Normal,
+		NetworkMessageType:    t,
+		NetworkMessage:        payload,
+	}
+}
+
+// macFromUDP returns the 6 bytes BACnet/IP MAC address used in the
+// SADR and DADR fields
+func macFromUDP(addr *net.UDPAddr) []byte {
+	mac := make([]byte, 6)
+	copy(mac, addr.IP.To4())
+	binary.BigEndian.PutUint16(mac[4:], uint16(addr.Port))
+	return mac
+}
+
+func udpFromMac(mac []byte) *net.UDPAddr {
+	if len(mac) != 6 {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   net.IPv4(mac[0], mac[1], mac[2], mac[3]),
+		Port: int(binary.BigEndian.Uint16(mac[4:])),
+	}
+}
+
+func contains(networks []uint16, n uint16) bool {
+	for _, x := range networks {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+
+	"github.com/matryer/is"
+)
+
+// readPropertyRequest is the APDU of a confirmed ReadProperty request
+var readPropertyRequest = []byte{0x00, 0x05, 0x01, 0x0c, 0x0c, 0x02, 0x00, 0x00, 0x01, 0x19, 0x4d}
+
+// testNetwork is a loopback setup with a router between network 1
+// and network 2. Each network has a single node, so the router
+// broadcasts are sent to it.
+type testNetwork struct {
+	router *Router
+	node1  *net.UDPConn
+	node2  *net.UDPConn
+}
+
+func newTestNetwork(t *testing.T) *testNetwork {
+	t.Helper()
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	n := &testNetwork{node1: listen(), node2: listen()}
+	r, err := New([]PortConfig{
+		{Network: 1, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, Broadcast: localAddr(n.node1)},
+		{Network: 2, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, Broadcast: localAddr(n.node2)},
+	}, bacip.NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	n.router = r
+	// Startup announces
+	expectNetworkMessage(t, n.node1, bacip.NetworkMessageIAmRouterToNetwork)
+	expectNetworkMessage(t, n.node2, bacip.NetworkMessageIAmRouterToNetwork)
+	return n
+}
+
+func localAddr(conn *net.UDPConn) *net.UDPAddr {
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func send(t *testing.T, conn *net.UDPConn, dst *net.UDPAddr, npdu bacip.NPDU, apdu []byte) {
+	t.Helper()
+	write(t, conn, dst, bacip.BacFuncUnicast, npdu, apdu)
+}
+
+func broadcast(t *testing.T, conn *net.UDPConn, dst *net.UDPAddr, npdu bacip.NPDU) {
+	t.Helper()
+	write(t, conn, dst, bacip.BacFuncBroadcast, npdu, nil)
+}
+
+func write(t *testing.T, conn *net.UDPConn, dst *net.UDPAddr, function bacip.Function, npdu bacip.NPDU, apdu []byte) {
+	t.Helper()
+	data, err := npdu.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := []byte{byte(bacip.TypeBacnetIP), byte(function), 0, 0}
+	b = append(append(b, data...), apdu...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	_, err = conn.WriteToUDP(b, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the next npdu received by conn and its raw apdu.
+// ok is false on timeout
+func receive(t *testing.T, conn *net.UDPConn, timeout time.Duration) (npdu bacip.NPDU, apdu []byte, ok bool) {
+	t.Helper()
+	b := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	i, _, err := conn.ReadFromUDP(b)
+	if err != nil {
+		return npdu, nil, false
+	}
+	apdu, err = npdu.UnmarshalHeader(b[4:i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return npdu, apdu, true
+}
+
+func expectNetworkMessage(t *testing.T, conn *net.UDPConn, msgType bacip.NetworkMessageType) bacip.NPDU {
+	t.Helper()
+	npdu, _, ok := receive(t, conn, time.Second)
+	if !ok {
+		t.Fatalf("no network message %d received", msgType)
+	}
+	if !npdu.IsNetworkLayerMessage || npdu.NetworkMessageType != msgType {
+		t.Fatalf("network message %d expected, got %+v", msgType, npdu)
+	}
+	return npdu
+}
+
+func TestForward(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	send(t, n.node1, n.router.Addr(1), bacip.NPDU{
+		Version:        bacip.Version1,
+		ExpectingReply: true,
+		Destination:    &bacnet.Address{Net: 2, Adr: macFromUDP(localAddr(n.node2))},
+		HopCount:       255,
+	}, readPropertyRequest)
+
+	req, apdu, ok := receive(t, n.node2, time.Second)
+	is.True(ok)
+	is.Equal(req.Destination, nil)
+	is.Equal(*req.Source, bacnet.Address{Net: 1, Adr: macFromUDP(localAddr(n.node1))})
+	is.True(req.ExpectingReply)
+	is.True(bytes.Equal(apdu, readPropertyRequest))
+
+	ack := []byte{0x30, 0x05, 0x0c}
+	send(t, n.node2, n.router.Addr(2), bacip.NPDU{
+		Version:     bacip.Version1,
+		Destination: req.Source,
+		HopCount:    255,
+	}, ack)
+	resp, apdu, ok := receive(t, n.node1, time.Second)
+	is.True(ok)
+	is.Equal(resp.Destination, nil)
+	is.Equal(*resp.Source, bacnet.Address{Net: 2, Adr: macFromUDP(localAddr(n.node2))})
+	is.True(bytes.Equal(apdu, ack))
+}
+
+func TestForwardBroadcast(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	whoIs := []byte{0x10, 0x08}
+	for _, dnet := range []uint16{2, bacip.GlobalBroadcastNetwork} {
+		send(t, n.node1, n.router.Addr(1), bacip.NPDU{
+			Version:     bacip.Version1,
+			Destination: &bacnet.Address{Net: dnet},
+			HopCount:    255,
+		}, whoIs)
+		npdu, apdu, ok := receive(t, n.node2, time.Second)
+		is.True(ok)
+		if dnet == bacip.GlobalBroadcastNetwork {
+			is.Equal(npdu.Destination.Net, dnet)
+			is.Equal(npdu.HopCount, byte(254))
+		} else {
+			is.Equal(npdu.Destination, nil)
+		}
+		is.Equal(npdu.Source.Net, uint16(1))
+		is.True(bytes.Equal(apdu, whoIs))
+	}
+}
+
+func TestHopCount(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	send(t, n.node1, n.router.Addr(1), bacip.NPDU{
+		Version:     bacip.Version1,
+		Destination: &bacnet.Address{Net: 2, Adr: macFromUDP(localAddr(n.node2))},
+		HopCount:    1,
+	}, readPropertyRequest)
+	_, _, ok := receive(t, n.node2, 100*time.Millisecond)
+	is.True(!ok) // hop count exhausted
+}
+
+func TestWhoIsRouter(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	network := uint16(2)
+	for _, who := range []*bacip.WhoIsRouterToNetwork{{}, {Network: &network}} {
+		send(t, n.node1, n.router.Addr(1), networkMessage(bacip.NetworkMessageWhoIsRouterToNetwork, who), nil)
+		npdu := expectNetworkMessage(t, n.node1, bacip.NetworkMessageIAmRouterToNetwork)
+		is.Equal(npdu.NetworkMessage.(*bacip.IAmRouterToNetwork).Networks, []uint16{2})
+	}
+
+	// Unknown networks are searched on the other ports
+	network = 3
+	send(t, n.node1, n.router.Addr(1), networkMessage(bacip.NetworkMessageWhoIsRouterToNetwork,
+		&bacip.WhoIsRouterToNetwork{Network: &network}), nil)
+	npdu := expectNetworkMessage(t, n.node2, bacip.NetworkMessageWhoIsRouterToNetwork)
+	is.Equal(*npdu.NetworkMessage.(*bacip.WhoIsRouterToNetwork).Network, uint16(3))
+	is.Equal(npdu.Source.Net, uint16(1))
+}
+
+func TestSubnetBroadcast(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	// The query is broadcast on the loopback subnet, not sent to the
+	// address of the port
+	dst := &net.UDPAddr{IP: net.IPv4(127, 255, 255, 255), Port: n.router.Addr(1).Port}
+	broadcast(t, n.node1, dst, networkMessage(bacip.NetworkMessageWhoIsRouterToNetwork, &bacip.WhoIsRouterToNetwork{}))
+	npdu := expectNetworkMessage(t, n.node1, bacip.NetworkMessageIAmRouterToNetwork)
+	is.Equal(npdu.NetworkMessage.(*bacip.IAmRouterToNetwork).Networks, []uint16{2})
+}
+
+func TestOwnBroadcast(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	// node2 is a router to network 3, announced on network 1
+	send(t, n.node2, n.router.Addr(2), networkMessage(bacip.NetworkMessageIAmRouterToNetwork,
+		&bacip.IAmRouterToNetwork{Networks: []uint16{3}}), nil)
+	expectNetworkMessage(t, n.node1, bacip.NetworkMessageIAmRouterToNetwork)
+
+	// The announce comes back to the port, as any broadcast of its
+	// subnet
+	b, err := bacip.BVLC{
+		Type:     bacip.TypeBacnetIP,
+		Function: bacip.BacFuncBroadcast,
+		NPDU: networkMessage(bacip.NetworkMessageIAmRouterToNetwork,
+			&bacip.IAmRouterToNetwork{Networks: []uint16{3}}),
+	}.MarshalBinary()
+	is.NoErr(err)
+	is.NoErr(n.router.handleMessage(n.router.ports[0], n.router.Addr(1), b))
+	is.Equal(n.router.Routes()[3], Route{Port: 2, NextHop: udpFromMac(macFromUDP(localAddr(n.node2)))})
+	_, _, ok := receive(t, n.node2, 100*time.Millisecond)
+	is.True(!ok) // not announced back
+}
+
+func TestLearnRoute(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	// node2 is a router to network 3
+	send(t, n.node2, n.router.Addr(2), networkMessage(bacip.NetworkMessageIAmRouterToNetwork,
+		&bacip.IAmRouterToNetwork{Networks: []uint16{3, 1}}), nil)
+	npdu := expectNetworkMessage(t, n.node1, bacip.NetworkMessageIAmRouterToNetwork)
+	is.Equal(npdu.NetworkMessage.(*bacip.IAmRouterToNetwork).Networks, []uint16{3})
+	is.Equal(n.router.Routes()[3], Route{Port: 2, NextHop: udpFromMac(macFromUDP(localAddr(n.node2)))})
+	is.Equal(n.router.Routes()[1].NextHop, nil) // directly connected
+
+	send(t, n.node1, n.router.Addr(1), bacip.NPDU{
+		Version:     bacip.Version1,
+		Destination: &bacnet.Address{Net: 3, Adr: []byte{0x05}},
+		HopCount:    255,
+	}, readPropertyRequest)
+	req, apdu, ok := receive(t, n.node2, time.Second)
+	is.True(ok)
+	is.Equal(*req.Destination, bacnet.Address{Net: 3, Adr: []byte{0x05}})
+	is.Equal(req.HopCount, byte(254))
+	is.True(bytes.Equal(apdu, readPropertyRequest))
+}
+
+func TestUnknownNetwork(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	send(t, n.node1, n.router.Addr(1), bacip.NPDU{
+		Version:     bacip.Version1,
+		Destination: &bacnet.Address{Net: 4, Adr: []byte{0x05}},
+		HopCount:    255,
+	}, readPropertyRequest)
+	npdu := expectNetworkMessage(t, n.node1, bacip.NetworkMessageRejectMessageToNetwork)
+	is.Equal(*npdu.NetworkMessage.(*bacip.RejectMessageToNetwork), bacip.RejectMessageToNetwork{
+		Reason:  bacip.RejectMessageUnknownNetwork,
+		Network: 4,
+	})
+}
+
+func TestBusy(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	n.router.SetBusy(true)
+	npdu := expectNetworkMessage(t, n.node1, bacip.NetworkMessageRouterBusyToNetwork)
+	is.Equal(npdu.NetworkMessage.(*bacip.RouterBusyToNetwork).Networks, []uint16{2})
+	expectNetworkMessage(t, n.node2, bacip.NetworkMessageRouterBusyToNetwork)
+
+	request := bacip.NPDU{
+		Version:     bacip.Version1,
+		Destination: &bacnet.Address{Net: 2, Adr: macFromUDP(localAddr(n.node2))},
+		HopCount:    255,
+	}
+	send(t, n.node1, n.router.Addr(1), request, readPropertyRequest)
+	npdu = expectNetworkMessage(t, n.node1, bacip.NetworkMessageRejectMessageToNetwork)
+	is.Equal(npdu.NetworkMessage.(*bacip.RejectMessageToNetwork).Reason, bacip.RejectMessageRouterBusy)
+
+	n.router.SetBusy(false)
+	expectNetworkMessage(t, n.node1, bacip.NetworkMessageRouterAvailableToNetwork)
+	expectNetworkMessage(t, n.node2, bacip.NetworkMessageRouterAvailableToNetwork)
+	send(t, n.node1, n.router.Addr(1), request, readPropertyRequest)
+	_, _, ok := receive(t, n.node2, time.Second)
+	is.True(ok)
+}
+
+func TestDownstreamBusy(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	send(t, n.node2, n.router.Addr(2), networkMessage(bacip.NetworkMessageIAmRouterToNetwork,
+		&bacip.IAmRouterToNetwork{Networks: []uint16{3}}), nil)
+	expectNetworkMessage(t, n.node1, bacip.NetworkMessageIAmRouterToNetwork)
+	send(t, n.node2, n.router.Addr(2), networkMessage(bacip.NetworkMessageRouterBusyToNetwork,
+		&bacip.RouterBusyToNetwork{}), nil)
+	time.Sleep(20 * time.Millisecond)
+	is.True(n.router.Routes()[3].Busy)
+
+	send(t, n.node1, n.router.Addr(1), bacip.NPDU{
+		Version:     bacip.Version1,
+		Destination: &bacnet.Address{Net: 3, Adr: []byte{0x05}},
+		HopCount:    255,
+	}, readPropertyRequest)
+	npdu := expectNetworkMessage(t, n.node1, bacip.NetworkMessageRejectMessageToNetwork)
+	is.Equal(npdu.NetworkMessage.(*bacip.RejectMessageToNetwork).Reason, bacip.RejectMessageRouterBusy)
+
+	send(t, n.node2, n.router.Addr(2), networkMessage(bacip.NetworkMessageRouterAvailableToNetwork,
+		&bacip.RouterAvailableToNetwork{Networks: []uint16{3}}), nil)
+	time.Sleep(20 * time.Millisecond)
+	is.True(!n.router.Routes()[3].Busy)
+}
+
+func TestNetworkNumber(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	send(t, n.node2, n.router.Addr(2), networkMessage(bacip.NetworkMessageWhatIsNetworkNumber,
+		&bacip.WhatIsNetworkNumber{}), nil)
+	npdu := expectNetworkMessage(t, n.node2, bacip.NetworkMessageNetworkNumberIs)
+	is.Equal(*npdu.NetworkMessage.(*bacip.NetworkNumberIs), bacip.NetworkNumberIs{Network: 2, Configured: true})
+
+	send(t, n.node1, n.router.Addr(1), networkMessage(bacip.NetworkMessageInitializeRoutingTable,
+		&bacip.InitializeRoutingTable{}), nil)
+	npdu = expectNetworkMessage(t, n.node1, bacip.NetworkMessageInitializeRoutingTableAck)
+	is.Equal(len(npdu.NetworkMessage.(*bacip.InitializeRoutingTableAck).Ports), 2)
+}
+
+func TestForwardedNPDU(t *testing.T) {
+	is := is.New(t)
+	n := newTestNetwork(t)
+	// A broadcast of 10.0.0.5 forwarded by a BBMD of the network 1
+	origin := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 47808}
+	b, err := bacip.BVLC{
+		Type:     bacip.TypeBacnetIP,
+		Function: bacip.BacFuncForwardedNPDU,
+		Origin:   origin,
+		NPDU: bacip.NPDU{
+			Version:     bacip.Version1,
+			Destination: &bacnet.Address{Net: 2},
+			HopCount:    255,
+			ADPU:        &bacip.APDU{DataType: bacip.UnconfirmedServiceRequest, ServiceType: bacip.ServiceUnconfirmedWhoIs, Payload: &bacip.WhoIs{}},
+		},
+	}.MarshalBinary()
+	is.NoErr(err)
+	_, err = n.node1.WriteToUDP(b, n.router.Addr(1))
+	is.NoErr(err)
+	npdu, _, ok := receive(t, n.node2, time.Second)
+	is.True(ok)
+	is.Equal(*npdu.Source, bacnet.Address{Net: 1, Adr: macFromUDP(origin)})
+}
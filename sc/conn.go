@@ -0,0 +1,170 @@
+package sc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/internal/websocket"
+)
+
+// connection is a WebSocket connection between a node and a hub, or
+// between two nodes
+type connection struct {
+	conn *websocket.Conn
+	uri  string
+	// status is PrimaryHubConnected or FailoverHubConnected for the
+	// connections of a node to a hub
+	status byte
+	// peer is the VMAC of the node at the other end of the connection,
+	// nil for a connection to a hub
+	peer         *VMAC
+	lastReceived atomic.Int64
+}
+
+func newConnection(conn *websocket.Conn, uri string) *connection {
+	c := &connection{conn: conn, uri: uri}
+	c.lastReceived.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *connection) write(m Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(data)
+}
+
+// read returns the next message. The connection is lost after
+// timeout without any message.
+func (c *connection) read(timeout time.Duration) (Message, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	data, err := c.conn.ReadMessage()
+	if err != nil {
+		return Message{}, err
+	}
+	c.lastReceived.Store(time.Now().UnixNano())
+	var m Message
+	err = m.UnmarshalBinary(data)
+	if err != nil {
+		return m, fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	return m, nil
+}
+
+// request sends the message and returns its answer, the next message
+// with the same message ID and one of the answer functions, before the
+// connection is served. The other messages are dropped.
+func (c *connection) request(ctx context.Context, m Message, answers ...Function) (Message, error) {
+	err := c.write(m)
+	if err != nil {
+		return Message{}, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Minute)
+	}
+	for {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return Message{}, context.DeadlineExceeded
+		}
+		answer, err := c.read(timeout)
+		if errors.Is(err, errMalformed) {
+			continue
+		}
+		if err != nil {
+			return Message{}, err
+		}
+		if answer.MessageID != m.MessageID {
+			continue
+		}
+		for _, f := range answers {
+			if answer.Function == f {
+				return answer, nil
+			}
+		}
+	}
+}
+
+// connect exchanges the Connect-Request and the Connect-Accept on the
+// connection opened to a hub or to a node. It returns the payload of
+// the Connect-Accept. A NAK is returned as Result error.
+func (c *connection) connect(ctx context.Context, messageID uint16, local ConnectPayload) (ConnectPayload, error) {
+	payload, _ := local.MarshalBinary()
+	answer, err := c.request(ctx, Message{
+		Function:  FuncConnectRequest,
+		MessageID: messageID,
+		Payload:   payload,
+	}, FuncConnectAccept, FuncResult)
+	if err != nil {
+		return ConnectPayload{}, err
+	}
+	var accept ConnectPayload
+	switch answer.Function {
+	case FuncConnectAccept:
+		err = accept.UnmarshalBinary(answer.Payload)
+		return accept, err
+	case FuncResult:
+		var result Result
+		err = result.UnmarshalBinary(answer.Payload)
+		if err != nil {
+			return accept, err
+		}
+		return accept, result
+	}
+	return accept, fmt.Errorf("unexpected answer %v", answer.Function)
+}
+
+// accept waits for the Connect-Request on a connection opened by a
+// node. check returns the error code of the NAK refusing the node, 0
+// to accept it.
+func (c *connection) accept(timeout time.Duration, local ConnectPayload, check func(ConnectPayload) bacnet.ErrorCode) (ConnectPayload, error) {
+	req, err := c.read(timeout)
+	if err != nil {
+		return ConnectPayload{}, err
+	}
+	if req.Function != FuncConnectRequest {
+		return ConnectPayload{}, fmt.Errorf("unexpected %v before connection", req.Function)
+	}
+	var remote ConnectPayload
+	err = remote.UnmarshalBinary(req.Payload)
+	if err != nil {
+		return remote, err
+	}
+	if code := check(remote); code != 0 {
+		_ = nak(c, req, 0, code)
+		return remote, fmt.Errorf("connection of %v refused: %v", remote.VMAC, code)
+	}
+	payload, _ := local.MarshalBinary()
+	return remote, c.write(Message{Function: FuncConnectAccept, MessageID: req.MessageID, Payload: payload})
+}
+
+var (
+	// errDisconnected is returned when the peer asks to disconnect
+	errDisconnected = errors.New("disconnected by the peer")
+	// errMalformed wraps the decoding errors of the received messages
+	errMalformed = errors.New("malformed bvlc-sc message")
+)
+
+// nak answers the message with a BVLC-Result NAK. The marker is the
+// one of the option causing the NAK, 0 if none.
+func nak(c *connection, m Message, marker byte, code bacnet.ErrorCode) error {
+	payload, _ := Result{
+		Function:    m.Function,
+		NAK:         true,
+		ErrorMarker: marker,
+		ErrorClass:  bacnet.CommunicationError,
+		ErrorCode:   code,
+	}.MarshalBinary()
+	return c.write(Message{
+		Function:    FuncResult,
+		MessageID:   m.MessageID,
+		Destination: m.Origin,
+		Payload:     payload,
+	})
+}
@@ -0,0 +1,117 @@
+package sc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/internal/websocket"
+)
+
+// ConnectDirect opens a direct connection to the node with the VMAC,
+// at one of the URIs returned by its address resolution. The npdus
+// sent to this node then bypass the hub.
+func (n *Node) ConnectDirect(ctx context.Context, vmac VMAC) error {
+	if n.directConnection(vmac) != nil {
+		return nil
+	}
+	uris, err := n.ResolveAddress(ctx, vmac)
+	if err != nil {
+		return err
+	}
+	err = fmt.Errorf("no direct connect uri for %v", vmac)
+	for _, uri := range uris {
+		var c *connection
+		c, err = n.dialDirect(ctx, uri, vmac)
+		if err == nil {
+			return n.addDirect(c)
+		}
+	}
+	return err
+}
+
+func (n *Node) dialDirect(ctx context.Context, uri string, vmac VMAC) (*connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.config.ConnectTimeout)
+	defer cancel()
+	conn, err := websocket.Dial(ctx, uri, n.config.TLSConfig, DirectSubprotocol)
+	if err != nil {
+		return nil, fmt.Errorf("direct connect to %s: %w", uri, err)
+	}
+	c := newConnection(conn, uri)
+	accept, err := c.connect(ctx, n.nextMessageID(), n.connectPayload())
+	if err == nil && accept.VMAC != vmac {
+		err = fmt.Errorf("connected to %v instead of %v", accept.VMAC, vmac)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("direct connect to %s: %w", uri, err)
+	}
+	c.peer = &accept.VMAC
+	return c, nil
+}
+
+// ServeHTTP accepts the direct connections of the other nodes. It is
+// served at the DirectConnectURIs of the node, by a TLS server
+// requiring and verifying the client certificates.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r, DirectSubprotocol)
+	if err != nil {
+		n.logger.Error(fmt.Sprintf("direct connection from %s: %v", r.RemoteAddr, err))
+		return
+	}
+	c := newConnection(conn, r.RemoteAddr)
+	local := n.connectPayload()
+	remote, err := c.accept(n.config.ConnectTimeout, local, func(remote ConnectPayload) bacnet.ErrorCode {
+		if remote.VMAC == local.VMAC {
+			return ErrorNodeDuplicateVMAC
+		}
+		return 0
+	})
+	if err != nil {
+		conn.Close()
+		n.logger.Error(fmt.Sprintf("direct connection from %s: %v", r.RemoteAddr, err))
+		return
+	}
+	c.peer = &remote.VMAC
+	_ = n.addDirect(c)
+}
+
+// addDirect serves the direct connection, replacing any previous
+// connection with the same node
+func (n *Node) addDirect(c *connection) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	select {
+	case <-n.closed:
+		c.conn.Close()
+		return net.ErrClosed
+	default:
+	}
+	if previous, ok := n.direct[*c.peer]; ok {
+		previous.conn.Close()
+	}
+	n.direct[*c.peer] = c
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.serve(c)
+		n.mutex.Lock()
+		if n.direct[*c.peer] == c {
+			delete(n.direct, *c.peer)
+		}
+		n.mutex.Unlock()
+	}()
+	return nil
+}
+
+func (n *Node) directConnection(vmac VMAC) *connection {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.direct[vmac]
+}
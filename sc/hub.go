@@ -0,0 +1,321 @@
+package sc
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+	"github.com/REQUEA/bacnet/internal/websocket"
+)
+
+// HubConfig is the configuration of a BACnet/SC hub
+type HubConfig struct {
+	// Addr is the TCP address the hub listens on, such as ":4443".
+	// Default is a random port on all the interfaces.
+	Addr string
+	// TLSConfig holds the operational certificate of the hub and the
+	// CA certificates of the nodes in ClientCAs, which is required.
+	// The nodes must present a certificate signed by one of these CAs.
+	TLSConfig *tls.Config
+	// VMAC and UUID identify the hub. Defaults are random.
+	VMAC *VMAC
+	UUID [16]byte
+	// MaxBVLCLength and MaxNPDULength are the maximum sizes of the
+	// messages accepted by the hub. Defaults are 1600 and 1497.
+	MaxBVLCLength uint16
+	MaxNPDULength uint16
+	// ConnectTimeout is the time waited for the Connect-Request of a
+	// node. Default is 10 seconds.
+	ConnectTimeout time.Duration
+	// HeartbeatTimeout is the idle time after which the nodes send a
+	// Heartbeat-Request. The connection of a node is lost after twice
+	// this time without any message. Default is 300 seconds.
+	HeartbeatTimeout time.Duration
+}
+
+// Hub is a BACnet/SC hub function: it forwards the messages between
+// the nodes connected to it
+type Hub struct {
+	config    HubConfig
+	logger    bacip.Logger
+	local     ConnectPayload
+	listener  net.Listener
+	server    *http.Server
+	mutex     sync.Mutex
+	nodes     map[VMAC]*hubNode
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// hubNode is a node connected to the hub
+type hubNode struct {
+	conn *connection
+	uuid [16]byte
+}
+
+// NewHub starts a hub listening for the connections of the nodes
+func NewHub(config HubConfig, logger bacip.Logger) (*Hub, error) {
+	if config.TLSConfig == nil {
+		return nil, errors.New("no tls configuration")
+	}
+	if config.TLSConfig.ClientCAs == nil {
+		// The system roots would accept any node with a public
+		// certificate
+		return nil, errors.New("no CA certificates for the nodes")
+	}
+	if config.MaxBVLCLength == 0 {
+		config.MaxBVLCLength = 1600
+	}
+	if config.MaxNPDULength == 0 {
+		config.MaxNPDULength = 1497
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 10 * time.Second
+	}
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = 300 * time.Second
+	}
+	if config.UUID == [16]byte{} {
+		_, err := rand.Read(config.UUID[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	h := &Hub{
+		config: config,
+		logger: logger,
+		nodes:  map[VMAC]*hubNode{},
+		closed: make(chan struct{}),
+	}
+	h.local = ConnectPayload{
+		UUID:          config.UUID,
+		MaxBVLCLength: config.MaxBVLCLength,
+		MaxNPDULength: config.MaxNPDULength,
+	}
+	if config.VMAC != nil {
+		h.local.VMAC = *config.VMAC
+	} else {
+		vmac, err := RandomVMAC()
+		if err != nil {
+			return nil, err
+		}
+		h.local.VMAC = vmac
+	}
+	tlsConfig := config.TLSConfig.Clone()
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	addr := config.Addr
+	if addr == "" {
+		addr = ":0"
+	}
+	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	h.listener = listener
+	h.server = &http.Server{
+		Handler:  h,
+		ErrorLog: log.New(logWriter{logger}, "", 0),
+	}
+	go func() {
+		_ = h.server.Serve(listener)
+	}()
+	return h, nil
+}
+
+// logWriter logs the errors of the http server, such as the rejected
+// certificates
+type logWriter struct {
+	logger bacip.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Error(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// URI returns the wss URI of the hub
+func (h *Hub) URI() string {
+	return "wss://" + h.listener.Addr().String()
+}
+
+// VMAC returns the virtual MAC address of the hub
+func (h *Hub) VMAC() VMAC {
+	return h.local.VMAC
+}
+
+// ServeHTTP accepts the connections of the nodes. It is served by the
+// hub, and can also be served by a TLS server requiring and verifying
+// the client certificates.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r, HubSubprotocol)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("connection from %s: %v", r.RemoteAddr, err))
+		return
+	}
+	c := newConnection(conn, r.RemoteAddr)
+	remote, err := c.accept(h.config.ConnectTimeout, h.local, h.check)
+	if err != nil {
+		conn.Close()
+		h.logger.Error(fmt.Sprintf("connection from %s: %v", r.RemoteAddr, err))
+		return
+	}
+	c.peer = &remote.VMAC
+	node := &hubNode{conn: c, uuid: remote.UUID}
+	if !h.add(node) {
+		conn.Close()
+		return
+	}
+	defer h.wg.Done()
+	h.serve(node)
+}
+
+// check refuses a node using the VMAC of the hub, or the VMAC of
+// another device. The same device connecting again replaces its
+// previous connection.
+func (h *Hub) check(remote ConnectPayload) bacnet.ErrorCode {
+	if remote.VMAC == h.local.VMAC || remote.VMAC == BroadcastVMAC {
+		return ErrorNodeDuplicateVMAC
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if node, ok := h.nodes[remote.VMAC]; ok && node.uuid != remote.UUID {
+		return ErrorNodeDuplicateVMAC
+	}
+	return 0
+}
+
+func (h *Hub) add(node *hubNode) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	select {
+	case <-h.closed:
+		return false
+	default:
+	}
+	if previous, ok := h.nodes[*node.conn.peer]; ok {
+		previous.conn.conn.Close()
+	}
+	h.nodes[*node.conn.peer] = node
+	h.wg.Add(1)
+	return true
+}
+
+// serve forwards the messages of the node until its connection is lost
+func (h *Hub) serve(node *hubNode) {
+	c := node.conn
+	defer func() {
+		c.conn.Close()
+		h.mutex.Lock()
+		if h.nodes[*c.peer] == node {
+			delete(h.nodes, *c.peer)
+		}
+		h.mutex.Unlock()
+	}()
+	for {
+		m, err := c.read(2 * h.config.HeartbeatTimeout)
+		if errors.Is(err, errMalformed) {
+			h.logger.Error(err)
+			continue
+		}
+		if err != nil {
+			select {
+			case <-h.closed:
+			default:
+				h.logger.Info(fmt.Sprintf("node %v disconnected: %v", c.peer, err))
+			}
+			return
+		}
+		err = h.handleMessage(c, m)
+		if errors.Is(err, errDisconnected) {
+			return
+		}
+		if err != nil {
+			h.logger.Error("handle bvlc-sc msg: ", err)
+		}
+	}
+}
+
+func (h *Hub) handleMessage(c *connection, m Message) error {
+	if m.Destination != nil {
+		h.forward(c, m)
+		return nil
+	}
+	switch m.Function {
+	case FuncHeartbeatRequest:
+		return c.write(Message{Function: FuncHeartbeatAck, MessageID: m.MessageID})
+	case FuncDisconnectRequest:
+		_ = c.write(Message{Function: FuncDisconnectAck, MessageID: m.MessageID})
+		return errDisconnected
+	case FuncEncapsulatedNPDU, FuncHeartbeatAck, FuncResult, FuncAdvertisement,
+		FuncAddressResolutionAck, FuncDisconnectAck, FuncProprietaryMessage:
+		// The hub function isn't a node: the messages without
+		// destination are dropped
+		return nil
+	case FuncAddressResolution, FuncAdvertisementSolicitation:
+		return nak(c, m, 0, bacnet.OptionalFunctionalityNotSupported)
+	default:
+		return nak(c, m, 0, ErrorBVLCFunctionUnknown)
+	}
+}
+
+// forward sends the message to its destination with the VMAC of the
+// sender as originating address. The destination of an unicast
+// message is removed, the one of a broadcast is kept.
+func (h *Hub) forward(c *connection, m Message) {
+	m.Origin = c.peer
+	dst := *m.Destination
+	var recipients []*connection
+	h.mutex.Lock()
+	if dst == BroadcastVMAC {
+		for vmac, node := range h.nodes {
+			if vmac != *c.peer {
+				recipients = append(recipients, node.conn)
+			}
+		}
+	} else if node, ok := h.nodes[dst]; ok {
+		m.Destination = nil
+		recipients = append(recipients, node.conn)
+	}
+	h.mutex.Unlock()
+	for _, r := range recipients {
+		err := r.write(m)
+		if err != nil {
+			h.logger.Error(fmt.Sprintf("forward to %v: %v", r.peer, err))
+		}
+	}
+}
+
+// Close disconnects the nodes and stops the hub
+func (h *Hub) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		h.mutex.Lock()
+		close(h.closed)
+		var conns []*connection
+		for _, node := range h.nodes {
+			conns = append(conns, node.conn)
+		}
+		h.mutex.Unlock()
+		err = h.server.Close()
+		for _, c := range conns {
+			_ = c.write(Message{Function: FuncDisconnectRequest})
+			c.conn.Close()
+		}
+		h.wg.Wait()
+	})
+	return err
+}
@@ -0,0 +1,163 @@
+package sc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+
+	"github.com/matryer/is"
+)
+
+func newTestHub(t *testing.T, pki *testPKI) *Hub {
+	t.Helper()
+	h, err := NewHub(HubConfig{Addr: "127.0.0.1:0", TLSConfig: pki.serverConfig(t)}, bacip.NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func receiveNPDU(t *testing.T, n *Node) ([]byte, []byte) {
+	t.Helper()
+	type result struct{ npdu, mac []byte }
+	ch := make(chan result, 1)
+	go func() {
+		npdu, mac, err := n.Receive()
+		if err == nil {
+			ch <- result{npdu, mac}
+		}
+	}()
+	select {
+	case r := <-ch:
+		return r.npdu, r.mac
+	case <-time.After(2 * time.Second):
+		t.Fatal("no npdu received")
+		return nil, nil
+	}
+}
+
+func TestHub(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newTestHub(t, pki)
+	deviceVMAC := VMAC{0x02, 0x00, 0x00, 0x00, 0x04, 0xd2}
+	device := dialNode(t, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "device"), VMAC: &deviceVMAC})
+	go serveDevice(device)
+	node := dialNode(t, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "client")})
+
+	c := bacip.NewClientWithDataLink(node, bacip.NoOpLogger{})
+	defer c.Close()
+	devices, err := c.WhoIs(bacip.WhoIs{}, 200*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(len(devices), 1)
+	is.Equal(devices[0].Addr, bacnet.Address{Mac: deviceVMAC[:]})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, devices[0], bacip.ReadProperty{
+		ObjectID: bacnet.ObjectID{Type: bacnet.AnalogOutput, Instance: 8121},
+		Property: bacnet.PropertyIdentifier{Type: bacnet.Units},
+	})
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+}
+
+func TestHubBroadcast(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newTestHub(t, pki)
+	a := dialNode(t, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "a")})
+	b := dialNode(t, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "b")})
+	c := dialNode(t, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "c")})
+	npdu := []byte{0x01, 0x20, 0xff, 0xff, 0x00, 0xff, 0x10, 0x08}
+	is.NoErr(a.Broadcast(npdu))
+	vmacA := a.VMAC()
+	for _, n := range []*Node{b, c} {
+		received, mac := receiveNPDU(t, n)
+		is.Equal(received, npdu)
+		is.Equal(mac, vmacA[:])
+	}
+}
+
+func TestHubDuplicateVMAC(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newTestHub(t, pki)
+	vmac := VMAC{0x02, 0, 0, 0, 0, 1}
+	dialNode(t, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "a"), VMAC: &vmac})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := Dial(ctx, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: pki.clientConfig(t, "b"), VMAC: &vmac}, bacip.NoOpLogger{})
+	var result Result
+	is.True(errors.As(err, &result))
+	is.Equal(result.ErrorCode, ErrorNodeDuplicateVMAC)
+}
+
+func TestHubCertificate(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newTestHub(t, pki)
+	other := newTestPKI(t)
+	config := other.clientConfig(t, "intruder")
+	config.RootCAs = pki.pool
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := Dial(ctx, NodeConfig{PrimaryHub: hub.URI(), TLSConfig: config}, bacip.NoOpLogger{})
+	is.True(err != nil)
+}
+
+func TestHubClientCAs(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	config := pki.serverConfig(t)
+	config.ClientCAs = nil
+	_, err := NewHub(HubConfig{Addr: "127.0.0.1:0", TLSConfig: config}, bacip.NoOpLogger{})
+	is.True(err != nil)
+}
+
+func TestDirectConnection(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newTestHub(t, pki)
+	server := httptest.NewUnstartedServer(nil)
+	server.TLS = pki.serverConfig(t)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	uri := "wss://" + server.Listener.Addr().String()
+	b := dialNode(t, NodeConfig{
+		PrimaryHub:        hub.URI(),
+		TLSConfig:         pki.clientConfig(t, "b"),
+		DirectConnectURIs: []string{uri},
+	})
+	server.Config.Handler = b
+	server.StartTLS()
+	defer server.Close()
+	a := dialNode(t, NodeConfig{
+		PrimaryHub:       hub.URI(),
+		TLSConfig:        pki.clientConfig(t, "a"),
+		ReconnectTimeout: time.Hour,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	is.NoErr(a.ConnectDirect(ctx, b.VMAC()))
+	is.True(a.directConnection(b.VMAC()) != nil)
+
+	// The direct connection doesn't need the hub
+	hub.Close()
+	npdu := []byte{0x01, 0x00, 0x10, 0x08}
+	vmacB, vmacA := b.VMAC(), a.VMAC()
+	is.NoErr(a.Send(vmacB[:], npdu))
+	received, mac := receiveNPDU(t, b)
+	is.Equal(received, npdu)
+	is.Equal(mac, vmacA[:])
+	is.NoErr(b.Send(vmacA[:], npdu))
+	received, mac = receiveNPDU(t, a)
+	is.Equal(received, npdu)
+	is.Equal(mac, vmacB[:])
+}
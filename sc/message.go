@@ -0,0 +1,384 @@
+// Package sc implements BACnet Secure Connect (Annex AB): the BVLC-SC
+// messages exchanged over WebSocket connections secured by mutual TLS.
+package sc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/REQUEA/bacnet"
+)
+
+// The WebSocket subprotocols of the hub connections and of the direct
+// connections between nodes
+const (
+	HubSubprotocol    = "hub.bsc.bacnet.org"
+	DirectSubprotocol = "dc.bsc.bacnet.org"
+)
+
+// Function is the function of a BVLC-SC message
+type Function byte
+
+const (
+	FuncResult                    Function = 0x00
+	FuncEncapsulatedNPDU          Function = 0x01
+	FuncAddressResolution         Function = 0x02
+	FuncAddressResolutionAck      Function = 0x03
+	FuncAdvertisement             Function = 0x04
+	FuncAdvertisementSolicitation Function = 0x05
+	FuncConnectRequest            Function = 0x06
+	FuncConnectAccept             Function = 0x07
+	FuncDisconnectRequest         Function = 0x08
+	FuncDisconnectAck             Function = 0x09
+	FuncHeartbeatRequest          Function = 0x0A
+	FuncHeartbeatAck              Function = 0x0B
+	FuncProprietaryMessage        Function = 0x0C
+)
+
+var functionNames = map[Function]string{
+	FuncResult:                    "BVLC-Result",
+	FuncEncapsulatedNPDU:          "Encapsulated-NPDU",
+	FuncAddressResolution:         "Address-Resolution",
+	FuncAddressResolutionAck:      "Address-Resolution-ACK",
+	FuncAdvertisement:             "Advertisement",
+	FuncAdvertisementSolicitation: "Advertisement-Solicitation",
+	FuncConnectRequest:            "Connect-Request",
+	FuncConnectAccept:             "Connect-Accept",
+	FuncDisconnectRequest:         "Disconnect-Request",
+	FuncDisconnectAck:             "Disconnect-ACK",
+	FuncHeartbeatRequest:          "Heartbeat-Request",
+	FuncHeartbeatAck:              "Heartbeat-ACK",
+	FuncProprietaryMessage:        "Proprietary-Message",
+}
+
+func (f Function) String() string {
+	if name, ok := functionNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Function(0x%02x)", byte(f))
+}
+
+// The error codes of the BVLC-Result NAKs specific to BACnet/SC
+const (
+	ErrorBVLCFunctionUnknown bacnet.ErrorCode = 143
+	ErrorHeaderNotUnderstood bacnet.ErrorCode = 146
+	ErrorNotABACnetSCHub     bacnet.ErrorCode = 148
+	ErrorNodeDuplicateVMAC   bacnet.ErrorCode = 151
+)
+
+// VMAC is the 6 bytes virtual MAC address of a BACnet/SC node
+type VMAC [6]byte
+
+// BroadcastVMAC is the destination of the broadcasts
+var BroadcastVMAC = VMAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func (v VMAC) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", v[0], v[1], v[2], v[3], v[4], v[5])
+}
+
+// RandomVMAC returns a Random-48 VMAC, a locally administered unicast
+// address
+func RandomVMAC() (VMAC, error) {
+	var v VMAC
+	_, err := rand.Read(v[:])
+	if err != nil {
+		return v, err
+	}
+	v[0] = v[0]&0xf0 | 0x02
+	return v, nil
+}
+
+// The bits of the control flags
+const (
+	flagDataOptions        = 1 << 0
+	flagDestinationOptions = 1 << 1
+	flagDestination        = 1 << 2
+	flagOrigin             = 1 << 3
+)
+
+// HeaderOption is a destination or data option of a message
+type HeaderOption struct {
+	Type           byte
+	MustUnderstand bool
+	Data           []byte
+}
+
+// Message is a BVLC-SC message
+type Message struct {
+	Function  Function
+	MessageID uint16
+	// Origin is the VMAC of the originating node, added by the hub
+	// when it forwards a message
+	Origin *VMAC
+	// Destination is the VMAC of the recipient, BroadcastVMAC for a
+	// broadcast. It is removed by the hub when it forwards an
+	// unicast message
+	Destination        *VMAC
+	DestinationOptions []HeaderOption
+	DataOptions        []HeaderOption
+	// Payload is the content of the message, the raw NPDU of an
+	// Encapsulated-NPDU
+	Payload []byte
+}
+
+func (m Message) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if m.Origin != nil {
+		flags |= flagOrigin
+	}
+	if m.Destination != nil {
+		flags |= flagDestination
+	}
+	if len(m.DestinationOptions) > 0 {
+		flags |= flagDestinationOptions
+	}
+	if len(m.DataOptions) > 0 {
+		flags |= flagDataOptions
+	}
+	b := []byte{byte(m.Function), flags}
+	b = binary.BigEndian.AppendUint16(b, m.MessageID)
+	if m.Origin != nil {
+		b = append(b, m.Origin[:]...)
+	}
+	if m.Destination != nil {
+		b = append(b, m.Destination[:]...)
+	}
+	var err error
+	b, err = appendOptions(b, m.DestinationOptions)
+	if err != nil {
+		return nil, err
+	}
+	b, err = appendOptions(b, m.DataOptions)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, m.Payload...), nil
+}
+
+func appendOptions(b []byte, options []HeaderOption) ([]byte, error) {
+	for i, o := range options {
+		if o.Type > 0x1f {
+			return nil, fmt.Errorf("invalid header option type %d", o.Type)
+		}
+		marker := optionMarker(o)
+		if i < len(options)-1 {
+			marker |= 0x80
+		}
+		b = append(b, marker)
+		if o.Data != nil {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+			b = append(b, o.Data...)
+		}
+	}
+	return b, nil
+}
+
+// optionMarker returns the marker identifying the option in a NAK
+func optionMarker(o HeaderOption) byte {
+	marker := o.Type
+	if o.MustUnderstand {
+		marker |= 0x40
+	}
+	if o.Data != nil {
+		marker |= 0x20
+	}
+	return marker
+}
+
+// ErrMessageIncomplete is returned when decoding a truncated message
+var ErrMessageIncomplete = errors.New("bvlc-sc message incomplete")
+
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return ErrMessageIncomplete
+	}
+	m.Function = Function(data[0])
+	flags := data[1]
+	m.MessageID = binary.BigEndian.Uint16(data[2:])
+	remaining := data[4:]
+	readVMAC := func() (*VMAC, error) {
+		if len(remaining) < len(VMAC{}) {
+			return nil, ErrMessageIncomplete
+		}
+		var v VMAC
+		copy(v[:], remaining)
+		remaining = remaining[len(v):]
+		return &v, nil
+	}
+	var err error
+	if flags&flagOrigin != 0 {
+		m.Origin, err = readVMAC()
+		if err != nil {
+			return err
+		}
+	}
+	if flags&flagDestination != 0 {
+		m.Destination, err = readVMAC()
+		if err != nil {
+			return err
+		}
+	}
+	if flags&flagDestinationOptions != 0 {
+		m.DestinationOptions, remaining, err = decodeOptions(remaining)
+		if err != nil {
+			return err
+		}
+	}
+	if flags&flagDataOptions != 0 {
+		m.DataOptions, remaining, err = decodeOptions(remaining)
+		if err != nil {
+			return err
+		}
+	}
+	m.Payload = append([]byte{}, remaining...)
+	return nil
+}
+
+func decodeOptions(data []byte) ([]HeaderOption, []byte, error) {
+	var options []HeaderOption
+	for {
+		if len(data) < 1 {
+			return nil, nil, ErrMessageIncomplete
+		}
+		marker := data[0]
+		data = data[1:]
+		o := HeaderOption{Type: marker & 0x1f, MustUnderstand: marker&0x40 != 0}
+		if marker&0x20 != 0 {
+			if len(data) < 2 {
+				return nil, nil, ErrMessageIncomplete
+			}
+			length := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+length {
+				return nil, nil, ErrMessageIncomplete
+			}
+			o.Data = append([]byte{}, data[2:2+length]...)
+			data = data[2+length:]
+		}
+		options = append(options, o)
+		if marker&0x80 == 0 {
+			return options, data, nil
+		}
+	}
+}
+
+// ConnectPayload is the payload of Connect-Request and Connect-Accept
+type ConnectPayload struct {
+	VMAC          VMAC
+	UUID          [16]byte
+	MaxBVLCLength uint16
+	MaxNPDULength uint16
+}
+
+func (p ConnectPayload) MarshalBinary() ([]byte, error) {
+	b := append(append([]byte{}, p.VMAC[:]...), p.UUID[:]...)
+	b = binary.BigEndian.AppendUint16(b, p.MaxBVLCLength)
+	return binary.BigEndian.AppendUint16(b, p.MaxNPDULength), nil
+}
+
+func (p *ConnectPayload) UnmarshalBinary(data []byte) error {
+	if len(data) != 26 {
+		return fmt.Errorf("invalid connect payload length %d", len(data))
+	}
+	copy(p.VMAC[:], data)
+	copy(p.UUID[:], data[6:])
+	p.MaxBVLCLength = binary.BigEndian.Uint16(data[22:])
+	p.MaxNPDULength = binary.BigEndian.Uint16(data[24:])
+	return nil
+}
+
+// Result is the payload of a BVLC-Result. A NAK is returned as error.
+type Result struct {
+	// Function is the function of the message the result answers
+	Function Function
+	NAK      bool
+	// ErrorMarker is the marker of the header option causing the
+	// NAK, 0 if the NAK isn't caused by an option
+	ErrorMarker byte
+	ErrorClass  bacnet.ErrorClass
+	ErrorCode   bacnet.ErrorCode
+	Details     string
+}
+
+func (r Result) Error() string {
+	msg := fmt.Sprintf("%v NAK: %v %v", r.Function, r.ErrorClass, r.ErrorCode)
+	if r.Details != "" {
+		msg += ": " + r.Details
+	}
+	return msg
+}
+
+func (r Result) MarshalBinary() ([]byte, error) {
+	if !r.NAK {
+		return []byte{byte(r.Function), 0x00}, nil
+	}
+	b := []byte{byte(r.Function), 0x01, r.ErrorMarker}
+	b = binary.BigEndian.AppendUint16(b, uint16(r.ErrorClass))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.ErrorCode))
+	return append(b, r.Details...), nil
+}
+
+func (r *Result) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return ErrMessageIncomplete
+	}
+	r.Function = Function(data[0])
+	r.NAK = data[1] == 0x01
+	if !r.NAK {
+		return nil
+	}
+	if len(data) < 7 {
+		return ErrMessageIncomplete
+	}
+	r.ErrorMarker = data[2]
+	r.ErrorClass = bacnet.ErrorClass(binary.BigEndian.Uint16(data[3:]))
+	r.ErrorCode = bacnet.ErrorCode(binary.BigEndian.Uint16(data[5:]))
+	r.Details = string(data[7:])
+	return nil
+}
+
+// Hub connection status of an Advertisement
+const (
+	NoHubConnection      byte = 0
+	PrimaryHubConnected  byte = 1
+	FailoverHubConnected byte = 2
+)
+
+// Advertisement is the payload of an Advertisement
+type Advertisement struct {
+	HubConnection        byte
+	AcceptDirectConnects bool
+	MaxBVLCLength        uint16
+	MaxNPDULength        uint16
+}
+
+func (a Advertisement) MarshalBinary() ([]byte, error) {
+	b := []byte{a.HubConnection, 0}
+	if a.AcceptDirectConnects {
+		b[1] = 1
+	}
+	b = binary.BigEndian.AppendUint16(b, a.MaxBVLCLength)
+	return binary.BigEndian.AppendUint16(b, a.MaxNPDULength), nil
+}
+
+func (a *Advertisement) UnmarshalBinary(data []byte) error {
+	if len(data) != 6 {
+		return fmt.Errorf("invalid advertisement length %d", len(data))
+	}
+	a.HubConnection = data[0]
+	a.AcceptDirectConnects = data[1] == 1
+	a.MaxBVLCLength = binary.BigEndian.Uint16(data[2:])
+	a.MaxNPDULength = binary.BigEndian.Uint16(data[4:])
+	return nil
+}
+
+// encodeURIs returns the payload of an Address-Resolution-ACK
+func encodeURIs(uris []string) []byte {
+	return []byte(strings.Join(uris, " "))
+}
+
+func decodeURIs(payload []byte) []string {
+	return strings.Fields(string(payload))
+}
@@ -0,0 +1,103 @@
+package sc
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/REQUEA/bacnet"
+
+	"github.com/matryer/is"
+)
+
+func TestMessageCoherency(t *testing.T) {
+	origin := VMAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	ttc := []struct {
+		name    string
+		data    string //hex string
+		message Message
+	}{
+		{
+			name:    "Heartbeat-Request",
+			data:    "0a000102",
+			message: Message{Function: FuncHeartbeatRequest, MessageID: 0x0102},
+		},
+		{
+			name: "Encapsulated-NPDU broadcast",
+			data: "01040007ffffffffffff01001008",
+			message: Message{
+				Function:    FuncEncapsulatedNPDU,
+				MessageID:   7,
+				Destination: &BroadcastVMAC,
+				Payload:     []byte{0x01, 0x00, 0x10, 0x08},
+			},
+		},
+		{
+			name: "Encapsulated-NPDU forwarded with options",
+			data: "010b00070200000000014121000201020100",
+			message: Message{
+				Function:           FuncEncapsulatedNPDU,
+				MessageID:          7,
+				Origin:             &origin,
+				DestinationOptions: []HeaderOption{{Type: 1, MustUnderstand: true}},
+				DataOptions:        []HeaderOption{{Type: 1, Data: []byte{0x01, 0x02}}},
+				Payload:            []byte{0x01, 0x00},
+			},
+		},
+	}
+	for _, tc := range ttc {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			data, err := hex.DecodeString(tc.data)
+			is.NoErr(err)
+			var m Message
+			is.NoErr(m.UnmarshalBinary(data))
+			if len(tc.message.Payload) == 0 {
+				tc.message.Payload = []byte{}
+			}
+			is.Equal(m, tc.message)
+			b, err := tc.message.MarshalBinary()
+			is.NoErr(err)
+			is.Equal(hex.EncodeToString(b), tc.data)
+		})
+	}
+}
+
+func TestMessageIncomplete(t *testing.T) {
+	is := is.New(t)
+	var m Message
+	is.Equal(m.UnmarshalBinary([]byte{0x01, 0x04, 0x00, 0x07, 0xff}), ErrMessageIncomplete)
+	is.Equal(m.UnmarshalBinary([]byte{0x01, 0x02, 0x00, 0x07, 0xa1}), ErrMessageIncomplete)
+}
+
+func TestPayloadsCoherency(t *testing.T) {
+	is := is.New(t)
+	connect := ConnectPayload{
+		VMAC:          VMAC{0x02, 0, 0, 0, 0, 1},
+		UUID:          [16]byte{1, 2, 3},
+		MaxBVLCLength: 1600,
+		MaxNPDULength: 1497,
+	}
+	b, err := connect.MarshalBinary()
+	is.NoErr(err)
+	var decodedConnect ConnectPayload
+	is.NoErr(decodedConnect.UnmarshalBinary(b))
+	is.Equal(decodedConnect, connect)
+
+	nak := Result{
+		Function:   FuncConnectRequest,
+		NAK:        true,
+		ErrorClass: bacnet.CommunicationError,
+		ErrorCode:  ErrorNodeDuplicateVMAC,
+		Details:    "duplicate",
+	}
+	b, err = nak.MarshalBinary()
+	is.NoErr(err)
+	is.Equal(hex.EncodeToString(b), "060100000700976475706c6963617465")
+	var decodedResult Result
+	is.NoErr(decodedResult.UnmarshalBinary(b))
+	is.Equal(decodedResult, nak)
+
+	vmac, err := RandomVMAC()
+	is.NoErr(err)
+	is.Equal(vmac[0]&0x0f, byte(0x02)) // locally administered unicast
+}
@@ -0,0 +1,562 @@
+package sc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+	"github.com/REQUEA/bacnet/internal/websocket"
+)
+
+// NodeConfig is the configuration of a BACnet/SC node
+type NodeConfig struct {
+	// PrimaryHub is the wss URI of the hub the node connects to
+	PrimaryHub string
+	// FailoverHub is the wss URI of the hub used when the primary hub
+	// can't be reached. Optional.
+	FailoverHub string
+	// TLSConfig holds the operational certificate of the node and the
+	// CA certificates of the hubs
+	TLSConfig *tls.Config
+	// VMAC is the virtual MAC address of the node. Default is a
+	// random VMAC, changed if the hub reports it as a duplicate.
+	VMAC *VMAC
+	// UUID identifies the device of the node. Default is random.
+	UUID [16]byte
+	// MaxBVLCLength and MaxNPDULength are the maximum sizes of the
+	// messages accepted by the node. Defaults are 1600 and 1497.
+	MaxBVLCLength uint16
+	MaxNPDULength uint16
+	// ConnectTimeout is the time waited for the connection to a hub.
+	// Default is 10 seconds.
+	ConnectTimeout time.Duration
+	// HeartbeatTimeout is the idle time after which the node checks
+	// the connection with a Heartbeat-Request. The connection is lost
+	// after twice this time without any message. Default is 300
+	// seconds.
+	HeartbeatTimeout time.Duration
+	// ReconnectTimeout is the time waited before trying again to
+	// connect when both hubs can't be reached, and between the
+	// attempts to connect again to the primary hub while connected to
+	// the failover hub. Default is 10 seconds.
+	ReconnectTimeout time.Duration
+	// DirectConnectURIs are the URIs the node accepts direct
+	// connections on with ServeHTTP, returned to the address
+	// resolutions
+	DirectConnectURIs []string
+}
+
+// ErrNotConnected is returned when sending while no hub is connected
+var ErrNotConnected = errors.New("not connected to a hub")
+
+// Node is a BACnet/SC node connected to a hub, and directly to other
+// nodes. It is a data link for the bacip client, the MAC addresses of
+// the devices being their VMAC.
+type Node struct {
+	config    NodeConfig
+	logger    bacip.Logger
+	mutex     sync.Mutex
+	vmac      VMAC
+	hub       *connection
+	direct    map[VMAC]*connection
+	messageID atomic.Uint32
+	pending   map[uint16]chan Message
+	incoming  chan received
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type received struct {
+	npdu []byte
+	mac  []byte
+}
+
+// Dial connects a node to its primary hub, or to its failover hub if
+// the primary hub can't be reached. The connection is maintained
+// until the node is closed: when it is lost, the node connects again
+// to the primary hub, or to the failover hub.
+func Dial(ctx context.Context, config NodeConfig, logger bacip.Logger) (*Node, error) {
+	if config.PrimaryHub == "" {
+		return nil, errors.New("no primary hub")
+	}
+	if config.MaxBVLCLength == 0 {
+		config.MaxBVLCLength = 1600
+	}
+	if config.MaxNPDULength == 0 {
+		config.MaxNPDULength = 1497
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 10 * time.Second
+	}
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = 300 * time.Second
+	}
+	if config.ReconnectTimeout == 0 {
+		config.ReconnectTimeout = 10 * time.Second
+	}
+	if config.UUID == [16]byte{} {
+		_, err := rand.Read(config.UUID[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	n := &Node{
+		config:   config,
+		logger:   logger,
+		pending:  map[uint16]chan Message{},
+		direct:   map[VMAC]*connection{},
+		incoming: make(chan received),
+		closed:   make(chan struct{}),
+	}
+	if config.VMAC != nil {
+		n.vmac = *config.VMAC
+	} else {
+		vmac, err := RandomVMAC()
+		if err != nil {
+			return nil, err
+		}
+		n.vmac = vmac
+	}
+	hc, err := n.connectHub(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.setHub(hc)
+	n.wg.Add(1)
+	go n.run(hc)
+	return n, nil
+}
+
+// VMAC returns the virtual MAC address of the node
+func (n *Node) VMAC() VMAC {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.vmac
+}
+
+// ConnectedHub returns the URI of the hub the node is connected to,
+// an empty string while it is disconnected
+func (n *Node) ConnectedHub() string {
+	hc := n.currentHub()
+	if hc == nil {
+		return ""
+	}
+	return hc.uri
+}
+
+func (n *Node) setHub(hc *connection) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.hub = hc
+}
+
+func (n *Node) currentHub() *connection {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.hub
+}
+
+func (n *Node) nextMessageID() uint16 {
+	return uint16(n.messageID.Add(1))
+}
+
+// connectHub connects to the primary hub, then to the failover hub
+func (n *Node) connectHub(ctx context.Context) (*connection, error) {
+	hc, err := n.connect(ctx, n.config.PrimaryHub)
+	if err == nil {
+		hc.status = PrimaryHubConnected
+		return hc, nil
+	}
+	if n.config.FailoverHub == "" {
+		return nil, err
+	}
+	hc, failoverErr := n.connect(ctx, n.config.FailoverHub)
+	if failoverErr != nil {
+		return nil, fmt.Errorf("%v, %w", err, failoverErr)
+	}
+	hc.status = FailoverHubConnected
+	return hc, nil
+}
+
+// connect opens a connection to the hub and exchanges the
+// Connect-Request and Connect-Accept
+func (n *Node) connect(ctx context.Context, uri string) (*connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.config.ConnectTimeout)
+	defer cancel()
+	conn, err := websocket.Dial(ctx, uri, n.config.TLSConfig, HubSubprotocol)
+	if err != nil {
+		return nil, fmt.Errorf("connect to hub %s: %w", uri, err)
+	}
+	hc := newConnection(conn, uri)
+	_, err = hc.connect(ctx, n.nextMessageID(), n.connectPayload())
+	if err == nil {
+		return hc, nil
+	}
+	var result Result
+	if errors.As(err, &result) && result.ErrorCode == ErrorNodeDuplicateVMAC && n.config.VMAC == nil {
+		// Another node uses the VMAC, a new one is used for the next
+		// attempt
+		if vmac, err := RandomVMAC(); err == nil {
+			n.mutex.Lock()
+			n.vmac = vmac
+			n.mutex.Unlock()
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("connect to hub %s: %w", uri, err)
+}
+
+func (n *Node) connectPayload() ConnectPayload {
+	return ConnectPayload{
+		VMAC:          n.VMAC(),
+		UUID:          n.config.UUID,
+		MaxBVLCLength: n.config.MaxBVLCLength,
+		MaxNPDULength: n.config.MaxNPDULength,
+	}
+}
+
+// run serves the hub connection and connects again when it is lost.
+// While connected to the failover hub, the node switches back to the
+// primary hub as soon as it can be reached.
+func (n *Node) run(hc *connection) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.closed:
+			// Closed while connecting
+			hc.conn.Close()
+			return
+		default:
+		}
+		primary := make(chan *connection, 1)
+		done := make(chan struct{})
+		var retry sync.WaitGroup
+		if hc.status == FailoverHubConnected {
+			retry.Add(1)
+			go func(failover *connection) {
+				defer retry.Done()
+				n.retryPrimary(failover, primary, done)
+			}(hc)
+		}
+		n.serve(hc)
+		close(done)
+		retry.Wait()
+		select {
+		case hc = <-primary:
+			n.setHub(hc)
+			continue
+		default:
+		}
+		n.setHub(nil)
+		for {
+			select {
+			case <-n.closed:
+				return
+			default:
+			}
+			var err error
+			hc, err = n.connectHub(context.Background())
+			if err == nil {
+				n.setHub(hc)
+				break
+			}
+			n.logger.Error(err.Error())
+			select {
+			case <-n.closed:
+				return
+			case <-time.After(n.config.ReconnectTimeout):
+			}
+		}
+	}
+}
+
+// retryPrimary tries to connect to the primary hub every
+// ReconnectTimeout until done is closed. When connected, it passes the
+// connection to primary and disconnects from the failover hub.
+func (n *Node) retryPrimary(failover *connection, primary chan<- *connection, done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(n.config.ReconnectTimeout):
+		}
+		hc, err := n.connect(ctx, n.config.PrimaryHub)
+		if err != nil {
+			continue
+		}
+		hc.status = PrimaryHubConnected
+		primary <- hc
+		_ = failover.write(Message{Function: FuncDisconnectRequest, MessageID: n.nextMessageID()})
+		failover.conn.Close()
+		return
+	}
+}
+
+// serve handles the messages of a hub or direct connection until the
+// connection is lost or the node is closed
+func (n *Node) serve(c *connection) {
+	defer c.conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go n.heartbeat(c, done)
+	for {
+		m, err := c.read(2 * n.config.HeartbeatTimeout)
+		if errors.Is(err, errMalformed) {
+			n.logger.Error(err)
+			continue
+		}
+		if err != nil {
+			select {
+			case <-n.closed:
+			default:
+				n.logger.Error(fmt.Sprintf("connection to %s lost: %v", c.uri, err))
+			}
+			return
+		}
+		err = n.handleMessage(c, m)
+		if errors.Is(err, errDisconnected) {
+			return
+		}
+		if err != nil {
+			n.logger.Error("handle bvlc-sc msg: ", err)
+		}
+	}
+}
+
+// heartbeat sends a Heartbeat-Request when the connection is idle
+func (n *Node) heartbeat(c *connection, done chan struct{}) {
+	timeout := n.config.HeartbeatTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, c.lastReceived.Load()))
+			if idle < timeout {
+				continue
+			}
+			err := c.write(Message{Function: FuncHeartbeatRequest, MessageID: n.nextMessageID()})
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (n *Node) handleMessage(c *connection, m Message) error {
+	if m.Origin == nil && c.peer != nil {
+		// The messages of a direct connection have no addresses
+		m.Origin = c.peer
+	}
+	switch m.Function {
+	case FuncEncapsulatedNPDU:
+		if m.Origin == nil {
+			return errors.New("encapsulated npdu without originating address")
+		}
+		if option, ok := notUnderstood(m.DestinationOptions); ok {
+			if m.Destination != nil && *m.Destination == BroadcastVMAC {
+				return nil
+			}
+			return nak(c, m, optionMarker(option), ErrorHeaderNotUnderstood)
+		}
+		select {
+		case n.incoming <- received{npdu: m.Payload, mac: append([]byte{}, m.Origin[:]...)}:
+		case <-n.closed:
+		}
+	case FuncHeartbeatRequest:
+		return c.write(Message{Function: FuncHeartbeatAck, MessageID: m.MessageID})
+	case FuncHeartbeatAck, FuncAdvertisement, FuncProprietaryMessage:
+	case FuncAddressResolution:
+		if m.Origin == nil {
+			return nil
+		}
+		if len(n.config.DirectConnectURIs) == 0 {
+			return nak(c, m, 0, bacnet.OptionalFunctionalityNotSupported)
+		}
+		return c.write(Message{
+			Function:    FuncAddressResolutionAck,
+			MessageID:   m.MessageID,
+			Destination: m.Origin,
+			Payload:     encodeURIs(n.config.DirectConnectURIs),
+		})
+	case FuncAdvertisementSolicitation:
+		if m.Origin == nil {
+			return nil
+		}
+		var status byte
+		if hc := n.currentHub(); hc != nil {
+			status = hc.status
+		}
+		payload, _ := Advertisement{
+			HubConnection:        status,
+			AcceptDirectConnects: len(n.config.DirectConnectURIs) > 0,
+			MaxBVLCLength:        n.config.MaxBVLCLength,
+			MaxNPDULength:        n.config.MaxNPDULength,
+		}.MarshalBinary()
+		return c.write(Message{
+			Function:    FuncAdvertisement,
+			MessageID:   m.MessageID,
+			Destination: m.Origin,
+			Payload:     payload,
+		})
+	case FuncAddressResolutionAck, FuncResult:
+		n.deliverAnswer(m)
+	case FuncDisconnectRequest:
+		_ = c.write(Message{Function: FuncDisconnectAck, MessageID: m.MessageID})
+		return errDisconnected
+	default:
+		return nak(c, m, 0, ErrorBVLCFunctionUnknown)
+	}
+	return nil
+}
+
+// notUnderstood returns the first option which must be understood.
+// The node doesn't understand any option.
+func notUnderstood(options []HeaderOption) (HeaderOption, bool) {
+	for _, o := range options {
+		if o.MustUnderstand {
+			return o, true
+		}
+	}
+	return HeaderOption{}, false
+}
+
+func (n *Node) deliverAnswer(m Message) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	ch, ok := n.pending[m.MessageID]
+	if !ok {
+		return
+	}
+	select {
+	case ch <- m:
+	default:
+	}
+}
+
+// ResolveAddress returns the URIs the node with the VMAC accepts
+// direct connections on
+func (n *Node) ResolveAddress(ctx context.Context, vmac VMAC) ([]string, error) {
+	hc := n.currentHub()
+	if hc == nil {
+		return nil, ErrNotConnected
+	}
+	id := n.nextMessageID()
+	ch := make(chan Message, 1)
+	n.mutex.Lock()
+	n.pending[id] = ch
+	n.mutex.Unlock()
+	defer func() {
+		n.mutex.Lock()
+		delete(n.pending, id)
+		n.mutex.Unlock()
+	}()
+	err := hc.write(Message{Function: FuncAddressResolution, MessageID: id, Destination: &vmac})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case answer := <-ch:
+		if answer.Function == FuncResult {
+			var result Result
+			err := result.UnmarshalBinary(answer.Payload)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("resolve %v: %w", vmac, result)
+		}
+		return decodeURIs(answer.Payload), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Send sends the npdu to the node with the VMAC mac, over the direct
+// connection with this node if any, else through the hub
+func (n *Node) Send(mac []byte, npdu []byte) error {
+	if len(mac) != len(VMAC{}) {
+		return fmt.Errorf("invalid BACnet/SC MAC address %x", mac)
+	}
+	var dst VMAC
+	copy(dst[:], mac)
+	return n.sendNPDU(dst, npdu)
+}
+
+// Broadcast sends the npdu to all the nodes connected to the hub
+func (n *Node) Broadcast(npdu []byte) error {
+	return n.sendNPDU(BroadcastVMAC, npdu)
+}
+
+func (n *Node) sendNPDU(dst VMAC, npdu []byte) error {
+	m := Message{
+		Function:    FuncEncapsulatedNPDU,
+		MessageID:   n.nextMessageID(),
+		Destination: &dst,
+		Payload:     npdu,
+	}
+	c := n.directConnection(dst)
+	if c != nil {
+		m.Destination = nil
+	} else if c = n.currentHub(); c == nil {
+		return ErrNotConnected
+	}
+	return c.write(m)
+}
+
+// Receive returns the next npdu and the VMAC of its sender
+func (n *Node) Receive() ([]byte, []byte, error) {
+	select {
+	case r := <-n.incoming:
+		return r.npdu, r.mac, nil
+	case <-n.closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+// MaxAPDU returns the maximum APDU length of BACnet/SC
+func (n *Node) MaxAPDU() uint {
+	return 1476
+}
+
+// Close disconnects the node from its hub and from the directly
+// connected nodes
+func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		n.mutex.Lock()
+		var conns []*connection
+		if n.hub != nil {
+			conns = append(conns, n.hub)
+		}
+		for _, c := range n.direct {
+			conns = append(conns, c)
+		}
+		n.mutex.Unlock()
+		for _, c := range conns {
+			_ = c.write(Message{Function: FuncDisconnectRequest, MessageID: n.nextMessageID()})
+			c.conn.Close()
+		}
+		n.wg.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,417 @@
+package sc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+	"github.com/REQUEA/bacnet/internal/websocket"
+
+	"github.com/matryer/is"
+)
+
+// testPKI is a CA issuing the certificates of the hubs and nodes
+type testPKI struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{cert: cert, key: key, pool: pool}
+}
+
+// certificate issues a certificate valid for 127.0.0.1, used both as
+// server and client certificate
+func (p *testPKI) certificate(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// clientConfig returns the TLS configuration of a node
+func (p *testPKI) clientConfig(t *testing.T, name string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.certificate(t, name)},
+		RootCAs:      p.pool,
+	}
+}
+
+// serverConfig returns the TLS configuration of a hub, requiring a
+// certificate of the nodes
+func (p *testPKI) serverConfig(t *testing.T) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.certificate(t, "hub")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.pool,
+	}
+}
+
+// fakeHub is a minimal hub forwarding the encapsulated npdus between
+// the connected nodes
+type fakeHub struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+	nodes  map[VMAC]*websocket.Conn
+	// down drops the connections before the Connect-Request
+	down bool
+	// beforeAccept are sent to the nodes before the Connect-Accept
+	beforeAccept []Message
+}
+
+func newFakeHub(t *testing.T, pki *testPKI) *fakeHub {
+	t.Helper()
+	h := &fakeHub{nodes: map[VMAC]*websocket.Conn{}}
+	h.server = httptest.NewUnstartedServer(http.HandlerFunc(h.serve))
+	h.server.TLS = pki.serverConfig(t)
+	h.server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	h.server.StartTLS()
+	t.Cleanup(h.close)
+	return h
+}
+
+func (h *fakeHub) uri() string {
+	return "wss" + strings.TrimPrefix(h.server.URL, "https")
+}
+
+func (h *fakeHub) setDown(down bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.down = down
+}
+
+// close drops the connections of the nodes and stops the hub
+func (h *fakeHub) close() {
+	h.mutex.Lock()
+	for _, conn := range h.nodes {
+		conn.NetConn().Close()
+	}
+	h.mutex.Unlock()
+	h.server.Close()
+}
+
+func write(conn *websocket.Conn, m Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(data)
+}
+
+func read(conn *websocket.Conn) (Message, error) {
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return Message{}, err
+	}
+	var m Message
+	err = m.UnmarshalBinary(data)
+	return m, err
+}
+
+func (h *fakeHub) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r, HubSubprotocol)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	h.mutex.Lock()
+	down, beforeAccept := h.down, h.beforeAccept
+	h.mutex.Unlock()
+	if down {
+		return
+	}
+	req, err := read(conn)
+	if err != nil || req.Function != FuncConnectRequest {
+		return
+	}
+	var connect ConnectPayload
+	if connect.UnmarshalBinary(req.Payload) != nil {
+		return
+	}
+	for _, m := range beforeAccept {
+		if m.MessageID == 0 {
+			m.MessageID = req.MessageID
+		}
+		_ = write(conn, m)
+	}
+	accept, _ := ConnectPayload{MaxBVLCLength: 1600, MaxNPDULength: 1497}.MarshalBinary()
+	_ = write(conn, Message{Function: FuncConnectAccept, MessageID: req.MessageID, Payload: accept})
+	h.mutex.Lock()
+	h.nodes[connect.VMAC] = conn
+	h.mutex.Unlock()
+	defer func() {
+		h.mutex.Lock()
+		delete(h.nodes, connect.VMAC)
+		h.mutex.Unlock()
+	}()
+	for {
+		m, err := read(conn)
+		if err != nil {
+			return
+		}
+		if m.Function == FuncHeartbeatRequest {
+			_ = write(conn, Message{Function: FuncHeartbeatAck, MessageID: m.MessageID})
+			continue
+		}
+		if m.Destination == nil {
+			continue
+		}
+		origin := connect.VMAC
+		m.Origin = &origin
+		h.mutex.Lock()
+		for vmac, dst := range h.nodes {
+			if *m.Destination == BroadcastVMAC && vmac != origin {
+				_ = write(dst, m)
+			} else if vmac == *m.Destination {
+				m.Destination = nil
+				_ = write(dst, m)
+				break
+			}
+		}
+		h.mutex.Unlock()
+	}
+}
+
+func dialNode(t *testing.T, config NodeConfig) *Node {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := Dial(ctx, config, bacip.NoOpLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// serveDevice answers the WhoIs and ReadProperty requests received by
+// the node
+func serveDevice(n *Node) {
+	ack, _ := hex.DecodeString("0c00401fb919753e91623f")
+	for {
+		data, mac, err := n.Receive()
+		if err != nil {
+			return
+		}
+		var req bacip.NPDU
+		if req.UnmarshallBinary(data) != nil || req.ADPU == nil {
+			continue
+		}
+		var answer bacip.NPDU
+		switch req.ADPU.ServiceType {
+		case bacip.ServiceUnconfirmedWhoIs:
+			answer = bacip.NPDU{Version: bacip.Version1, ADPU: &bacip.APDU{
+				DataType:    bacip.UnconfirmedServiceRequest,
+				ServiceType: bacip.ServiceUnconfirmedIAm,
+				Payload: &bacip.Iam{
+					ObjectID:      bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: 1234},
+					MaxApduLength: 1476,
+					VendorID:      260,
+				},
+			}}
+		case bacip.ServiceConfirmedReadProperty:
+			answer = bacip.NPDU{Version: bacip.Version1, ADPU: &bacip.APDU{
+				DataType:    bacip.ComplexAck,
+				ServiceType: bacip.ServiceConfirmedReadProperty,
+				InvokeID:    req.ADPU.InvokeID,
+				Payload:     &bacip.DataPayload{Bytes: ack},
+			}}
+		default:
+			continue
+		}
+		b, _ := answer.MarshalBinary()
+		_ = n.Send(mac, b)
+	}
+}
+
+func TestClientOverSC(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newFakeHub(t, pki)
+	deviceVMAC := VMAC{0x02, 0x00, 0x00, 0x00, 0x04, 0xd2}
+	device := dialNode(t, NodeConfig{PrimaryHub: hub.uri(), TLSConfig: pki.clientConfig(t, "device"), VMAC: &deviceVMAC})
+	go serveDevice(device)
+	node := dialNode(t, NodeConfig{PrimaryHub: hub.uri(), TLSConfig: pki.clientConfig(t, "client")})
+	is.Equal(node.ConnectedHub(), hub.uri())
+
+	c := bacip.NewClientWithDataLink(node, bacip.NoOpLogger{})
+	defer c.Close()
+	devices, err := c.WhoIs(bacip.WhoIs{}, 200*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(len(devices), 1)
+	is.Equal(devices[0].Addr, bacnet.Address{Mac: deviceVMAC[:]})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.ReadProperty(ctx, devices[0], bacip.ReadProperty{
+		ObjectID: bacnet.ObjectID{Type: bacnet.AnalogOutput, Instance: 8121},
+		Property: bacnet.PropertyIdentifier{Type: bacnet.Units},
+	})
+	is.NoErr(err)
+	is.Equal(v, uint32(98))
+}
+
+func TestNodeCertificate(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newFakeHub(t, pki)
+	// Certificate of another CA
+	other := newTestPKI(t)
+	config := other.clientConfig(t, "intruder")
+	config.RootCAs = pki.pool
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := Dial(ctx, NodeConfig{PrimaryHub: hub.uri(), TLSConfig: config}, bacip.NoOpLogger{})
+	is.True(err != nil)
+}
+
+func TestNodeFailover(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	primary, failover := newFakeHub(t, pki), newFakeHub(t, pki)
+	n := dialNode(t, NodeConfig{
+		PrimaryHub:       primary.uri(),
+		FailoverHub:      failover.uri(),
+		TLSConfig:        pki.clientConfig(t, "node"),
+		ReconnectTimeout: 50 * time.Millisecond,
+	})
+	is.Equal(n.ConnectedHub(), primary.uri())
+
+	primary.close()
+	deadline := time.Now().Add(5 * time.Second)
+	for n.ConnectedHub() != failover.uri() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(n.ConnectedHub(), failover.uri())
+}
+
+func TestNodePrimaryRetry(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	primary, failover := newFakeHub(t, pki), newFakeHub(t, pki)
+	primary.setDown(true)
+	n := dialNode(t, NodeConfig{
+		PrimaryHub:       primary.uri(),
+		FailoverHub:      failover.uri(),
+		TLSConfig:        pki.clientConfig(t, "node"),
+		ReconnectTimeout: 50 * time.Millisecond,
+	})
+	is.Equal(n.ConnectedHub(), failover.uri())
+
+	// The node switches back to the primary hub once it is up
+	primary.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for n.ConnectedHub() != primary.uri() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(n.ConnectedHub(), primary.uri())
+}
+
+func TestNodeConnectAnswer(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newFakeHub(t, pki)
+	advertisement, _ := Advertisement{MaxBVLCLength: 1600, MaxNPDULength: 1497}.MarshalBinary()
+	result, _ := Result{Function: FuncConnectRequest, NAK: true, ErrorCode: ErrorNodeDuplicateVMAC}.MarshalBinary()
+	// Unrelated messages and the answer of another request come first
+	hub.beforeAccept = []Message{
+		{Function: FuncAdvertisement, Payload: advertisement},
+		{Function: FuncHeartbeatRequest},
+		{Function: FuncResult, MessageID: 0xffff, Payload: result},
+	}
+	n := dialNode(t, NodeConfig{PrimaryHub: hub.uri(), TLSConfig: pki.clientConfig(t, "node")})
+	is.Equal(n.ConnectedHub(), hub.uri())
+}
+
+func TestNodeHeartbeat(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newFakeHub(t, pki)
+	n := dialNode(t, NodeConfig{
+		PrimaryHub:       hub.uri(),
+		TLSConfig:        pki.clientConfig(t, "node"),
+		HeartbeatTimeout: 40 * time.Millisecond,
+	})
+	// The heartbeats keep the idle connection alive
+	time.Sleep(200 * time.Millisecond)
+	is.Equal(n.ConnectedHub(), hub.uri())
+}
+
+func TestNodeAddressResolution(t *testing.T) {
+	is := is.New(t)
+	pki := newTestPKI(t)
+	hub := newFakeHub(t, pki)
+	withURIs := dialNode(t, NodeConfig{
+		PrimaryHub:        hub.uri(),
+		TLSConfig:         pki.clientConfig(t, "a"),
+		DirectConnectURIs: []string{"wss://10.0.0.1:4443", "wss://[fd00::1]:4443"},
+	})
+	without := dialNode(t, NodeConfig{PrimaryHub: hub.uri(), TLSConfig: pki.clientConfig(t, "b")})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	uris, err := without.ResolveAddress(ctx, withURIs.VMAC())
+	is.NoErr(err)
+	is.Equal(uris, []string{"wss://10.0.0.1:4443", "wss://[fd00::1]:4443"})
+	_, err = withURIs.ResolveAddress(ctx, without.VMAC())
+	var result Result
+	is.True(errors.As(err, &result))
+	is.Equal(result.ErrorCode, bacnet.OptionalFunctionalityNotSupported)
+}
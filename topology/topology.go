@@ -0,0 +1,313 @@
+// Package topology maps a BACnet internetwork: the networks, the
+// routers between them and the devices on each network.
+package topology
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+)
+
+// LocalNetwork is the number given to the network of the client,
+// which has no network number as seen from the client
+const LocalNetwork uint16 = 0
+
+// Client sends the requests used to crawl the internetwork. The
+// requests are broadcast on the given network, LocalNetwork being the
+// network of the client.
+type Client interface {
+	WhoIsRouter(ctx context.Context, network uint16, timeout time.Duration) ([]bacip.Router, error)
+	WhoIs(ctx context.Context, network uint16, timeout time.Duration) ([]bacnet.Device, error)
+}
+
+// IPClient returns the Client sending the requests with a BACnet/IP
+// client
+func IPClient(c *bacip.Client) Client {
+	return ipClient{c}
+}
+
+type ipClient struct {
+	c *bacip.Client
+}
+
+func (c ipClient) WhoIsRouter(ctx context.Context, network uint16, timeout time.Duration) ([]bacip.Router, error) {
+	return withContext(ctx, timeout, func(timeout time.Duration) ([]bacip.Router, error) {
+		return c.c.WhoIsRouter(timeout, bacip.WithNetwork(network))
+	})
+}
+
+func (c ipClient) WhoIs(ctx context.Context, network uint16, timeout time.Duration) ([]bacnet.Device, error) {
+	return withContext(ctx, timeout, func(timeout time.Duration) ([]bacnet.Device, error) {
+		return c.c.WhoIs(bacip.WhoIs{}, timeout, bacip.WithNetwork(network))
+	})
+}
+
+// withContext runs the request collecting answers during timeout,
+// which is shortened to the deadline of ctx. It returns as soon as ctx
+// is done.
+func withContext[T any](ctx context.Context, timeout time.Duration, request func(time.Duration) (T, error)) (T, error) {
+	var zero T
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := request(timeout)
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// Options customizes the crawl
+type Options struct {
+	// Timeout is the time waited for the answers of each request.
+	// Default is 3 seconds
+	Timeout time.Duration
+	// SubnetMask groups the BACnet/IP nodes by IP subnet. The nodes
+	// of the local network use the mask of the network interface of
+	// their subnet. The mask of the remote subnets can't be known,
+	// default is /24
+	SubnetMask net.IPMask
+}
+
+// Topology is the map of an internetwork
+type Topology struct {
+	Networks []Network `json:"networks"`
+	Routers  []Router  `json:"routers"`
+}
+
+// Network is a BACnet network and the devices found on it
+type Network struct {
+	Number uint16 `json:"number"`
+	// Subnets are the IP subnets of the BACnet/IP nodes of the
+	// network
+	Subnets []string `json:"subnets,omitempty"`
+	Devices []Device `json:"devices"`
+}
+
+// Device is a device found on a network
+type Device struct {
+	Instance bacnet.ObjectInstance `json:"instance"`
+	Vendor   uint32                `json:"vendor"`
+	Address  string                `json:"address"`
+}
+
+// Router is a router between networks
+type Router struct {
+	Address string `json:"address"`
+	// Network is the network the router was found on
+	Network uint16 `json:"network"`
+	// Networks are the networks reachable through the router
+	Networks []uint16 `json:"networks"`
+}
+
+// Map crawls the internetwork. It looks for the routers of the local
+// network, then for the routers and the devices of each network
+// reachable through them, until all the networks are visited.
+func Map(ctx context.Context, client Client, opts Options) (*Topology, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.SubnetMask == nil {
+		opts.SubnetMask = net.CIDRMask(24, 32)
+	}
+	t := &Topology{}
+	routers := map[string]bool{}
+	visited := map[uint16]bool{LocalNetwork: true}
+	queue := []uint16{LocalNetwork}
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		number := queue[0]
+		queue = queue[1:]
+		found, err := client.WhoIsRouter(ctx, number, opts.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("routers of network %d: %w", number, err)
+		}
+		for _, r := range found {
+			// Routers relay the answers of the routers of the
+			// other networks, they are found when crawling them
+			if r.Addr.Net != number {
+				continue
+			}
+			address := addressString(r.Addr)
+			if !routers[address] {
+				routers[address] = true
+				networks := append([]uint16{}, r.Networks...)
+				sort.Slice(networks, func(i, j int) bool { return networks[i] < networks[j] })
+				t.Routers = append(t.Routers, Router{Address: address, Network: number, Networks: networks})
+			}
+			for _, n := range r.Networks {
+				if !visited[n] && n != bacip.GlobalBroadcastNetwork {
+					visited[n] = true
+					queue = append(queue, n)
+				}
+			}
+		}
+		devices, err := client.WhoIs(ctx, number, opts.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("devices of network %d: %w", number, err)
+		}
+		maskOf := func(net.IP) net.IPMask { return opts.SubnetMask }
+		if number == LocalNetwork {
+			maskOf = localMask(opts.SubnetMask)
+		}
+		t.Networks = append(t.Networks, newNetwork(number, devices, maskOf))
+	}
+	sort.Slice(t.Networks, func(i, j int) bool { return t.Networks[i].Number < t.Networks[j].Number })
+	sort.Slice(t.Routers, func(i, j int) bool {
+		if t.Routers[i].Network != t.Routers[j].Network {
+			return t.Routers[i].Network < t.Routers[j].Network
+		}
+		return t.Routers[i].Address < t.Routers[j].Address
+	})
+	return t, nil
+}
+
+// interfaceAddrs returns the addresses of the network interfaces
+var interfaceAddrs = net.InterfaceAddrs
+
+// localMask returns the function giving the mask of the network
+// interface whose subnet contains an IP address, def if there is none
+func localMask(def net.IPMask) func(net.IP) net.IPMask {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return func(net.IP) net.IPMask { return def }
+	}
+	return func(ip net.IP) net.IPMask {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.Contains(ip) {
+				return ipnet.Mask
+			}
+		}
+		return def
+	}
+}
+
+func newNetwork(number uint16, devices []bacnet.Device, maskOf func(net.IP) net.IPMask) Network {
+	n := Network{Number: number, Devices: []Device{}}
+	subnets := map[string]bool{}
+	for _, d := range devices {
+		if d.Addr.Net != number {
+			// Answer of a device of another network
+			continue
+		}
+		n.Devices = append(n.Devices, Device{
+			Instance: d.ID.Instance,
+			Vendor:   d.Vendor,
+			Address:  addressString(d.Addr),
+		})
+		if ip := deviceIP(d.Addr); ip != nil {
+			mask := maskOf(ip)
+			subnet := (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+			if !subnets[subnet] {
+				subnets[subnet] = true
+				n.Subnets = append(n.Subnets, subnet)
+			}
+		}
+	}
+	sort.Strings(n.Subnets)
+	sort.Slice(n.Devices, func(i, j int) bool { return n.Devices[i].Instance < n.Devices[j].Instance })
+	return n
+}
+
+// deviceIP returns the IP address of a BACnet/IP device, nil for the
+// other data links
+func deviceIP(addr bacnet.Address) net.IP {
+	if addr.IsRemote() {
+		if len(addr.Adr) != 6 {
+			return nil
+		}
+		return net.IP(addr.Adr[:4])
+	}
+	udp := bacnet.UDPFromAddress(addr)
+	return udp.IP.To4()
+}
+
+// addressString formats the address of a node. The address of a node
+// on a remote network is prefixed by the network number.
+func addressString(addr bacnet.Address) string {
+	if !addr.IsRemote() {
+		udp := bacnet.UDPFromAddress(addr)
+		return udp.String()
+	}
+	if ip := deviceIP(addr); ip != nil {
+		udp := net.UDPAddr{IP: ip, Port: int(addr.Adr[4])<<8 | int(addr.Adr[5])}
+		return fmt.Sprintf("%d:%s", addr.Net, udp.String())
+	}
+	return fmt.Sprintf("%d:%s", addr.Net, hex.EncodeToString(addr.Adr))
+}
+
+// WriteJSON writes the topology as indented JSON
+func (t Topology) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(t)
+}
+
+// WriteDOT writes the topology as a Graphviz graph
+func (t Topology) WriteDOT(w io.Writer) error {
+	b := &strings.Builder{}
+	b.WriteString("graph bacnet {\n")
+	for _, n := range t.Networks {
+		label := fmt.Sprintf("Network %d", n.Number)
+		if n.Number == LocalNetwork {
+			label = "Local network"
+		}
+		for _, s := range n.Subnets {
+			label += "\n" + s
+		}
+		fmt.Fprintf(b, "\t%s [shape=box, label=%s];\n", dotString(networkNode(n.Number)), dotString(label))
+		for _, d := range n.Devices {
+			node := fmt.Sprintf("device:%d", d.Instance)
+			fmt.Fprintf(b, "\t%s [label=%s];\n", dotString(node), dotString(fmt.Sprintf("Device %d\n%s", d.Instance, d.Address)))
+			fmt.Fprintf(b, "\t%s -- %s;\n", dotString(networkNode(n.Number)), dotString(node))
+		}
+	}
+	for _, r := range t.Routers {
+		node := "router:" + r.Address
+		fmt.Fprintf(b, "\t%s [shape=diamond, label=%s];\n", dotString(node), dotString("Router\n"+r.Address))
+		fmt.Fprintf(b, "\t%s -- %s;\n", dotString(networkNode(r.Network)), dotString(node))
+		for _, n := range r.Networks {
+			fmt.Fprintf(b, "\t%s -- %s [style=dashed];\n", dotString(node), dotString(networkNode(n)))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func networkNode(number uint16) string {
+	return fmt.Sprintf("network:%d", number)
+}
+
+// dotString quotes s as a DOT identifier. Newlines are kept as line
+// breaks of the labels
+func dotString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
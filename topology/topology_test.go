@@ -0,0 +1,159 @@
+package topology
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/REQUEA/bacnet"
+	"github.com/REQUEA/bacnet/bacip"
+
+	"github.com/matryer/is"
+)
+
+// fakeClient answers with the routers and devices of each network
+type fakeClient struct {
+	routers map[uint16][]bacip.Router
+	devices map[uint16][]bacnet.Device
+	visited []uint16
+}
+
+func (c *fakeClient) WhoIsRouter(ctx context.Context, network uint16, timeout time.Duration) ([]bacip.Router, error) {
+	c.visited = append(c.visited, network)
+	return c.routers[network], nil
+}
+
+func (c *fakeClient) WhoIs(ctx context.Context, network uint16, timeout time.Duration) ([]bacnet.Device, error) {
+	return c.devices[network], nil
+}
+
+func device(instance bacnet.ObjectInstance, addr bacnet.Address) bacnet.Device {
+	return bacnet.Device{
+		ID:     bacnet.ObjectID{Type: bacnet.BacnetDevice, Instance: instance},
+		Vendor: 7,
+		Addr:   addr,
+	}
+}
+
+// newFakeClient builds an internetwork where the local network has a
+// router to the networks 1 and 2 (MS/TP), and the network 1 has a
+// router to the network 3 (MS/TP)
+func newFakeClient() *fakeClient {
+	router1 := bacnet.Address{Mac: []byte{4, 192, 168, 1, 1, 0xba, 0xc0}}
+	router2 := bacnet.Address{Net: 1, Adr: []byte{10, 0, 0, 1, 0xba, 0xc0}}
+	return &fakeClient{
+		routers: map[uint16][]bacip.Router{
+			LocalNetwork: {{Addr: router1, Networks: []uint16{2, 1, 3}}},
+			1: {
+				// Relayed by router1
+				{Addr: router1, Networks: []uint16{3}},
+				{Addr: router2, Networks: []uint16{3}},
+			},
+		},
+		devices: map[uint16][]bacnet.Device{
+			LocalNetwork: {
+				device(10, bacnet.Address{Mac: []byte{4, 192, 168, 1, 10, 0xba, 0xc0}}),
+				device(11, bacnet.Address{Mac: []byte{4, 192, 168, 1, 11, 0xba, 0xc0}}),
+			},
+			1: {device(100, bacnet.Address{Net: 1, Adr: []byte{10, 0, 0, 100, 0xba, 0xc0}})},
+			2: {device(200, bacnet.Address{Net: 2, Adr: []byte{5}})},
+			3: {
+				device(300, bacnet.Address{Net: 3, Adr: []byte{7}}),
+				// Answer to another request
+				device(100, bacnet.Address{Net: 1, Adr: []byte{10, 0, 0, 100, 0xba, 0xc0}}),
+			},
+		},
+	}
+}
+
+func TestMap(t *testing.T) {
+	is := is.New(t)
+	client := newFakeClient()
+	topo, err := Map(context.Background(), client, Options{Timeout: time.Millisecond})
+	is.NoErr(err)
+	is.Equal(client.visited, []uint16{LocalNetwork, 2, 1, 3}) // each network is crawled once
+	is.Equal(*topo, Topology{
+		Networks: []Network{
+			{Number: LocalNetwork, Subnets: []string{"192.168.1.0/24"}, Devices: []Device{
+				{Instance: 10, Vendor: 7, Address: "192.168.1.10:47808"},
+				{Instance: 11, Vendor: 7, Address: "192.168.1.11:47808"},
+			}},
+			{Number: 1, Subnets: []string{"10.0.0.0/24"}, Devices: []Device{
+				{Instance: 100, Vendor: 7, Address: "1:10.0.0.100:47808"},
+			}},
+			{Number: 2, Devices: []Device{{Instance: 200, Vendor: 7, Address: "2:05"}}},
+			{Number: 3, Devices: []Device{{Instance: 300, Vendor: 7, Address: "3:07"}}},
+		},
+		Routers: []Router{
+			{Address: "192.168.1.1:47808", Network: LocalNetwork, Networks: []uint16{1, 2, 3}},
+			{Address: "1:10.0.0.1:47808", Network: 1, Networks: []uint16{3}},
+		},
+	})
+
+	var b bytes.Buffer
+	is.NoErr(topo.WriteJSON(&b))
+	var decoded Topology
+	is.NoErr(json.Unmarshal(b.Bytes(), &decoded))
+	is.Equal(decoded, *topo)
+}
+
+func TestMapLocalMask(t *testing.T) {
+	is := is.New(t)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.IPv4(192, 168, 0, 2), Mask: net.CIDRMask(16, 32)}}, nil
+	}
+	t.Cleanup(func() { interfaceAddrs = net.InterfaceAddrs })
+	topo, err := Map(context.Background(), newFakeClient(), Options{Timeout: time.Millisecond})
+	is.NoErr(err)
+	is.Equal(topo.Networks[0].Subnets, []string{"192.168.0.0/16"})
+	is.Equal(topo.Networks[1].Subnets, []string{"10.0.0.0/24"}) // remote
+}
+
+func TestWithContext(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	timeouts := make(chan time.Duration, 1)
+	start := time.Now()
+	_, err := withContext(ctx, time.Minute, func(timeout time.Duration) (int, error) {
+		timeouts <- timeout
+		time.Sleep(time.Second)
+		return 1, nil
+	})
+	is.Equal(err, context.DeadlineExceeded)
+	is.True(time.Since(start) < time.Second)
+	is.True(<-timeouts <= 20*time.Millisecond) // limited to the deadline
+}
+
+func TestMapCanceled(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Map(ctx, newFakeClient(), Options{})
+	is.Equal(err, context.Canceled)
+}
+
+func TestWriteDOT(t *testing.T) {
+	is := is.New(t)
+	topo, err := Map(context.Background(), newFakeClient(), Options{Timeout: time.Millisecond})
+	is.NoErr(err)
+	var b strings.Builder
+	is.NoErr(topo.WriteDOT(&b))
+	dot := b.String()
+	is.True(strings.HasPrefix(dot, "graph bacnet {\n"))
+	is.True(strings.HasSuffix(dot, "}\n"))
+	for _, line := range []string{
+		`"network:0" [shape=box, label="Local network\n192.168.1.0/24"];`,
+		`"device:300" [label="Device 300\n3:07"];`,
+		`"network:3" -- "device:300";`,
+		`"router:192.168.1.1:47808" [shape=diamond, label="Router\n192.168.1.1:47808"];`,
+		`"network:0" -- "router:192.168.1.1:47808";`,
+		`"router:1:10.0.0.1:47808" -- "network:3" [style=dashed];`,
+	} {
+		is.True(strings.Contains(dot, "\t"+line+"\n")) // missing line
+	}
+}
@@ -123,6 +123,7 @@ type Device struct {
 type Address struct {
 	// mac_len = 0 is a broadcast address
 	// note: MAC for IP addresses uses 4 bytes for addr, 2 bytes for port
+	// For a device behind a router, it is the MAC of the router
 	Mac []byte
 	// the following are used if the device is behind a router
 	// net = 0 indicates local
@@ -130,12 +131,18 @@ type Address struct {
 	Adr []byte // hwaddr (MAC) address
 }
 
+// IsRemote returns true if the device is on a network reached through
+// a router
+func (a Address) IsRemote() bool {
+	return a.Net != 0
+}
+
 func AddressFromUDP(udp net.UDPAddr) *Address {
 	b := bytes.NewBuffer(nil)
 
-	if len(udp.IP) == net.IPv4len {
+	if ip4 := udp.IP.To4(); ip4 != nil {
 		b.WriteByte(4)
-		b.Write(udp.IP.To4())
+		b.Write(ip4)
 	} else {
 		b.WriteByte(16)
 		b.Write(udp.IP.To16())